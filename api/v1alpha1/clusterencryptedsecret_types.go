@@ -0,0 +1,94 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// NamespaceSelector selects namespaces by label and by name. A namespace is
+// selected when it matches either of them.
+type NamespaceSelector struct {
+	// LabelSelector selects namespaces by their labels
+	LabelSelector *metav1.LabelSelector `json:"labelSelector,omitempty"`
+	// Names lists namespaces explicitly
+	Names []string `json:"names,omitempty"`
+}
+
+// NamespaceStatus reports the state of the secret in one namespace
+type NamespaceStatus struct {
+	Namespace string `json:"namespace"`
+	Status    string `json:"status"`
+	Message   string `json:"message,omitempty"`
+}
+
+// ClusterEncryptedSecretStatus defines the observed state of ClusterEncryptedSecret
+type ClusterEncryptedSecretStatus struct {
+	Status  string `json:"status"`
+	Message string `json:"message"`
+	// KeyVersion lists the versions of the keys the data is encrypted with
+	KeyVersion string `json:"keyVersion,omitempty"`
+	// Failures counts the reconciliations that failed in a row. Failed
+	// reconciliations are retried with a backoff growing with it.
+	Failures int32 `json:"failures,omitempty"`
+	// Fingerprint is a hash of the ciphertexts, provider, key version and
+	// namespaces the secrets were last written from. Decryption is skipped while
+	// it doesn't change.
+	Fingerprint string `json:"fingerprint,omitempty"`
+	// Namespaces reports the secret of every selected namespace
+	Namespaces []NamespaceStatus `json:"namespaces,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:resource:scope=Cluster
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
+//+kubebuilder:printcolumn:name="Status",type=string,JSONPath=`.status.status`
+
+// ClusterEncryptedSecret is the Schema for the clusterencryptedsecrets API. It is
+// decrypted once and written as a secret into every selected namespace.
+type ClusterEncryptedSecret struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	NamespaceSelector NamespaceSelector `json:"namespaceSelector"`
+	// ProviderRef selects a ClusterEncryptionProvider instead of the provider annotation
+	ProviderRef *ProviderReference `json:"providerRef,omitempty"`
+	// DriftPolicy decides what happens when one of the secrets is changed by hand.
+	// The default of the operator is used when it isn't set.
+	//+kubebuilder:validation:Enum=Overwrite;Warn;Merge
+	DriftPolicy string `json:"driftPolicy,omitempty"`
+	// RefreshInterval is how often the secret is decrypted and written again,
+	// which also heals failures the operator isn't notified about. The default
+	// of the operator is used when it isn't set, 0 disables refreshing.
+	RefreshInterval *metav1.Duration             `json:"refreshInterval,omitempty"`
+	Data            map[string]string            `json:"data,omitempty"`
+	Status          ClusterEncryptedSecretStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// ClusterEncryptedSecretList contains a list of ClusterEncryptedSecret
+type ClusterEncryptedSecretList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ClusterEncryptedSecret `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ClusterEncryptedSecret{}, &ClusterEncryptedSecretList{})
+}
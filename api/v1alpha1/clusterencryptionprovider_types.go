@@ -0,0 +1,65 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ClusterEncryptionProviderSpec defines the provider and the namespaces allowed to use it.
+// The secrets it references must name their namespace.
+//+kubebuilder:validation:XValidation:rule="!has(self.k8s) || !has(self.k8s.keySecretRef) || has(self.k8s.keySecretRef.__namespace__)",message="k8s.keySecretRef needs a namespace"
+//+kubebuilder:validation:XValidation:rule="!has(self.awsKms) || !has(self.awsKms.auth) || !has(self.awsKms.auth.secretRef) || has(self.awsKms.auth.secretRef.__namespace__)",message="awsKms.auth.secretRef needs a namespace"
+//+kubebuilder:validation:XValidation:rule="!has(self.sops) || !has(self.sops.ageKeySecretRef) || has(self.sops.ageKeySecretRef.__namespace__)",message="sops.ageKeySecretRef needs a namespace"
+//+kubebuilder:validation:XValidation:rule="!has(self.sops) || !has(self.sops.pgpKeySecretRef) || has(self.sops.pgpKeySecretRef.__namespace__)",message="sops.pgpKeySecretRef needs a namespace"
+//+kubebuilder:validation:XValidation:rule="!has(self.sops) || !has(self.sops.kms) || !has(self.sops.kms.auth) || !has(self.sops.kms.auth.secretRef) || has(self.sops.kms.auth.secretRef.__namespace__)",message="sops.kms.auth.secretRef needs a namespace"
+type ClusterEncryptionProviderSpec struct {
+	EncryptionProviderSpec `json:",inline"`
+	// AllowedNamespaces restricts the namespaces whose EncryptedSecrets may
+	// reference the provider. Every namespace may reference it when it isn't set.
+	AllowedNamespaces *NamespaceSelector `json:"allowedNamespaces,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:resource:scope=Cluster
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Type",type=string,JSONPath=`.spec.type`
+//+kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
+//+kubebuilder:printcolumn:name="Status",type=string,JSONPath=`.status.status`
+
+// ClusterEncryptionProvider is the Schema for the clusterencryptionproviders API. It
+// configures a provider for the EncryptedSecrets of every namespace.
+type ClusterEncryptionProvider struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ClusterEncryptionProviderSpec `json:"spec,omitempty"`
+	Status EncryptionProviderStatus      `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// ClusterEncryptionProviderList contains a list of ClusterEncryptionProvider
+type ClusterEncryptionProviderList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ClusterEncryptionProvider `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ClusterEncryptionProvider{}, &ClusterEncryptionProviderList{})
+}
@@ -17,17 +17,24 @@ limitations under the License.
 package v1alpha1
 
 import (
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 //+kubebuilder:object:root=true
-//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
 
-// DecryptedSecret is the Schema for the decryptedsecrets API
+// DecryptedSecret is the Schema for the decryptedsecrets API. With the admission
+// webhooks enabled its values are encrypted before it is stored, and it is
+// replaced by an EncryptedSecret of the same name.
 type DecryptedSecret struct {
 	metav1.TypeMeta   `json:",inline"`
 	metav1.ObjectMeta `json:"metadata,omitempty"`
 
+	// ProviderRef selects the provider instead of the provider annotation
+	ProviderRef *ProviderReference `json:"providerRef,omitempty"`
+	// Type is the type of the secret the values belong to
+	Type corev1.SecretType `json:"type,omitempty"`
 	Data map[string]string `json:"data,omitempty"`
 }
 
@@ -17,18 +17,41 @@ limitations under the License.
 package v1alpha1
 
 import (
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 const (
 	EncryptedSecretStatusReady = "Ready"
 	EncryptedSecretStatusError = "Error"
+	// EncryptedSecretStatusForbidden is set when a policy refuses the provider or keys
+	EncryptedSecretStatusForbidden = "Forbidden"
+	// EncryptedSecretStatusDrifted is set when the secret was changed by hand and
+	// the drift policy keeps the changes
+	EncryptedSecretStatusDrifted = "Drifted"
+
+	// DriftPolicyOverwrite restores the values of a secret that was changed by hand
+	DriftPolicyOverwrite = "Overwrite"
+	// DriftPolicyWarn reports changes of a secret but keeps them until the
+	// encrypted values change
+	DriftPolicyWarn = "Warn"
+	// DriftPolicyMerge restores the encrypted values of a secret but keeps keys
+	// that were added by hand
+	DriftPolicyMerge = "Merge"
 )
 
 // EncryptedSecretStatus defines the observed state of EncryptedSecret
 type EncryptedSecretStatus struct {
 	Status  string `json:"status"`
 	Message string `json:"message"`
+	// KeyVersion lists the versions of the keys the data is encrypted with
+	KeyVersion string `json:"keyVersion,omitempty"`
+	// Failures counts the reconciliations that failed in a row. Failed
+	// reconciliations are retried with a backoff growing with it.
+	Failures int32 `json:"failures,omitempty"`
+	// Fingerprint is a hash of the ciphertexts, provider and key version the
+	// secret was last written from. Decryption is skipped while it doesn't change.
+	Fingerprint string `json:"fingerprint,omitempty"`
 }
 
 //+kubebuilder:object:root=true
@@ -41,7 +64,24 @@ type EncryptedSecret struct {
 	metav1.TypeMeta   `json:",inline"`
 	metav1.ObjectMeta `json:"metadata,omitempty"`
 
-	Data   map[string]string     `json:"data,omitempty"`
+	// ProviderRef selects the provider instead of the provider annotation
+	ProviderRef *ProviderReference `json:"providerRef,omitempty"`
+	// DriftPolicy decides what happens when the secret is changed by hand. The
+	// default of the operator is used when it isn't set.
+	//+kubebuilder:validation:Enum=Overwrite;Warn;Merge
+	DriftPolicy string `json:"driftPolicy,omitempty"`
+	// RefreshInterval is how often the secret is decrypted and written again,
+	// which also heals failures the operator isn't notified about. The default
+	// of the operator is used when it isn't set, 0 disables refreshing.
+	RefreshInterval *metav1.Duration `json:"refreshInterval,omitempty"`
+	// Type is the type of the secret, Opaque when it isn't set. It can't be
+	// changed once the secret exists.
+	Type corev1.SecretType `json:"type,omitempty"`
+	Data map[string]string `json:"data,omitempty"`
+	// Sops holds a document encrypted by SOPS instead of data, for the sops
+	// provider. Its values become the values of the secret once its MAC was
+	// checked.
+	Sops   string                `json:"sops,omitempty"`
 	Status EncryptedSecretStatus `json:"status,omitempty"`
 }
 
@@ -0,0 +1,151 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	EncryptionProviderKind        = "EncryptionProvider"
+	ClusterEncryptionProviderKind = "ClusterEncryptionProvider"
+
+	AWSAuthMethodDefault   = "Default"
+	AWSAuthMethodSecretRef = "SecretRef"
+)
+
+// ProviderReference references the EncryptionProvider or ClusterEncryptionProvider
+// used to decrypt the data
+type ProviderReference struct {
+	// Kind is EncryptionProvider or ClusterEncryptionProvider
+	//+kubebuilder:validation:Enum=EncryptionProvider;ClusterEncryptionProvider
+	//+kubebuilder:default=EncryptionProvider
+	Kind string `json:"kind,omitempty"`
+	Name string `json:"name"`
+}
+
+// SecretReference references a secret. The namespace is required by cluster
+// scoped resources, namespaced resources always use their own namespace.
+type SecretReference struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// K8sProviderSpec configures the k8s provider
+type K8sProviderSpec struct {
+	// KeySecretRef references the keyring or key secret holding the keys. The
+	// cryptctl-keyring and cryptctl-key secrets are used when it isn't set.
+	KeySecretRef *SecretReference `json:"keySecretRef,omitempty"`
+}
+
+// AWSAuth selects the credentials used to call KMS
+type AWSAuth struct {
+	// Method is Default to use the credentials of the operator, or SecretRef to
+	// use the credentials in SecretRef. An EncryptionProvider may only use Default
+	// when the operator allows it.
+	//+kubebuilder:validation:Enum=Default;SecretRef
+	//+kubebuilder:default=Default
+	Method string `json:"method,omitempty"`
+	// SecretRef references a secret with the access-key-id, secret-access-key
+	// and optionally session-token keys
+	SecretRef *SecretReference `json:"secretRef,omitempty"`
+	// RoleARN is assumed with the selected credentials when set
+	RoleARN string `json:"roleArn,omitempty"`
+}
+
+// AWSKMSProviderSpec configures the aws-kms provider
+type AWSKMSProviderSpec struct {
+	// KeyID is the id, ARN or alias of the KMS key new values are encrypted with
+	KeyID string `json:"keyId,omitempty"`
+	// Region overrides the AWS region of the operator
+	Region string  `json:"region,omitempty"`
+	Auth   AWSAuth `json:"auth,omitempty"`
+}
+
+// SOPSProviderSpec configures the keys the sops provider decrypts SOPS documents
+// with. Only the keys configured here are used, the keys of the operator need
+// the --sops-operator-keys flag.
+type SOPSProviderSpec struct {
+	// AgeKeySecretRef references a secret with the age identities in keys.txt.
+	// The sops-age secret is used when it isn't set.
+	AgeKeySecretRef *SecretReference `json:"ageKeySecretRef,omitempty"`
+	// PGPKeySecretRef references a secret with the armored PGP private keys in
+	// private.asc. The sops-pgp secret is used when it isn't set.
+	PGPKeySecretRef *SecretReference `json:"pgpKeySecretRef,omitempty"`
+	// KMS decrypts the KMS master keys of the documents when set. The role a
+	// document names is ignored, only the credentials configured here are used.
+	KMS *SOPSKMSSpec `json:"kms,omitempty"`
+}
+
+// SOPSKMSSpec configures the credentials of the KMS master keys of SOPS documents
+type SOPSKMSSpec struct {
+	// Region overrides the AWS region of the operator for assuming the role, KMS
+	// is called in the region of the ARN of each master key
+	Region string  `json:"region,omitempty"`
+	Auth   AWSAuth `json:"auth,omitempty"`
+}
+
+// EncryptionProviderSpec defines the provider and where its keys and credentials are
+type EncryptionProviderSpec struct {
+	// Type is the provider used to encrypt and decrypt values
+	//+kubebuilder:validation:Enum=k8s;aws-kms;sops
+	Type   string              `json:"type"`
+	K8s    *K8sProviderSpec    `json:"k8s,omitempty"`
+	AWSKMS *AWSKMSProviderSpec `json:"awsKms,omitempty"`
+	Sops   *SOPSProviderSpec   `json:"sops,omitempty"`
+	// AllowedKeyIDs restricts the keys values may be decrypted with. Every entry is
+	// a pattern matching a key id, or the last part of a KMS key ARN. Every key is
+	// allowed when it is empty.
+	AllowedKeyIDs []string `json:"allowedKeyIds,omitempty"`
+}
+
+// EncryptionProviderStatus defines the observed state of EncryptionProvider
+type EncryptionProviderStatus struct {
+	Status  string `json:"status"`
+	Message string `json:"message"`
+	// KeyVersion is the version of the key new values are encrypted with
+	KeyVersion string `json:"keyVersion,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Type",type=string,JSONPath=`.spec.type`
+//+kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
+//+kubebuilder:printcolumn:name="Status",type=string,JSONPath=`.status.status`
+
+// EncryptionProvider is the Schema for the encryptionproviders API. It configures a
+// provider for the EncryptedSecrets of its namespace.
+type EncryptionProvider struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   EncryptionProviderSpec   `json:"spec,omitempty"`
+	Status EncryptionProviderStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// EncryptionProviderList contains a list of EncryptionProvider
+type EncryptionProviderList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []EncryptionProvider `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&EncryptionProvider{}, &EncryptionProviderList{})
+}
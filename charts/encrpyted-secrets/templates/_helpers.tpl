@@ -60,3 +60,23 @@ Create the name of the service account to use
 {{- default "default" .Values.serviceAccount.name }}
 {{- end }}
 {{- end }}
+
+{{/*
+Name of the secret holding the serving certificate of the webhooks
+*/}}
+{{- define "encrpyted-secrets.webhookCertSecretName" -}}
+{{- default (printf "%s-webhook-server-cert" (include "encrpyted-secrets.fullname" .)) .Values.webhook.certSecretName }}
+{{- end }}
+
+{{/*
+Client configuration of a webhook served at path
+*/}}
+{{- define "encrpyted-secrets.webhookClientConfig" -}}
+service:
+  name: {{ include "encrpyted-secrets.fullname" .context }}-webhook-service
+  namespace: {{ .context.Release.Namespace }}
+  path: {{ .path }}
+{{- if and (not .context.Values.webhook.certManager) .context.Values.webhook.caBundle }}
+caBundle: {{ .context.Values.webhook.caBundle }}
+{{- end }}
+{{- end }}
@@ -0,0 +1,185 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/opensecrecy/encrypted-secrets/pkg/providers"
+)
+
+// defaultEditor is used when $EDITOR isn't set
+const defaultEditor = "vi"
+
+// runEdit decrypts an EncryptedSecret file into a DecryptedSecret, opens it in
+// $EDITOR and writes the result back into the file. Only values that were changed
+// or added are encrypted again, the ciphertexts of the others stay as they are so
+// that diffs only show what was edited.
+func runEdit(ctx context.Context, args []string, _ io.Reader, out io.Writer) error {
+	var flags providerFlags
+	fs := newFlagSet("edit", "<file>")
+	flags.bind(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("expected exactly one file")
+	}
+	path := fs.Arg(0)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	encryptedSecret, err := decodeEncryptedSecret(data)
+	if err != nil {
+		return err
+	}
+	decryptedSecret, err := decrypt(ctx, &flags, encryptedSecret)
+	if err != nil {
+		return err
+	}
+	plaintext, err := encodeManifest(decryptedSecret)
+	if err != nil {
+		return err
+	}
+
+	edited, err := editInEditor(ctx, filepath.Base(path), plaintext)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(edited, plaintext) {
+		fmt.Fprintf(out, "%s is unchanged\n", path)
+		return nil
+	}
+
+	editedSecret, err := decodeDecryptedSecret(edited)
+	if err != nil {
+		return err
+	}
+	cfg, err := flags.config(&editedSecret.ObjectMeta)
+	if err != nil {
+		return err
+	}
+	provider, err := newProvider(ctx, cfg)
+	if err != nil {
+		return err
+	}
+
+	encrypted, changed, err := providers.EncryptReusing(ctx, provider, *editedSecret, encryptedSecret)
+	if err != nil {
+		return err
+	}
+
+	// the fields a DecryptedSecret doesn't have are kept from the file
+	updated := encryptedSecret.DeepCopy()
+	updated.ObjectMeta = editedSecret.ObjectMeta
+	updated.ProviderRef = editedSecret.ProviderRef
+	updated.Data = encrypted.Data
+
+	manifest, err := encodeManifest(updated)
+	if err != nil {
+		return err
+	}
+	if err := writeFile(path, manifest); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "%s: encrypted %d of %d values\n", path, changed, len(encrypted.Data))
+	return nil
+}
+
+// editInEditor writes plaintext to a file named name in a private temporary
+// directory, runs $EDITOR on it and returns what the editor left in the file.
+// Everything in the directory, including backup and swap files of the editor,
+// is shredded afterwards.
+func editInEditor(ctx context.Context, name string, plaintext []byte) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "cryptctl-edit-")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := shredDir(dir); err != nil {
+			fmt.Fprintf(os.Stderr, "cryptctl: failed to shred %s %v\n", dir, err)
+		}
+	}()
+
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, plaintext, 0o600); err != nil {
+		return nil, err
+	}
+
+	editor := strings.Fields(os.Getenv("EDITOR"))
+	if len(editor) == 0 {
+		editor = []string{defaultEditor}
+	}
+	cmd := exec.CommandContext(ctx, editor[0], append(editor[1:], path)...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("editor %s failed %v", editor[0], err)
+	}
+	return os.ReadFile(path)
+}
+
+// shredDir overwrites every file in dir with zeros before removing dir, so that
+// the plaintext doesn't stay on disk. Filesystems that copy on write may still
+// keep the old blocks.
+func shredDir(dir string) error {
+	err := filepath.WalkDir(dir, func(path string, entry os.DirEntry, err error) error {
+		if err != nil || !entry.Type().IsRegular() {
+			return err
+		}
+		return shred(path)
+	})
+	if removeErr := os.RemoveAll(dir); err == nil {
+		err = removeErr
+	}
+	return err
+}
+
+// shred overwrites the file at path with zeros and flushes it to disk
+func shred(path string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := io.CopyN(file, zeros{}, info.Size()); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// zeros is an endless reader of zero bytes
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
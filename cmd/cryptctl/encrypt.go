@@ -0,0 +1,183 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+
+	secretsv1alpha1 "github.com/opensecrecy/encrypted-secrets/api/v1alpha1"
+	"github.com/opensecrecy/encrypted-secrets/pkg/providers"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// runEncrypt turns a Secret or DecryptedSecret manifest into an EncryptedSecret
+func runEncrypt(ctx context.Context, args []string, in io.Reader, out io.Writer) error {
+	var flags providerFlags
+	var input, output, previousPath string
+	fs := newFlagSet("encrypt", "")
+	flags.bind(fs)
+	flags.bindDeterministic(fs)
+	fs.StringVar(&flags.keyBundle, "key-bundle", "", "Encrypt with the key bundle written by export-key "+
+		"instead of reading the keys from the cluster.")
+	fs.StringVar(&previousPath, "previous", "", "An EncryptedSecret, usually the one written last time, whose "+
+		"ciphertexts are kept for the values that didn't change. It may not exist yet.")
+	fs.StringVar(&input, "f", "-", "The Secret or DecryptedSecret manifest, - for stdin.")
+	fs.StringVar(&output, "o", "-", "The file the EncryptedSecret is written to, - for stdout.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	data, err := readInput(input, in)
+	if err != nil {
+		return err
+	}
+	decryptedSecret, err := decodeDecryptedSecret(data)
+	if err != nil {
+		return err
+	}
+	var previous *secretsv1alpha1.EncryptedSecret
+	if previousPath != "" {
+		if previous, err = readPrevious(previousPath); err != nil {
+			return err
+		}
+	}
+	encryptedSecret, err := encrypt(ctx, &flags, decryptedSecret, previous)
+	if err != nil {
+		return err
+	}
+
+	manifest, err := encodeManifest(encryptedSecret)
+	if err != nil {
+		return err
+	}
+	return writeOutput(output, out, manifest)
+}
+
+// readPrevious reads the EncryptedSecret at path whose ciphertexts encrypt keeps,
+// which is nil when the file doesn't exist yet
+func readPrevious(path string) (*secretsv1alpha1.EncryptedSecret, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeEncryptedSecret(data)
+}
+
+// encrypt encrypts every value of decryptedSecret with the provider selected by
+// its annotations and flags. The values that previous, which may be nil, holds
+// unchanged keep their ciphertexts.
+func encrypt(ctx context.Context, flags *providerFlags, decryptedSecret *secretsv1alpha1.DecryptedSecret,
+	previous *secretsv1alpha1.EncryptedSecret) (*secretsv1alpha1.EncryptedSecret, error) {
+	cfg, err := flags.config(&decryptedSecret.ObjectMeta)
+	if err != nil {
+		return nil, err
+	}
+	provider, err := newProvider(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	encryptedSecret, _, err := providers.EncryptReusing(ctx, provider, *decryptedSecret, previous)
+	if err != nil {
+		return nil, err
+	}
+	encryptedSecret.ProviderRef = decryptedSecret.ProviderRef
+	return encryptedSecret, nil
+}
+
+// runDecrypt turns an EncryptedSecret manifest into a DecryptedSecret or Secret
+func runDecrypt(ctx context.Context, args []string, in io.Reader, out io.Writer) error {
+	var flags providerFlags
+	var input, output string
+	var toSecret bool
+	fs := newFlagSet("decrypt", "")
+	flags.bind(fs)
+	fs.StringVar(&input, "f", "-", "The EncryptedSecret manifest, - for stdin.")
+	fs.StringVar(&output, "o", "-", "The file the decrypted manifest is written to, - for stdout.")
+	fs.BoolVar(&toSecret, "secret", false, "Write a Secret instead of a DecryptedSecret.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	data, err := readInput(input, in)
+	if err != nil {
+		return err
+	}
+	encryptedSecret, err := decodeEncryptedSecret(data)
+	if err != nil {
+		return err
+	}
+	decryptedSecret, err := decrypt(ctx, &flags, encryptedSecret)
+	if err != nil {
+		return err
+	}
+
+	var manifest []byte
+	if toSecret {
+		manifest, err = encodeManifest(secretFor(decryptedSecret))
+	} else {
+		manifest, err = encodeManifest(decryptedSecret)
+	}
+	if err != nil {
+		return err
+	}
+	return writePrivateOutput(output, out, manifest)
+}
+
+// decrypt decrypts every value of encryptedSecret with the provider selected by
+// its annotations and flags
+func decrypt(ctx context.Context, flags *providerFlags, encryptedSecret *secretsv1alpha1.EncryptedSecret) (*secretsv1alpha1.DecryptedSecret, error) {
+	cfg, err := flags.config(&encryptedSecret.ObjectMeta)
+	if err != nil {
+		return nil, err
+	}
+	provider, err := newProvider(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	decryptedSecret, _, err := providers.DecryptWithProvider(ctx, provider, encryptedSecret)
+	if err != nil {
+		return nil, err
+	}
+	decryptedSecret.ProviderRef = encryptedSecret.ProviderRef
+	return decryptedSecret, nil
+}
+
+// secretFor returns the Secret the operator writes for decryptedSecret
+func secretFor(decryptedSecret *secretsv1alpha1.DecryptedSecret) *corev1.Secret {
+	secret := &corev1.Secret{
+		TypeMeta:   metav1.TypeMeta{Kind: "Secret", APIVersion: "v1"},
+		ObjectMeta: decryptedSecret.ObjectMeta,
+		Type:       decryptedSecret.Type,
+		Data:       make(map[string][]byte, len(decryptedSecret.Data)),
+	}
+	if secret.Type == "" {
+		secret.Type = corev1.SecretTypeOpaque
+	}
+	for key, value := range decryptedSecret.Data {
+		secret.Data[key] = []byte(value)
+	}
+	return secret
+}
@@ -0,0 +1,276 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+
+	secretsv1alpha1 "github.com/opensecrecy/encrypted-secrets/api/v1alpha1"
+	"github.com/opensecrecy/encrypted-secrets/pkg/providers"
+	"k8s.io/apimachinery/pkg/types"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"sigs.k8s.io/yaml"
+)
+
+// gitFilterName is the name of the filter and diff driver in the git configuration
+const gitFilterName = "cryptctl"
+
+// readIndexedBlob returns the content git has staged for path. The tests replace it.
+var readIndexedBlob = func(ctx context.Context, path string) ([]byte, error) {
+	return exec.CommandContext(ctx, "git", "cat-file", "blob", ":"+path).Output()
+}
+
+// runGitFilter is the clean and smudge filter and the textconv diff driver that
+// keep DecryptedSecrets in the working copy while git stores EncryptedSecrets
+func runGitFilter(ctx context.Context, args []string, in io.Reader, out io.Writer) error {
+	var flags providerFlags
+	fs := newFlagSet("git-filter", "clean|smudge|textconv|install [<path>]")
+	flags.bind(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var result []byte
+	var err error
+	switch fs.Arg(0) {
+	case "clean":
+		var plaintext []byte
+		if plaintext, err = io.ReadAll(in); err == nil {
+			result, err = gitClean(ctx, &flags, fs.Arg(1), plaintext)
+		}
+	case "smudge":
+		var data []byte
+		if data, err = io.ReadAll(in); err == nil {
+			result, err = gitSmudge(ctx, &flags, data)
+		}
+	case "textconv":
+		var data []byte
+		if data, err = os.ReadFile(fs.Arg(1)); err == nil {
+			result, err = gitSmudge(ctx, &flags, data)
+		}
+	case "install":
+		return installGitFilter(ctx, out)
+	default:
+		return errors.New("expected clean, smudge, textconv or install")
+	}
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(result)
+	return err
+}
+
+// gitClean encrypts the DecryptedSecrets from the working copy into the
+// EncryptedSecrets git stores. Values that didn't change since the version in the
+// index keep their ciphertext, so that files that weren't edited don't show up as
+// modified. The other documents of the file are stored as they are, but a Secret
+// or a document that can't be parsed fails instead of being stored in plaintext.
+func gitClean(ctx context.Context, flags *providerFlags, path string, plaintext []byte) ([]byte, error) {
+	documents, err := splitDocuments(plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("refusing to store %s, it isn't valid YAML %v", path, err)
+	}
+	var indexed map[types.NamespacedName]*secretsv1alpha1.EncryptedSecret
+	for i, document := range documents {
+		var fields map[string]interface{}
+		if err := yaml.Unmarshal(document, &fields); err != nil {
+			return nil, fmt.Errorf("refusing to store %s, document %d isn't valid YAML %v", path, i+1, err)
+		}
+		switch fields["kind"] {
+		case "Secret":
+			return nil, fmt.Errorf("refusing to store %s, document %d is a Secret, use a DecryptedSecret instead", path, i+1)
+		case "DecryptedSecret":
+		default:
+			continue
+		}
+
+		if indexed == nil {
+			indexed = indexedSecrets(ctx, path)
+		}
+		cleaned, err := cleanDocument(ctx, flags, fields, document, indexed)
+		if err != nil {
+			return nil, fmt.Errorf("%s document %d: %w", path, i+1, err)
+		}
+		documents[i] = append(leadingSeparator(document), cleaned...)
+	}
+	return joinDocuments(documents), nil
+}
+
+// cleanDocument encrypts the DecryptedSecret document, whose fields are fields,
+// reusing the ciphertext of the EncryptedSecret with the same name in indexed
+func cleanDocument(ctx context.Context, flags *providerFlags, fields map[string]interface{}, document []byte,
+	indexed map[types.NamespacedName]*secretsv1alpha1.EncryptedSecret) ([]byte, error) {
+
+	decryptedSecret, err := decodeDecryptedSecret(document)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := flags.config(&decryptedSecret.ObjectMeta)
+	if err != nil {
+		return nil, err
+	}
+	provider, err := newProvider(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	previous := indexed[types.NamespacedName{Namespace: decryptedSecret.Namespace, Name: decryptedSecret.Name}]
+	encrypted, _, err := providers.EncryptReusing(ctx, provider, *decryptedSecret, previous)
+	if err != nil {
+		return nil, err
+	}
+
+	// the fields of the document are kept, apart from the metadata the flags changed
+	meta, err := manifestFields(decryptedSecret)
+	if err != nil {
+		return nil, err
+	}
+	fields["kind"] = "EncryptedSecret"
+	fields["metadata"] = meta["metadata"]
+	fields["data"] = encrypted.Data
+	return yaml.Marshal(fields)
+}
+
+// indexedSecrets returns the EncryptedSecrets git has staged at path by namespace
+// and name
+func indexedSecrets(ctx context.Context, path string) map[types.NamespacedName]*secretsv1alpha1.EncryptedSecret {
+	secrets := map[types.NamespacedName]*secretsv1alpha1.EncryptedSecret{}
+	if path == "" {
+		return secrets
+	}
+	blob, err := readIndexedBlob(ctx, path)
+	if err != nil {
+		return secrets
+	}
+	documents, err := splitDocuments(blob)
+	if err != nil {
+		return secrets
+	}
+	for _, document := range documents {
+		if previous, err := decodeEncryptedSecret(document); err == nil {
+			secrets[types.NamespacedName{Namespace: previous.Namespace, Name: previous.Name}] = previous
+		}
+	}
+	return secrets
+}
+
+// splitDocuments returns the YAML documents of data. The separator data may start
+// with stays on the first document, joinDocuments puts the documents back together.
+func splitDocuments(data []byte) ([][]byte, error) {
+	var documents [][]byte
+	reader := utilyaml.NewYAMLReader(bufio.NewReader(bytes.NewReader(data)))
+	for {
+		document, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return documents, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		documents = append(documents, document)
+	}
+}
+
+// leadingSeparator returns the document separator document starts with
+func leadingSeparator(document []byte) []byte {
+	if bytes.HasPrefix(document, []byte("---\n")) {
+		return []byte("---\n")
+	}
+	return nil
+}
+
+// joinDocuments returns the documents separated by document separators
+func joinDocuments(documents [][]byte) []byte {
+	var joined []byte
+	for i, document := range documents {
+		if i > 0 {
+			if !bytes.HasSuffix(joined, []byte("\n")) {
+				joined = append(joined, '\n')
+			}
+			joined = append(joined, "---\n"...)
+		}
+		joined = append(joined, document...)
+	}
+	return joined
+}
+
+// gitSmudge decrypts the EncryptedSecrets git stores into the DecryptedSecrets of
+// the working copy, keeping every other field of the file. Anything that isn't
+// an EncryptedSecret or can't be decrypted, for lack of keys for example, is
+// checked out as it is.
+func gitSmudge(ctx context.Context, flags *providerFlags, data []byte) ([]byte, error) {
+	documents, err := splitDocuments(data)
+	if err != nil {
+		return data, nil
+	}
+	smudged := false
+	for i, document := range documents {
+		encryptedSecret, err := decodeEncryptedSecret(document)
+		if err != nil {
+			continue
+		}
+		decryptedSecret, err := decrypt(ctx, flags, encryptedSecret)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cryptctl: keeping EncryptedSecret %s encrypted, %v\n", encryptedSecret.Name, err)
+			continue
+		}
+
+		var fields map[string]interface{}
+		if err := yaml.Unmarshal(document, &fields); err != nil {
+			return nil, err
+		}
+		delete(fields, "status")
+		fields["kind"] = "DecryptedSecret"
+		fields["data"] = decryptedSecret.Data
+		decrypted, err := yaml.Marshal(fields)
+		if err != nil {
+			return nil, err
+		}
+		documents[i] = append(leadingSeparator(document), decrypted...)
+		smudged = true
+	}
+	if !smudged {
+		return data, nil
+	}
+	return joinDocuments(documents), nil
+}
+
+// installGitFilter configures the filter and diff driver in the git repository
+// of the working directory
+func installGitFilter(ctx context.Context, out io.Writer) error {
+	settings := [][2]string{
+		{"filter." + gitFilterName + ".clean", "cryptctl git-filter clean %f"},
+		{"filter." + gitFilterName + ".smudge", "cryptctl git-filter smudge %f"},
+		// never commit plaintext when encrypting fails
+		{"filter." + gitFilterName + ".required", "true"},
+		{"diff." + gitFilterName + ".textconv", "cryptctl git-filter textconv"},
+	}
+	for _, setting := range settings {
+		if output, err := exec.CommandContext(ctx, "git", "config", setting[0], setting[1]).CombinedOutput(); err != nil {
+			return fmt.Errorf("git config %s failed %v %s", setting[0], err, output)
+		}
+	}
+	fmt.Fprintf(out, "configured the %s filter, select the files in .gitattributes:\n\n", gitFilterName)
+	fmt.Fprintf(out, "secrets/*.yaml filter=%s diff=%s\n", gitFilterName, gitFilterName)
+	return nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/opensecrecy/encrypted-secrets/pkg/providers"
+)
+
+const decryptedManifest = `apiVersion: secrets.opensecrecy.org/v1alpha1
+kind: DecryptedSecret
+metadata:
+  name: db
+  namespace: default
+  annotations:
+    secrets.opensecrecy.org/provider: k8s
+driftPolicy: Warn
+data:
+  username: admin
+  password: hunter2
+`
+
+// useIndex makes the clean filter see blob as the staged version of every file
+func useIndex(t *testing.T, blob []byte) {
+	previous := readIndexedBlob
+	readIndexedBlob = func(context.Context, string) ([]byte, error) {
+		if blob == nil {
+			return nil, errors.New("not staged")
+		}
+		return blob, nil
+	}
+	t.Cleanup(func() { readIndexedBlob = previous })
+}
+
+func TestGitFilterRoundTripIsStable(t *testing.T) {
+	useKeyring(t, "v1")
+	ctx := context.Background()
+	flags := &providerFlags{}
+
+	useIndex(t, nil)
+	stored, err := gitClean(ctx, flags, "db.yaml", []byte(decryptedManifest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(stored), "kind: EncryptedSecret") || !strings.Contains(string(stored), "driftPolicy: Warn") ||
+		strings.Contains(string(stored), "hunter2") {
+		t.Fatalf("unexpected stored file\n%s", stored)
+	}
+
+	checkedOut, err := gitSmudge(ctx, flags, stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(checkedOut), "kind: DecryptedSecret") || !strings.Contains(string(checkedOut), "password: hunter2") ||
+		!strings.Contains(string(checkedOut), "driftPolicy: Warn") {
+		t.Fatalf("unexpected working copy\n%s", checkedOut)
+	}
+
+	// cleaning the checked out file again gives the stored file byte for byte
+	useIndex(t, stored)
+	cleaned, err := gitClean(ctx, flags, "db.yaml", checkedOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(cleaned) != string(stored) {
+		t.Fatalf("expected an unchanged file to stay the same\n%s\n%s", stored, cleaned)
+	}
+
+	// only the edited value gets a new ciphertext
+	edited := strings.Replace(string(checkedOut), "hunter2", "correct-horse", 1)
+	cleaned, err = gitClean(ctx, flags, "db.yaml", []byte(edited))
+	if err != nil {
+		t.Fatal(err)
+	}
+	storedLines, cleanedLines := strings.Split(string(stored), "\n"), strings.Split(string(cleaned), "\n")
+	changed := 0
+	for i := range storedLines {
+		if storedLines[i] != cleanedLines[i] {
+			changed++
+			if !strings.Contains(cleanedLines[i], "password:") {
+				t.Fatalf("unexpected change %q", cleanedLines[i])
+			}
+		}
+	}
+	if changed != 1 {
+		t.Fatalf("expected one changed line, got %d", changed)
+	}
+}
+
+func TestGitCleanRefusesBrokenDecryptedSecrets(t *testing.T) {
+	useIndex(t, nil)
+	// a tab in the indentation is a YAML error
+	broken := []byte(strings.Replace(decryptedManifest, "  password: hunter2", "\tpassword: hunter2", 1))
+	out, err := gitClean(context.Background(), &providerFlags{}, "secrets/db.yaml", broken)
+	if err == nil || !strings.Contains(err.Error(), "refusing to store secrets/db.yaml") {
+		t.Fatalf("expected the broken DecryptedSecret to be refused, got %v", err)
+	}
+	if strings.Contains(string(out), "hunter2") {
+		t.Fatalf("expected no plaintext in the output, got %s", out)
+	}
+
+	// neither are files that aren't YAML
+	text := []byte("password:\thunter2\n\tkind: notes\n")
+	if out, err := gitClean(context.Background(), &providerFlags{}, "notes.txt", text); err == nil || out != nil {
+		t.Fatalf("expected the file that isn't YAML to be refused, got %s %v", out, err)
+	}
+
+	// nor Secrets, which would be stored in plaintext
+	secret := []byte("apiVersion: v1\nkind: Secret\nmetadata:\n  name: db\nstringData:\n  password: hunter2\n")
+	if out, err := gitClean(context.Background(), &providerFlags{}, "secrets/db.yaml", secret); err == nil || out != nil {
+		t.Fatalf("expected the Secret to be refused, got %s %v", out, err)
+	}
+}
+
+func TestGitFilterEncryptsEveryDocument(t *testing.T) {
+	useKeyring(t, "v1")
+	ctx := context.Background()
+	flags := &providerFlags{}
+
+	configMap := "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: settings\ndata:\n  level: debug\n"
+	second := strings.NewReplacer("name: db", "name: cache", "hunter2", "swordfish").Replace(decryptedManifest)
+	plaintext := "---\n" + configMap + "---\n" + decryptedManifest + "---\n" + second
+
+	useIndex(t, nil)
+	stored, err := gitClean(ctx, flags, "secrets.yaml", []byte(plaintext))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(stored), "---\n"+configMap+"---\n") || strings.Count(string(stored), "kind: EncryptedSecret") != 2 ||
+		strings.Contains(string(stored), "hunter2") || strings.Contains(string(stored), "swordfish") {
+		t.Fatalf("unexpected stored file\n%s", stored)
+	}
+
+	checkedOut, err := gitSmudge(ctx, flags, stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(checkedOut), "---\n"+configMap+"---\n") || strings.Count(string(checkedOut), "kind: DecryptedSecret") != 2 ||
+		!strings.Contains(string(checkedOut), "password: hunter2") || !strings.Contains(string(checkedOut), "password: swordfish") {
+		t.Fatalf("unexpected working copy\n%s", checkedOut)
+	}
+
+	// every DecryptedSecret keeps the ciphertext of its own staged version
+	useIndex(t, stored)
+	cleaned, err := gitClean(ctx, flags, "secrets.yaml", checkedOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(cleaned) != string(stored) {
+		t.Fatalf("expected an unchanged file to stay the same\n%s\n%s", stored, cleaned)
+	}
+
+	// a Secret or a broken document anywhere in the file fails the whole file
+	secret := "apiVersion: v1\nkind: Secret\nmetadata:\n  name: db\nstringData:\n  password: hunter2\n"
+	broken := "kind: ConfigMap\ndata:\n\tlevel: debug\n"
+	for _, document := range []string{secret, broken} {
+		out, err := gitClean(ctx, flags, "secrets.yaml", []byte(plaintext+"---\n"+document))
+		if err == nil || !strings.Contains(err.Error(), "document 4") || out != nil {
+			t.Fatalf("expected the file to be refused, got %s %v", out, err)
+		}
+	}
+}
+
+func TestGitSmudgeKeepsWhatItCantDecrypt(t *testing.T) {
+	ctx := context.Background()
+	previous := newProvider
+	newProvider = func(context.Context, providers.Config) (providers.Provider, error) {
+		return nil, errors.New("no access to the cluster")
+	}
+	t.Cleanup(func() { newProvider = previous })
+
+	configMap := []byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: settings\n")
+	if out, err := gitSmudge(ctx, &providerFlags{}, configMap); err != nil || string(out) != string(configMap) {
+		t.Fatalf("expected other files to be checked out as they are, got %s %v", out, err)
+	}
+
+	encrypted := []byte("apiVersion: secrets.opensecrecy.org/v1alpha1\nkind: EncryptedSecret\nmetadata:\n  name: db\n" +
+		"  namespace: default\n  annotations:\n    secrets.opensecrecy.org/provider: k8s\ndata:\n  password: c2VjcmV0\n")
+	if out, err := gitSmudge(ctx, &providerFlags{}, encrypted); err != nil || string(out) != string(encrypted) {
+		t.Fatalf("expected the EncryptedSecret to be checked out encrypted, got %s %v", out, err)
+	}
+}
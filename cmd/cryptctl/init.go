@@ -0,0 +1,110 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/opensecrecy/encrypted-secrets/pkg/providers"
+)
+
+// runInit creates the key secret of the k8s provider or the KMS key of aws-kms
+func runInit(ctx context.Context, args []string, _ io.Reader, out io.Writer) error {
+	var flags providerFlags
+	var keyType string
+	var printKey bool
+	fs := newFlagSet("init", "")
+	flags.bind(fs)
+	fs.StringVar(&keyType, "key-type", providers.KeyTypePassphrase, "The type of the k8s key, passphrase or x25519. "+
+		"The public key of an x25519 key can be exported with export-key to encrypt without cluster access.")
+	fs.BoolVar(&printKey, "print", false, "Print a new k8s key to add to an existing keyring instead of creating a key secret.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if flags.provider == "" {
+		return errors.New("no provider, pass -p")
+	}
+	if printKey {
+		if flags.provider != providers.K8sProvider {
+			return errors.New("only k8s keys can be printed")
+		}
+		key, err := providers.GenerateK8sKey(keyType)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, key)
+		return nil
+	}
+
+	cfg := providers.Config{
+		Provider:      flags.provider,
+		Namespace:     flags.namespace,
+		KeySecretName: flags.keySecretName,
+		KMSKeyID:      flags.kmsKeyID,
+		Region:        flags.region,
+	}
+	keyVersion, err := providers.InitKey(ctx, cfg, keyType)
+	if err != nil {
+		return err
+	}
+
+	switch cfg.Provider {
+	case providers.K8sProvider:
+		name := cfg.KeySecretName
+		if name == "" {
+			name = providers.K8sKeySecretName
+		}
+		fmt.Fprintf(out, "created key secret %s in namespace %s with key version %s\n", name, cfg.Namespace, keyVersion)
+	default:
+		fmt.Fprintf(out, "created KMS key %s\n", keyVersion)
+	}
+	return nil
+}
+
+// runExportKey writes the key bundle of the k8s provider of a namespace, which
+// encrypt uses to encrypt without cluster access
+func runExportKey(ctx context.Context, args []string, _ io.Reader, out io.Writer) error {
+	var namespace, keySecretName, output string
+	fs := newFlagSet("export-key", "")
+	fs.StringVar(&namespace, "n", "", "The namespace holding the keys of the k8s provider.")
+	fs.StringVar(&keySecretName, "key-secret", "", "The keyring or key secret of the k8s provider.")
+	fs.StringVar(&output, "o", "-", "The file the key bundle is written to, - for stdout.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if namespace == "" {
+		return errors.New("no namespace, pass -n")
+	}
+
+	bundle, err := providers.ExportKeyBundle(ctx, providers.Config{
+		Provider:      providers.K8sProvider,
+		Namespace:     namespace,
+		KeySecretName: keySecretName,
+	})
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(bundle, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writePrivateOutput(output, out, append(data, '\n'))
+}
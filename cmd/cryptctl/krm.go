@@ -0,0 +1,293 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	secretsv1alpha1 "github.com/opensecrecy/encrypted-secrets/api/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// krmExecName makes cryptctl run as a KRM function when it is called by this
+	// name, as kustomize runs exec functions without arguments
+	krmExecName = "cryptctl-krm"
+
+	generatorKind  = "EncryptedSecretGenerator"
+	krmModeEncrypt = "encrypt"
+	krmModeDecrypt = "decrypt"
+)
+
+// krmAnnotationPrefixes start the annotations of the function config that belong
+// to kustomize and aren't copied to the generated resources
+var krmAnnotationPrefixes = []string{
+	"config.kubernetes.io/",
+	"config.k8s.io/",
+	"internal.config.kubernetes.io/",
+	"kustomize.config.k8s.io/",
+}
+
+// resourceList is the input and output of a KRM function
+type resourceList struct {
+	APIVersion     string                       `json:"apiVersion"`
+	Kind           string                       `json:"kind"`
+	Items          []*unstructured.Unstructured `json:"items"`
+	FunctionConfig *unstructured.Unstructured   `json:"functionConfig,omitempty"`
+}
+
+// encryptedSecretGenerator is the function config. Like a secretGenerator of
+// kustomize it collects values from files, env files and literals, which end up
+// encrypted in an EncryptedSecret of the same name. In decrypt mode it turns the
+// EncryptedSecrets of the input into Secrets instead.
+type encryptedSecretGenerator struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	// Mode is encrypt, the default, or decrypt
+	Mode string `json:"mode,omitempty"`
+
+	Provider  string `json:"provider,omitempty"`
+	KMSKeyID  string `json:"kmsKeyId,omitempty"`
+	Region    string `json:"region,omitempty"`
+	KeySecret string `json:"keySecret,omitempty"`
+	KeyBundle string `json:"keyBundle,omitempty"`
+	// Deterministic encrypts equal values to equal ciphertexts, so that the output
+	// only changes with the values
+	Deterministic bool `json:"deterministic,omitempty"`
+
+	// Files are read into values, as [key=]path with the file name as the default key
+	Files []string `json:"files,omitempty"`
+	// Envs are files of key=value lines
+	Envs     []string `json:"envs,omitempty"`
+	Literals []string `json:"literals,omitempty"`
+}
+
+// runKRM runs cryptctl as a KRM function, reading a ResourceList from in and
+// writing it to out
+func runKRM(ctx context.Context, args []string, in io.Reader, out io.Writer) error {
+	fs := newFlagSet("krm", "")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	data, err := io.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	list := &resourceList{}
+	if err := yaml.Unmarshal(data, list); err != nil {
+		return fmt.Errorf("invalid ResourceList %v", err)
+	}
+	if list.FunctionConfig == nil {
+		return errors.New("no function config")
+	}
+	generator := &encryptedSecretGenerator{}
+	if err := convert(list.FunctionConfig, generator); err != nil {
+		return err
+	}
+	if generator.Kind != generatorKind {
+		return fmt.Errorf("expected an %s function config, got %q", generatorKind, generator.Kind)
+	}
+
+	flags := providerFlags{
+		provider:      generator.Provider,
+		kmsKeyID:      generator.KMSKeyID,
+		region:        generator.Region,
+		keySecretName: generator.KeySecret,
+		keyBundle:     generator.KeyBundle,
+		deterministic: generator.Deterministic,
+	}
+	switch generator.Mode {
+	case "", krmModeEncrypt:
+		err = generateEncryptedSecret(ctx, &flags, generator, list)
+	case krmModeDecrypt:
+		// a key bundle only encrypts, decrypting needs the keys
+		flags.keyBundle = ""
+		err = decryptItems(ctx, &flags, list)
+	default:
+		err = fmt.Errorf("invalid mode %s", generator.Mode)
+	}
+	if err != nil {
+		return err
+	}
+
+	manifest, err := yaml.Marshal(list)
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(manifest)
+	return err
+}
+
+// generateEncryptedSecret adds the EncryptedSecret of generator to list
+func generateEncryptedSecret(ctx context.Context, flags *providerFlags, generator *encryptedSecretGenerator, list *resourceList) error {
+	values, err := generatorValues(generator)
+	if err != nil {
+		return err
+	}
+
+	decryptedSecret := &secretsv1alpha1.DecryptedSecret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        generator.Name,
+			Namespace:   generator.Namespace,
+			Labels:      generator.Labels,
+			Annotations: resourceAnnotations(generator.Annotations),
+		},
+		Data: values,
+	}
+	encryptedSecret, err := encrypt(ctx, flags, decryptedSecret, nil)
+	if err != nil {
+		return err
+	}
+	fields, err := manifestFields(encryptedSecret)
+	if err != nil {
+		return err
+	}
+	list.Items = append(list.Items, &unstructured.Unstructured{Object: fields})
+	return nil
+}
+
+// decryptItems replaces the EncryptedSecrets of list with the Secrets the
+// operator would write for them
+func decryptItems(ctx context.Context, flags *providerFlags, list *resourceList) error {
+	for i, item := range list.Items {
+		if item.GetKind() != "EncryptedSecret" {
+			continue
+		}
+		encryptedSecret := &secretsv1alpha1.EncryptedSecret{}
+		if err := convert(item, encryptedSecret); err != nil {
+			return err
+		}
+		decryptedSecret, err := decrypt(ctx, flags, encryptedSecret)
+		if err != nil {
+			return fmt.Errorf("EncryptedSecret %s: %w", item.GetName(), err)
+		}
+		fields, err := manifestFields(secretFor(decryptedSecret))
+		if err != nil {
+			return err
+		}
+		list.Items[i] = &unstructured.Unstructured{Object: fields}
+	}
+	return nil
+}
+
+// generatorValues collects the values of generator. Keys may only be used once.
+func generatorValues(generator *encryptedSecretGenerator) (map[string]string, error) {
+	values := make(map[string]string)
+	add := func(key, value string) error {
+		if _, ok := values[key]; ok {
+			return fmt.Errorf("duplicate key %s", key)
+		}
+		values[key] = value
+		return nil
+	}
+
+	for _, literal := range generator.Literals {
+		key, value, ok := strings.Cut(literal, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid literal %q, expected key=value", literal)
+		}
+		if err := add(key, value); err != nil {
+			return nil, err
+		}
+	}
+	for _, file := range generator.Files {
+		key, path, ok := strings.Cut(file, "=")
+		if !ok {
+			key, path = filepath.Base(file), file
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := add(key, string(data)); err != nil {
+			return nil, err
+		}
+	}
+	for _, env := range generator.Envs {
+		data, err := os.ReadFile(env)
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for line := 1; scanner.Scan(); line++ {
+			text := strings.TrimSpace(scanner.Text())
+			if text == "" || strings.HasPrefix(text, "#") {
+				continue
+			}
+			key, value, ok := strings.Cut(text, "=")
+			if !ok || strings.TrimSpace(key) == "" {
+				return nil, fmt.Errorf("%s:%d: expected key=value", env, line)
+			}
+			if err := add(strings.TrimSpace(key), value); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return values, nil
+}
+
+// resourceAnnotations returns the annotations of the function config without
+// those of kustomize
+func resourceAnnotations(annotations map[string]string) map[string]string {
+	return withoutPrefixes(annotations, krmAnnotationPrefixes)
+}
+
+// withoutPrefixes returns annotations without those starting with one of prefixes
+func withoutPrefixes(annotations map[string]string, prefixes []string) map[string]string {
+	var kept map[string]string
+	for key, value := range annotations {
+		if hasAnyPrefix(key, prefixes) {
+			continue
+		}
+		if kept == nil {
+			kept = make(map[string]string)
+		}
+		kept[key] = value
+	}
+	return kept
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// convert converts an unstructured object into the typed object obj
+func convert(u *unstructured.Unstructured, obj interface{}) error {
+	data, err := json.Marshal(u.Object)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, obj)
+}
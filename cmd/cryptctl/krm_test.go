@@ -0,0 +1,74 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestKRMGeneratesEncryptedSecret(t *testing.T) {
+	bundle, keyring := writeKeyBundle(t)
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "tls.key"), []byte("private"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "db.env"), []byte("# database\nUSER=admin\n\nPASSWORD=hunter2\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	input := `apiVersion: config.kubernetes.io/v1
+kind: ResourceList
+items:
+- apiVersion: v1
+  kind: ConfigMap
+  metadata:
+    name: settings
+functionConfig:
+  apiVersion: secrets.opensecrecy.org/v1alpha1
+  kind: EncryptedSecretGenerator
+  metadata:
+    name: db
+    namespace: default
+    labels:
+      app: db
+    annotations:
+      config.kubernetes.io/function: |
+        exec:
+          path: cryptctl-krm
+  keyBundle: ` + bundle + `
+  files:
+  - ` + filepath.Join(dir, "tls.key") + `
+  envs:
+  - ` + filepath.Join(dir, "db.env") + `
+  literals:
+  - host=db.default.svc
+`
+	output := run(t, "krm", input)
+	for _, want := range []string{"kind: ConfigMap", "kind: EncryptedSecret", "name: db", "app: db", "tls.key:", "USER:", "PASSWORD:", "host:"} {
+		if !strings.Contains(output, want) {
+			t.Fatalf("expected %q in\n%s", want, output)
+		}
+	}
+	for _, unwanted := range []string{"hunter2", "config.kubernetes.io/function:\n      exec"} {
+		if strings.Contains(output, unwanted) {
+			t.Fatalf("unexpected %q in\n%s", unwanted, output)
+		}
+	}
+
+	// decrypt mode renders the generated EncryptedSecret as a Secret
+	useProvider(t, &keyringProvider{keyring: keyring})
+	decryptInput := strings.Replace(output, "kind: EncryptedSecretGenerator", "kind: EncryptedSecretGenerator\n  mode: decrypt", 1)
+	decrypted := run(t, "krm", decryptInput)
+	if strings.Contains(decrypted, "kind: EncryptedSecret\n") || !strings.Contains(decrypted, "kind: Secret") ||
+		!strings.Contains(decrypted, "PASSWORD: aHVudGVyMg==") {
+		t.Fatalf("expected the EncryptedSecret to be decrypted\n%s", decrypted)
+	}
+}
+
+func TestKRMRejectsDuplicateKeys(t *testing.T) {
+	_, err := generatorValues(&encryptedSecretGenerator{Literals: []string{"a=1", "a=2"}})
+	if err == nil || !strings.Contains(err.Error(), "duplicate key a") {
+		t.Fatalf("expected a duplicate key error, got %v", err)
+	}
+}
@@ -0,0 +1,139 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// cryptctl creates the keys of the providers and turns Secret and DecryptedSecret
+// manifests into EncryptedSecret manifests and back, with the same provider code
+// the operator decrypts them with.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// command is a subcommand of cryptctl
+type command struct {
+	usage string
+	run   func(ctx context.Context, args []string, in io.Reader, out io.Writer) error
+}
+
+var commands = map[string]command{
+	"init": {
+		usage: "create the key of a provider",
+		run:   runInit,
+	},
+	"encrypt": {
+		usage: "encrypt a Secret or DecryptedSecret manifest into an EncryptedSecret",
+		run:   runEncrypt,
+	},
+	"decrypt": {
+		usage: "decrypt an EncryptedSecret manifest into a DecryptedSecret or Secret",
+		run:   runDecrypt,
+	},
+	"export-key": {
+		usage: "write the key bundle that encrypts for a namespace without cluster access",
+		run:   runExportKey,
+	},
+	"edit": {
+		usage: "edit the values of an EncryptedSecret manifest in $EDITOR",
+		run:   runEdit,
+	},
+	"git-filter": {
+		usage: "keep DecryptedSecrets in the working copy while git stores EncryptedSecrets",
+		run:   runGitFilter,
+	},
+	"import": {
+		usage: "decrypt SealedSecrets or a SOPS encrypted file and encrypt them into EncryptedSecrets",
+		run:   runImport,
+	},
+	"export": {
+		usage: "decrypt an EncryptedSecret into a SealedSecret",
+		run:   runExport,
+	},
+	"krm": {
+		usage: "run as a KRM function generating or decrypting EncryptedSecrets, also when called " + krmExecName,
+		run:   runKRM,
+	},
+	"post-render": {
+		usage: "replace the selected Secrets of rendered manifests with EncryptedSecrets, as a Helm post-renderer",
+		run:   runPostRender,
+	},
+	"rotate": {
+		usage: "re-encrypt EncryptedSecret manifests with the primary key of their provider",
+		run:   runRotate,
+	},
+}
+
+func main() {
+	if filepath.Base(os.Args[0]) == krmExecName {
+		if err := runKRM(context.Background(), os.Args[1:], os.Stdin, os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", krmExecName, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "cryptctl: unknown command %s\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+
+	err := cmd.run(context.Background(), os.Args[2:], os.Stdin, os.Stdout)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cryptctl %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(os.Stderr, "Usage: cryptctl <command> [flags]")
+	fmt.Fprintln(os.Stderr, "\nCommands:")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, commands[name].usage)
+	}
+	fmt.Fprintln(os.Stderr, "\nRun cryptctl <command> -h for the flags of a command.")
+}
+
+// newFlagSet returns the flag set of the command name, which reports errors
+// instead of exiting
+func newFlagSet(name, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet("cryptctl "+name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: cryptctl %s [flags] %s\n\nFlags:\n", name, args)
+		fs.PrintDefaults()
+	}
+	return fs
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/opensecrecy/encrypted-secrets/pkg/providers"
+)
+
+// keyringProvider stands in for the k8s provider without a cluster
+type keyringProvider struct {
+	keyring *providers.Keyring
+}
+
+func (p *keyringProvider) Encrypt(_ context.Context, value string) (string, error) {
+	return p.keyring.Encrypt(value)
+}
+
+func (p *keyringProvider) Decrypt(_ context.Context, encoded string) (string, string, error) {
+	return p.keyring.Decrypt(encoded)
+}
+
+func (p *keyringProvider) PrimaryKeyVersion(_ context.Context) (string, error) {
+	return p.keyring.Primary(), nil
+}
+
+// useKeyring makes every command use a keyring with the keys v1 and v2 and
+// primary as its primary key
+func useKeyring(t *testing.T, primary string) {
+	keyring, err := providers.NewKeyring(primary, map[string]string{"v1": "first", "v2": "second"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := newProvider
+	newProvider = func(_ context.Context, cfg providers.Config) (providers.Provider, error) {
+		if cfg.Provider != providers.K8sProvider || cfg.Namespace == "" {
+			t.Fatalf("unexpected provider configuration %+v", cfg)
+		}
+		return &keyringProvider{keyring: keyring}, nil
+	}
+	t.Cleanup(func() { newProvider = previous })
+}
+
+const secretManifest = `apiVersion: v1
+kind: Secret
+metadata:
+  name: db
+  labels:
+    app: db
+data:
+  username: YWRtaW4=
+stringData:
+  password: hunter2
+`
+
+func run(t *testing.T, name string, in string, args ...string) string {
+	var out bytes.Buffer
+	if err := commands[name].run(context.Background(), args, strings.NewReader(in), &out); err != nil {
+		t.Fatalf("cryptctl %s: %v", name, err)
+	}
+	return out.String()
+}
+
+func TestEncryptAndDecryptSecret(t *testing.T) {
+	useKeyring(t, "v1")
+
+	encrypted := run(t, "encrypt", secretManifest, "-p", "k8s", "-n", "default")
+	for _, want := range []string{"kind: EncryptedSecret", "namespace: default", "secrets.opensecrecy.org/provider: k8s", "app: db"} {
+		if !strings.Contains(encrypted, want) {
+			t.Fatalf("expected %q in\n%s", want, encrypted)
+		}
+	}
+	for _, unwanted := range []string{"hunter2", "YWRtaW4=", "status:", "creationTimestamp"} {
+		if strings.Contains(encrypted, unwanted) {
+			t.Fatalf("unexpected %q in\n%s", unwanted, encrypted)
+		}
+	}
+
+	decrypted := run(t, "decrypt", encrypted)
+	if !strings.Contains(decrypted, "kind: DecryptedSecret") || !strings.Contains(decrypted, "password: hunter2") ||
+		!strings.Contains(decrypted, "username: admin") {
+		t.Fatalf("unexpected DecryptedSecret\n%s", decrypted)
+	}
+
+	secret := run(t, "decrypt", encrypted, "--secret")
+	if !strings.Contains(secret, "kind: Secret") || !strings.Contains(secret, "password: aHVudGVyMg==") {
+		t.Fatalf("unexpected Secret\n%s", secret)
+	}
+}
+
+func TestDecryptWritesPrivateFiles(t *testing.T) {
+	useKeyring(t, "v1")
+	encrypted := run(t, "encrypt", secretManifest, "-p", "k8s", "-n", "default")
+
+	dir := t.TempDir()
+	created, existing := filepath.Join(dir, "created.yaml"), filepath.Join(dir, "existing.yaml")
+	if err := os.WriteFile(existing, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{created, existing} {
+		run(t, "decrypt", encrypted, "-o", path)
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mode := info.Mode().Perm(); mode != 0o600 {
+			t.Fatalf("expected %s to be written with mode 0600, got %o", filepath.Base(path), mode)
+		}
+	}
+}
+
+func TestEncryptNeedsProvider(t *testing.T) {
+	useKeyring(t, "v1")
+
+	var out bytes.Buffer
+	err := runEncrypt(context.Background(), []string{"-n", "default"}, strings.NewReader(secretManifest), &out)
+	if err == nil || !strings.Contains(err.Error(), "no provider") {
+		t.Fatalf("expected a missing provider error, got %v", err)
+	}
+}
+
+func TestEncryptKeepsPreviousCiphertexts(t *testing.T) {
+	useKeyring(t, "v1")
+	path := filepath.Join(t.TempDir(), "db.yaml")
+
+	// a missing previous file is the first run
+	first := run(t, "encrypt", secretManifest, "-p", "k8s", "-n", "default", "--previous", path, "-o", path)
+	if first != "" {
+		t.Fatalf("unexpected output %s", first)
+	}
+	written, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again := run(t, "encrypt", secretManifest, "-p", "k8s", "-n", "default", "--previous", path)
+	if again != string(written) {
+		t.Fatalf("expected encrypting unchanged values to keep the manifest\n%s\n%s", written, again)
+	}
+
+	// values of a retired key are encrypted again
+	useKeyring(t, "v2")
+	if rotated := run(t, "encrypt", secretManifest, "-p", "k8s", "-n", "default", "--previous", path); rotated == string(written) {
+		t.Fatal("expected the values to be encrypted with the new primary key")
+	}
+}
+
+func TestRotateFile(t *testing.T) {
+	useKeyring(t, "v1")
+	path := filepath.Join(t.TempDir(), "db.yaml")
+	if err := os.WriteFile(path, []byte(run(t, "encrypt", secretManifest, "-p", "k8s", "-n", "default")), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if out := run(t, "rotate", "", path); !strings.Contains(out, "is up to date") {
+		t.Fatalf("expected nothing to rotate, got %s", out)
+	}
+
+	useKeyring(t, "v2")
+	if out := run(t, "rotate", "", path); !strings.Contains(out, "rotated") {
+		t.Fatalf("expected the file to be rotated, got %s", out)
+	}
+	if out := run(t, "rotate", "", path); !strings.Contains(out, "is up to date") {
+		t.Fatalf("expected nothing left to rotate, got %s", out)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+		t.Fatalf("expected the permissions to be kept, got %v %v", info.Mode(), err)
+	}
+}
+
+func TestEditFile(t *testing.T) {
+	useKeyring(t, "v1")
+	path := filepath.Join(t.TempDir(), "db.yaml")
+	if err := os.WriteFile(path, []byte(run(t, "encrypt", secretManifest, "-p", "k8s", "-n", "default")), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("EDITOR", "sed -i s/hunter2/correct-horse/")
+	run(t, "edit", "", path)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decrypted := run(t, "decrypt", string(data)); !strings.Contains(decrypted, "password: correct-horse") {
+		t.Fatalf("expected the edited value, got\n%s", decrypted)
+	}
+}
+
+func TestEditKeepsUnchangedCiphertexts(t *testing.T) {
+	useKeyring(t, "v1")
+	dir := t.TempDir()
+	path := filepath.Join(dir, "db.yaml")
+	original := run(t, "encrypt", secretManifest, "-p", "k8s", "-n", "default")
+	if err := os.WriteFile(path, []byte(original), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// the editor records the permissions and location of the plaintext file
+	editor := filepath.Join(dir, "editor.sh")
+	script := "#!/bin/sh\nstat -c %a \"$1\" > " + dir + "/perms\necho \"$1\" > " + dir + "/path\n" +
+		"sed -i s/hunter2/correct-horse/ \"$1\"\n"
+	if err := os.WriteFile(editor, []byte(script), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("EDITOR", editor)
+
+	if out := run(t, "edit", "", path); !strings.Contains(out, "encrypted 1 of 2 values") {
+		t.Fatalf("expected one value to be encrypted again, got %s", out)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	usernameLine := func(manifest string) string {
+		for _, line := range strings.Split(manifest, "\n") {
+			if strings.Contains(line, "username:") {
+				return line
+			}
+		}
+		return ""
+	}
+	if usernameLine(string(data)) == "" || usernameLine(string(data)) != usernameLine(original) {
+		t.Fatalf("expected the unchanged ciphertext to be kept\n%s\n%s", original, data)
+	}
+
+	perms, _ := os.ReadFile(filepath.Join(dir, "perms"))
+	if strings.TrimSpace(string(perms)) != "600" {
+		t.Fatalf("expected the plaintext file to be private, got %s", perms)
+	}
+	plaintextPath, _ := os.ReadFile(filepath.Join(dir, "path"))
+	if _, err := os.Stat(filepath.Dir(strings.TrimSpace(string(plaintextPath)))); !os.IsNotExist(err) {
+		t.Fatalf("expected the plaintext directory to be removed, got %v", err)
+	}
+}
+
+func TestShredOverwritesFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "plaintext")
+	if err := os.WriteFile(path, []byte("hunter2"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := shred(path); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, make([]byte, len("hunter2"))) {
+		t.Fatalf("expected zeros, got %q", data)
+	}
+}
+
+// writeKeyBundle writes the key bundle of a new x25519 key x1 of the namespace
+// default and returns its path together with a keyring holding the private key
+func writeKeyBundle(t *testing.T) (string, *providers.Keyring) {
+	privateKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle := filepath.Join(t.TempDir(), "bundle.json")
+	data, err := json.Marshal(providers.KeyBundle{
+		Provider:  providers.K8sProvider,
+		Namespace: "default",
+		KeyID:     "x1",
+		PublicKey: base64.StdEncoding.EncodeToString(privateKey.PublicKey().Bytes()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(bundle, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	keyring, err := providers.NewKeyring("x1", map[string]string{
+		"x1": "x25519:" + base64.StdEncoding.EncodeToString(privateKey.Bytes()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bundle, keyring
+}
+
+// useProvider makes every command use provider
+func useProvider(t *testing.T, provider providers.Provider) {
+	previous := newProvider
+	newProvider = func(context.Context, providers.Config) (providers.Provider, error) {
+		return provider, nil
+	}
+	t.Cleanup(func() { newProvider = previous })
+}
+
+func TestEncryptWithKeyBundle(t *testing.T) {
+	bundle, keyring := writeKeyBundle(t)
+
+	// no cluster is needed, the namespace and provider come from the bundle
+	encrypted := run(t, "encrypt", secretManifest, "--key-bundle", bundle)
+	if !strings.Contains(encrypted, "namespace: default") || !strings.Contains(encrypted, "secrets.opensecrecy.org/provider: k8s") {
+		t.Fatalf("unexpected EncryptedSecret\n%s", encrypted)
+	}
+
+	var out bytes.Buffer
+	err := runEncrypt(context.Background(), []string{"--key-bundle", bundle, "-n", "other"}, strings.NewReader(secretManifest), &out)
+	if err == nil {
+		t.Fatal("expected a bundle of another namespace to be refused")
+	}
+
+	useProvider(t, &keyringProvider{keyring: keyring})
+	if decrypted := run(t, "decrypt", encrypted); !strings.Contains(decrypted, "password: hunter2") {
+		t.Fatalf("unexpected DecryptedSecret\n%s", decrypted)
+	}
+}
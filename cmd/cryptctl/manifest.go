@@ -0,0 +1,225 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	secretsv1alpha1 "github.com/opensecrecy/encrypted-secrets/api/v1alpha1"
+	"github.com/opensecrecy/encrypted-secrets/pkg/providers"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// newProvider is replaced by the tests, which have no cluster or KMS
+var newProvider = providers.NewProvider
+
+// providerFlags override the provider annotations of a manifest
+type providerFlags struct {
+	provider      string
+	namespace     string
+	kmsKeyID      string
+	region        string
+	keySecretName string
+	// keyBundle is the key bundle encrypt uses instead of the keys in the cluster
+	keyBundle string
+	// deterministic records the deterministic annotation when encrypting
+	deterministic bool
+}
+
+func (f *providerFlags) bind(fs *flag.FlagSet) {
+	fs.StringVar(&f.provider, "p", "", "The provider, k8s, aws-kms or sops. Defaults to the provider annotation of the manifest.")
+	fs.StringVar(&f.namespace, "n", "", "The namespace of the secret, which holds the keys of the k8s provider. "+
+		"Defaults to the namespace of the manifest.")
+	fs.StringVar(&f.kmsKeyID, "kms-key-id", "", "The KMS key aws-kms encrypts with. Defaults to the "+
+		providers.KMSKeyIDAnnotation+" annotation or alias/cryptctl-key.")
+	fs.StringVar(&f.region, "region", "", "The AWS region of the KMS key. Defaults to the AWS configuration.")
+	fs.StringVar(&f.keySecretName, "key-secret", "", "The keyring or key secret of the k8s provider.")
+}
+
+// apply writes the flags into the metadata of a manifest, so that the operator
+// decrypts it with the same provider
+func (f *providerFlags) apply(meta *metav1.ObjectMeta) {
+	if f.namespace != "" {
+		meta.Namespace = f.namespace
+	}
+	if f.provider != "" {
+		metav1.SetMetaDataAnnotation(meta, providers.ProviderAnnotation, f.provider)
+	}
+	if f.kmsKeyID != "" {
+		metav1.SetMetaDataAnnotation(meta, providers.KMSKeyIDAnnotation, f.kmsKeyID)
+	}
+	if f.deterministic {
+		metav1.SetMetaDataAnnotation(meta, providers.DeterministicAnnotation, "true")
+	}
+}
+
+// bindDeterministic adds the flag of deterministic encryption to fs
+func (f *providerFlags) bindDeterministic(fs *flag.FlagSet) {
+	fs.BoolVar(&f.deterministic, "deterministic", false, "Encrypt equal values to equal ciphertexts and record it in the "+
+		providers.DeterministicAnnotation+" annotation. Needs the k8s provider with a passphrase as primary key.")
+}
+
+// config returns the provider configuration of a manifest with the metadata meta
+func (f *providerFlags) config(meta *metav1.ObjectMeta) (providers.Config, error) {
+	f.apply(meta)
+	var bundle *providers.KeyBundle
+	if f.keyBundle != "" {
+		var err error
+		if bundle, err = providers.LoadKeyBundle(f.keyBundle); err != nil {
+			return providers.Config{}, err
+		}
+		if err := bundle.ApplyTo(meta); err != nil {
+			return providers.Config{}, err
+		}
+	}
+
+	cfg := providers.ConfigFromAnnotations(meta)
+	cfg.Region = f.region
+	cfg.KeySecretName = f.keySecretName
+	cfg.KeyBundle = bundle
+	// cryptctl runs with the keys of its user
+	cfg.SOPSOperatorKeys = true
+	if cfg.Provider == "" {
+		return cfg, fmt.Errorf("no provider, set the %s annotation or pass -p", providers.ProviderAnnotation)
+	}
+	if cfg.Provider == providers.K8sProvider && cfg.Namespace == "" {
+		return cfg, fmt.Errorf("the k8s provider needs a namespace, set it in the manifest or pass -n")
+	}
+	return cfg, nil
+}
+
+// readInput reads the file at path, or in when path is -
+func readInput(path string, in io.Reader) ([]byte, error) {
+	if path == "-" {
+		return io.ReadAll(in)
+	}
+	return os.ReadFile(path)
+}
+
+// writeOutput writes data to the file at path, or out when path is -
+func writeOutput(path string, out io.Writer, data []byte) error {
+	if path == "-" {
+		_, err := out.Write(data)
+		return err
+	}
+	return writeFile(path, data)
+}
+
+// writeFile replaces the content of the file at path, keeping its permissions
+func writeFile(path string, data []byte) error {
+	mode := os.FileMode(0o644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	return os.WriteFile(path, data, mode)
+}
+
+// writePrivateOutput writes decrypted values or keys like writeOutput, a file is
+// only readable by its owner
+func writePrivateOutput(path string, out io.Writer, data []byte) error {
+	if path == "-" {
+		_, err := out.Write(data)
+		return err
+	}
+	// the permissions of an existing file are tightened before it is written
+	if err := os.Chmod(path, 0o600); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return os.WriteFile(path, data, 0o600)
+}
+
+// decodeDecryptedSecret reads a DecryptedSecret or Secret manifest. The values of
+// a Secret become the values of the DecryptedSecret, stringData winning over data.
+func decodeDecryptedSecret(data []byte) (*secretsv1alpha1.DecryptedSecret, error) {
+	var typeMeta metav1.TypeMeta
+	if err := yaml.Unmarshal(data, &typeMeta); err != nil {
+		return nil, err
+	}
+
+	switch typeMeta.Kind {
+	case "DecryptedSecret":
+		decryptedSecret := &secretsv1alpha1.DecryptedSecret{}
+		if err := yaml.Unmarshal(data, decryptedSecret); err != nil {
+			return nil, err
+		}
+		return decryptedSecret, nil
+	case "Secret":
+		secret := &corev1.Secret{}
+		if err := yaml.Unmarshal(data, secret); err != nil {
+			return nil, err
+		}
+		values := make(map[string]string, len(secret.Data)+len(secret.StringData))
+		for key, value := range secret.Data {
+			values[key] = string(value)
+		}
+		for key, value := range secret.StringData {
+			values[key] = value
+		}
+		return &secretsv1alpha1.DecryptedSecret{ObjectMeta: secret.ObjectMeta, Type: secret.Type, Data: values}, nil
+	default:
+		return nil, fmt.Errorf("expected a Secret or DecryptedSecret, got %q", typeMeta.Kind)
+	}
+}
+
+// decodeEncryptedSecret reads an EncryptedSecret manifest
+func decodeEncryptedSecret(data []byte) (*secretsv1alpha1.EncryptedSecret, error) {
+	encryptedSecret := &secretsv1alpha1.EncryptedSecret{}
+	if err := yaml.Unmarshal(data, encryptedSecret); err != nil {
+		return nil, err
+	}
+	if encryptedSecret.Kind != "EncryptedSecret" {
+		return nil, fmt.Errorf("expected an EncryptedSecret, got %q", encryptedSecret.Kind)
+	}
+	return encryptedSecret, nil
+}
+
+// encodeManifest returns obj as YAML without its status and empty creation
+// timestamp, which don't belong into a manifest
+func encodeManifest(obj interface{}) ([]byte, error) {
+	manifest, err := manifestFields(obj)
+	if err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(manifest)
+}
+
+// manifestFields returns the fields of obj like encodeManifest writes them
+func manifestFields(obj interface{}) (map[string]interface{}, error) {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	var manifest map[string]interface{}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, err
+	}
+
+	delete(manifest, "status")
+	if meta, ok := manifest["metadata"].(map[string]interface{}); ok {
+		if meta["creationTimestamp"] == nil {
+			delete(meta, "creationTimestamp")
+		}
+	}
+	return manifest, nil
+}
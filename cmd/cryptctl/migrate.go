@@ -0,0 +1,318 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"filippo.io/age"
+	"github.com/aws/aws-sdk-go-v2/config"
+	secretsv1alpha1 "github.com/opensecrecy/encrypted-secrets/api/v1alpha1"
+	"github.com/opensecrecy/encrypted-secrets/pkg/providers"
+	"github.com/opensecrecy/encrypted-secrets/pkg/sops"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	formatSealedSecret = "sealed-secret"
+
+	// operatorAnnotationPrefix is the prefix of the annotations of the operator,
+	// which export leaves out
+	operatorAnnotationPrefix = "secrets.opensecrecy.org/"
+)
+
+// runImport turns SealedSecrets or a SOPS encrypted file into EncryptedSecrets
+func runImport(ctx context.Context, args []string, in io.Reader, out io.Writer) error {
+	var flags providerFlags
+	var input, output, sealingKeys, ageKeyFile, name string
+	fs := newFlagSet("import", "")
+	flags.bind(fs)
+	flags.bindDeterministic(fs)
+	fs.StringVar(&flags.keyBundle, "key-bundle", "", "Encrypt with the key bundle written by export-key "+
+		"instead of reading the keys from the cluster.")
+	fs.StringVar(&input, "f", "-", "The SealedSecrets or the SOPS encrypted file, - for stdin.")
+	fs.StringVar(&output, "o", "-", "The file the EncryptedSecrets are written to, - for stdout.")
+	fs.StringVar(&sealingKeys, "sealing-key", "", "The PEM encoded private keys of the sealed-secrets controller, "+
+		"or the backup of its key secrets, needed to import SealedSecrets.")
+	fs.StringVar(&ageKeyFile, "age-key-file", "", "The age identities of a SOPS file. Defaults to $SOPS_AGE_KEY, "+
+		"$SOPS_AGE_KEY_FILE or the key file of sops. KMS and PGP master keys use the AWS configuration and gpg.")
+	fs.StringVar(&name, "name", "", "The name of the EncryptedSecret of a SOPS file that isn't a Secret, "+
+		"whose top level values become its values. With -p "+providers.SOPSProvider+" the file is kept as it is "+
+		"and only decrypted by the operator.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	data, err := readInput(input, in)
+	if err != nil {
+		return err
+	}
+	if sops.IsEncrypted(data) && flags.provider == providers.SOPSProvider {
+		encryptedSecret, err := wrapSOPS(&flags, data, name)
+		if err != nil {
+			return err
+		}
+		manifest, err := encodeManifest(encryptedSecret)
+		if err != nil {
+			return err
+		}
+		return writeOutput(output, out, manifest)
+	}
+
+	var decryptedSecrets []*secretsv1alpha1.DecryptedSecret
+	if sops.IsEncrypted(data) {
+		decryptedSecret, err := importSOPS(ctx, data, ageKeyFile, name)
+		if err != nil {
+			return err
+		}
+		decryptedSecrets = append(decryptedSecrets, decryptedSecret)
+	} else {
+		if sealingKeys == "" {
+			return errors.New("importing SealedSecrets needs the keys of the controller, pass --sealing-key")
+		}
+		keys, err := loadSealingKeys(sealingKeys)
+		if err != nil {
+			return err
+		}
+		if decryptedSecrets, err = importSealedSecrets(data, keys); err != nil {
+			return err
+		}
+	}
+
+	var manifests [][]byte
+	for _, decryptedSecret := range decryptedSecrets {
+		encryptedSecret, err := encrypt(ctx, &flags, decryptedSecret, nil)
+		if err != nil {
+			return fmt.Errorf("%s: %w", decryptedSecret.Name, err)
+		}
+		manifest, err := encodeManifest(encryptedSecret)
+		if err != nil {
+			return err
+		}
+		manifests = append(manifests, manifest)
+	}
+	return writeOutput(output, out, bytes.Join(manifests, []byte("---\n")))
+}
+
+// importSOPS decrypts a SOPS encrypted Secret or DecryptedSecret, or a map of
+// values which becomes a DecryptedSecret called name
+func importSOPS(ctx context.Context, data []byte, ageKeyFile, name string) (*secretsv1alpha1.DecryptedSecret, error) {
+	keys := sops.Keys{GPG: true}
+	var err error
+	if ageKeyFile != "" {
+		keys.Age, err = loadAgeIdentities(ageKeyFile)
+	} else {
+		keys.Age, err = sops.LoadAgeIdentities()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if awsConfig, err := config.LoadDefaultConfig(ctx); err == nil {
+		keys.AWS = &awsConfig
+	}
+
+	plain, err := sops.Decrypt(ctx, data, keys)
+	if err != nil {
+		return nil, err
+	}
+	var typeMeta metav1.TypeMeta
+	if err := yaml.Unmarshal(plain, &typeMeta); err != nil {
+		return nil, err
+	}
+	if typeMeta.Kind != "" {
+		return decodeDecryptedSecret(plain)
+	}
+
+	if name == "" {
+		return nil, errors.New("the SOPS file isn't a Secret, pass --name")
+	}
+	values, err := providers.SOPSValues(plain)
+	if err != nil {
+		return nil, err
+	}
+	return &secretsv1alpha1.DecryptedSecret{ObjectMeta: metav1.ObjectMeta{Name: name}, Data: values}, nil
+}
+
+// wrapSOPS returns an EncryptedSecret of the sops provider holding the SOPS
+// document data as it is. The name, namespace, labels, annotations and type are
+// taken from the document unless SOPS encrypted its metadata, name overrides the
+// name.
+func wrapSOPS(flags *providerFlags, data []byte, name string) (*secretsv1alpha1.EncryptedSecret, error) {
+	var document struct {
+		metav1.ObjectMeta `json:"metadata"`
+		Type              corev1.SecretType `json:"type"`
+	}
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+	metadata, err := json.Marshal(document)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Contains(metadata, []byte("ENC[")) {
+		document.ObjectMeta, document.Type = metav1.ObjectMeta{}, ""
+	}
+
+	encryptedSecret := &secretsv1alpha1.EncryptedSecret{
+		TypeMeta: metav1.TypeMeta{Kind: "EncryptedSecret", APIVersion: secretsv1alpha1.GroupVersion.String()},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        document.Name,
+			Namespace:   document.Namespace,
+			Labels:      document.Labels,
+			Annotations: document.Annotations,
+		},
+		Type: document.Type,
+		Sops: string(data),
+	}
+	if name != "" {
+		encryptedSecret.Name = name
+	}
+	if encryptedSecret.Name == "" {
+		return nil, errors.New("the SOPS file names no secret, pass --name")
+	}
+	flags.apply(&encryptedSecret.ObjectMeta)
+	return encryptedSecret, nil
+}
+
+// loadAgeIdentities reads the age identities of the file at path
+func loadAgeIdentities(path string) ([]age.Identity, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return age.ParseIdentities(file)
+}
+
+// importSealedSecrets unseals the SealedSecrets of the YAML documents in data,
+// which may be Lists of them as written by kubectl get -o yaml
+func importSealedSecrets(data []byte, keys []*rsa.PrivateKey) ([]*secretsv1alpha1.DecryptedSecret, error) {
+	var decryptedSecrets []*secretsv1alpha1.DecryptedSecret
+	reader := utilyaml.NewYAMLReader(bufio.NewReader(bytes.NewReader(data)))
+	for {
+		document, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(bytes.TrimSpace(document)) == 0 {
+			continue
+		}
+
+		var list struct {
+			metav1.TypeMeta `json:",inline"`
+			Items           []sealedSecret `json:"items"`
+		}
+		if err := yaml.Unmarshal(document, &list); err != nil {
+			return nil, err
+		}
+		switch list.Kind {
+		case "List", sealedSecretKind + "List":
+		case sealedSecretKind:
+			var s sealedSecret
+			if err := yaml.Unmarshal(document, &s); err != nil {
+				return nil, err
+			}
+			list.Items = []sealedSecret{s}
+		default:
+			return nil, fmt.Errorf("expected a SealedSecret or a SOPS encrypted file, got %q", list.Kind)
+		}
+
+		for i := range list.Items {
+			if list.Items[i].Kind != "" && list.Items[i].Kind != sealedSecretKind {
+				return nil, fmt.Errorf("expected a SealedSecret in the list, got %q", list.Items[i].Kind)
+			}
+			decryptedSecret, err := unseal(&list.Items[i], keys)
+			if err != nil {
+				return nil, err
+			}
+			decryptedSecrets = append(decryptedSecrets, decryptedSecret)
+		}
+	}
+	if len(decryptedSecrets) == 0 {
+		return nil, errors.New("no SealedSecrets to import")
+	}
+	return decryptedSecrets, nil
+}
+
+// runExport turns an EncryptedSecret into a SealedSecret, for moving back or
+// sharing a secret with a cluster without the operator
+func runExport(ctx context.Context, args []string, in io.Reader, out io.Writer) error {
+	var flags providerFlags
+	var input, output, to, cert, scope string
+	fs := newFlagSet("export", "")
+	flags.bind(fs)
+	fs.StringVar(&input, "f", "-", "The EncryptedSecret manifest, - for stdin.")
+	fs.StringVar(&output, "o", "-", "The file the exported secret is written to, - for stdout.")
+	fs.StringVar(&to, "to", "", "The format, "+formatSealedSecret+".")
+	fs.StringVar(&cert, "cert", "", "The certificate of the sealed-secrets controller, as written by kubeseal --fetch-cert.")
+	fs.StringVar(&scope, "scope", scopeStrict, "The scope of the SealedSecret, "+scopeStrict+", "+scopeNamespaceWide+
+		" or "+scopeClusterWide+".")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	data, err := readInput(input, in)
+	if err != nil {
+		return err
+	}
+	encryptedSecret, err := decodeEncryptedSecret(data)
+	if err != nil {
+		return err
+	}
+	decryptedSecret, err := decrypt(ctx, &flags, encryptedSecret)
+	if err != nil {
+		return err
+	}
+	secret := secretFor(decryptedSecret)
+	secret.Annotations = withoutPrefixes(secret.Annotations, []string{operatorAnnotationPrefix})
+
+	var exported []byte
+	switch to {
+	case formatSealedSecret:
+		if cert == "" {
+			return errors.New("exporting a SealedSecret needs the certificate of the controller, pass --cert")
+		}
+		publicKey, err := loadSealingCertificate(cert)
+		if err != nil {
+			return err
+		}
+		sealed, err := seal(secret, publicKey, scope)
+		if err != nil {
+			return err
+		}
+		if exported, err = encodeManifest(sealed); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("invalid format %q, pass --to %s", to, formatSealedSecret)
+	}
+	return writePrivateOutput(output, out, exported)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opensecrecy/encrypted-secrets/pkg/sops"
+	"sigs.k8s.io/yaml"
+)
+
+const basicAuthManifest = `apiVersion: v1
+kind: Secret
+metadata:
+  name: db
+  namespace: default
+  labels:
+    app: db
+type: kubernetes.io/basic-auth
+stringData:
+  username: admin
+  password: hunter2
+`
+
+// writeSealingKey writes the private key and certificate of a sealed-secrets
+// controller and returns their paths
+func writeSealingKey(t *testing.T) (string, string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "sealed-secret"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	keyPath, certPath := filepath.Join(dir, "tls.key"), filepath.Join(dir, "tls.crt")
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := os.WriteFile(keyPath, keyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return keyPath, certPath
+}
+
+func TestSealedSecretRoundTrip(t *testing.T) {
+	useKeyring(t, "v1")
+	keyPath, certPath := writeSealingKey(t)
+
+	encrypted := run(t, "encrypt", basicAuthManifest, "-p", "k8s")
+	sealed := run(t, "export", encrypted, "--to", "sealed-secret", "--cert", certPath)
+	for _, want := range []string{"kind: SealedSecret", "type: kubernetes.io/basic-auth", "app: db"} {
+		if !strings.Contains(sealed, want) {
+			t.Fatalf("expected %q in\n%s", want, sealed)
+		}
+	}
+	if strings.Contains(sealed, "hunter2") || strings.Contains(sealed, "secrets.opensecrecy.org") {
+		t.Fatalf("unexpected SealedSecret\n%s", sealed)
+	}
+
+	imported := run(t, "import", sealed, "-p", "k8s", "--sealing-key", keyPath)
+	decrypted := run(t, "decrypt", imported)
+	for _, want := range []string{"type: kubernetes.io/basic-auth", "app: db", "password: hunter2", "username: admin"} {
+		if !strings.Contains(decrypted, want) {
+			t.Fatalf("expected %q in\n%s", want, decrypted)
+		}
+	}
+
+	// strict SealedSecrets can't be unsealed under another name
+	renamed := strings.Replace(sealed, "name: db", "name: other", 1)
+	var out bytes.Buffer
+	err := runImport(context.Background(), []string{"-p", "k8s", "--sealing-key", keyPath}, strings.NewReader(renamed), &out)
+	if err == nil || !strings.Contains(err.Error(), "failed to unseal") {
+		t.Fatalf("expected the renamed SealedSecret to fail, got %v", err)
+	}
+}
+
+func TestImportSealedSecretList(t *testing.T) {
+	useKeyring(t, "v1")
+	keyPath, certPath := writeSealingKey(t)
+
+	encrypted := run(t, "encrypt", basicAuthManifest, "-p", "k8s")
+	sealed := run(t, "export", encrypted, "--to", "sealed-secret", "--cert", certPath, "--scope", "cluster-wide")
+	var item map[string]interface{}
+	if err := yaml.Unmarshal([]byte(sealed), &item); err != nil {
+		t.Fatal(err)
+	}
+	list, err := yaml.Marshal(map[string]interface{}{"apiVersion": "v1", "kind": "List", "items": []interface{}{item}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// cluster-wide SealedSecrets can be moved to another namespace
+	imported := run(t, "import", strings.Replace(string(list), "namespace: default", "namespace: other", -1),
+		"-p", "k8s", "--sealing-key", keyPath)
+	decrypted := run(t, "decrypt", imported)
+	if !strings.Contains(decrypted, "namespace: other") || !strings.Contains(decrypted, "password: hunter2") {
+		t.Fatalf("unexpected DecryptedSecret\n%s", decrypted)
+	}
+}
+
+// The SOPS fixtures in testdata were encrypted by sops 3.9.0 for the first
+// identity of age.txt
+
+func readFixture(t *testing.T, name string) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestImportSOPS(t *testing.T) {
+	useKeyring(t, "v1")
+	keyFile := filepath.Join("testdata", "age.txt")
+
+	imported := run(t, "import", readFixture(t, "secret.age.yaml"), "-p", "k8s", "--age-key-file", keyFile)
+	decrypted := run(t, "decrypt", imported)
+	for _, want := range []string{"type: kubernetes.io/basic-auth", "app: db", "password: hunter2", "username: admin", `port: "5432"`} {
+		if !strings.Contains(decrypted, want) {
+			t.Fatalf("expected %q in\n%s", want, decrypted)
+		}
+	}
+
+	// files of plain values need a name
+	plainFile := readFixture(t, "values.age.yaml")
+	var out bytes.Buffer
+	err := runImport(context.Background(), []string{"-p", "k8s", "-n", "default", "--age-key-file", keyFile},
+		strings.NewReader(plainFile), &out)
+	if err == nil || !strings.Contains(err.Error(), "--name") {
+		t.Fatalf("expected the missing name to be reported, got %v", err)
+	}
+	imported = run(t, "import", plainFile, "-p", "k8s", "-n", "default", "--age-key-file", keyFile, "--name", "db")
+	decrypted = run(t, "decrypt", imported)
+	if !strings.Contains(decrypted, "name: db") || !strings.Contains(decrypted, `port: "5432"`) {
+		t.Fatalf("unexpected DecryptedSecret\n%s", decrypted)
+	}
+}
+
+func TestImportSOPSKeepsTheDocument(t *testing.T) {
+	encryptedFile := readFixture(t, "secret.age.yaml")
+
+	// the sops provider neither decrypts nor needs any key to import
+	imported := run(t, "import", encryptedFile, "-p", "sops")
+	encryptedSecret, err := decodeEncryptedSecret([]byte(imported))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encryptedSecret.Name != "db" || encryptedSecret.Namespace != "default" || encryptedSecret.Labels["app"] != "db" ||
+		encryptedSecret.Type != "kubernetes.io/basic-auth" || encryptedSecret.Annotations["secrets.opensecrecy.org/provider"] != "sops" {
+		t.Fatalf("unexpected EncryptedSecret\n%s", imported)
+	}
+	if encryptedSecret.Sops != encryptedFile || len(encryptedSecret.Data) > 0 {
+		t.Fatalf("expected the SOPS document to be kept as it is\n%s", imported)
+	}
+	identities, err := loadAgeIdentities(filepath.Join("testdata", "age.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sops.Decrypt(context.Background(), []byte(encryptedSecret.Sops), sops.Keys{Age: identities}); err != nil {
+		t.Fatalf("the kept document doesn't decrypt: %v", err)
+	}
+
+	// encrypted metadata can't name the EncryptedSecret
+	var out bytes.Buffer
+	err = runImport(context.Background(), []string{"-p", "sops"}, strings.NewReader(readFixture(t, "secret.full.age.yaml")), &out)
+	if err == nil || !strings.Contains(err.Error(), "--name") {
+		t.Fatalf("expected the missing name to be reported, got %v", err)
+	}
+}
@@ -0,0 +1,150 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"sigs.k8s.io/yaml"
+)
+
+// encryptAnnotation selects a Secret for post-render when it is "true"
+const encryptAnnotation = "secrets.opensecrecy.org/encrypt"
+
+// runPostRender reads rendered manifests, replaces the selected Secrets with
+// EncryptedSecrets and writes everything else through as it is. It is meant to
+// be a Helm post-renderer.
+func runPostRender(ctx context.Context, args []string, in io.Reader, out io.Writer) error {
+	var flags providerFlags
+	var names string
+	fs := newFlagSet("post-render", "")
+	flags.bind(fs)
+	flags.bindDeterministic(fs)
+	fs.StringVar(&flags.keyBundle, "key-bundle", "", "Encrypt with the key bundle written by export-key "+
+		"instead of reading the keys from the cluster.")
+	fs.StringVar(&names, "names", "", "Comma separated patterns of the names of the Secrets to encrypt, like db-*. "+
+		"Secrets annotated with "+encryptAnnotation+": \"true\" are encrypted as well.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	var patterns []string
+	for _, pattern := range strings.Split(names, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid pattern %s %v", pattern, err)
+			}
+			patterns = append(patterns, pattern)
+		}
+	}
+
+	reader := utilyaml.NewYAMLReader(bufio.NewReader(in))
+	for {
+		document, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// the reader leaves the separator on the first document
+		document = bytes.TrimPrefix(document, []byte("---\n"))
+		if len(bytes.TrimSpace(document)) == 0 {
+			continue
+		}
+
+		encrypted, err := postRenderDocument(ctx, &flags, patterns, document)
+		if err != nil {
+			return err
+		}
+		if !bytes.HasSuffix(encrypted, []byte("\n")) {
+			encrypted = append(encrypted, '\n')
+		}
+		if _, err := io.WriteString(out, "---\n"); err != nil {
+			return err
+		}
+		if _, err := out.Write(encrypted); err != nil {
+			return err
+		}
+	}
+}
+
+// postRenderDocument returns document, or the EncryptedSecret replacing it when
+// it is a selected Secret. The comments heading the document, like the source
+// template Helm notes, are kept.
+func postRenderDocument(ctx context.Context, flags *providerFlags, patterns []string, document []byte) ([]byte, error) {
+	var secret corev1.Secret
+	if err := yaml.Unmarshal(document, &secret); err != nil {
+		return nil, err
+	}
+	if secret.Kind != "Secret" || !selectedSecret(&secret.ObjectMeta, patterns) {
+		return document, nil
+	}
+
+	decryptedSecret, err := decodeDecryptedSecret(document)
+	if err != nil {
+		return nil, err
+	}
+	delete(decryptedSecret.Annotations, encryptAnnotation)
+	if len(decryptedSecret.Annotations) == 0 {
+		decryptedSecret.Annotations = nil
+	}
+	encryptedSecret, err := encrypt(ctx, flags, decryptedSecret, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Secret %s: %w", secret.Name, err)
+	}
+	manifest, err := encodeManifest(encryptedSecret)
+	if err != nil {
+		return nil, err
+	}
+	return append(headingComments(document), manifest...), nil
+}
+
+// selectedSecret tells whether the Secret with the metadata meta is annotated for
+// encryption or its name matches one of patterns
+func selectedSecret(meta *metav1.ObjectMeta, patterns []string) bool {
+	if meta.Annotations[encryptAnnotation] == "true" {
+		return true
+	}
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, meta.Name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// headingComments returns the comment lines document starts with
+func headingComments(document []byte) []byte {
+	var comments []byte
+	for _, line := range bytes.SplitAfter(document, []byte("\n")) {
+		if !bytes.HasPrefix(bytes.TrimSpace(line), []byte("#")) {
+			break
+		}
+		comments = append(comments, line...)
+	}
+	return comments
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const renderedManifests = `---
+# Source: app/templates/configmap.yaml
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: settings
+data:
+  mode:   "fast"
+---
+# Source: app/templates/db-secret.yaml
+apiVersion: v1
+kind: Secret
+metadata:
+  name: db-credentials
+stringData:
+  password: hunter2
+---
+# Source: app/templates/api-secret.yaml
+apiVersion: v1
+kind: Secret
+metadata:
+  name: api
+  annotations:
+    secrets.opensecrecy.org/encrypt: "true"
+data:
+  token: c2VjcmV0
+---
+# Source: app/templates/public-secret.yaml
+apiVersion: v1
+kind: Secret
+metadata:
+  name: public
+stringData:
+  banner: hello
+`
+
+func TestPostRenderEncryptsSelectedSecrets(t *testing.T) {
+	bundle, _ := writeKeyBundle(t)
+
+	output := run(t, "post-render", renderedManifests, "--key-bundle", bundle, "--names", "db-*")
+	documents := strings.Split(strings.TrimPrefix(output, "---\n"), "---\n")
+	if len(documents) != 4 {
+		t.Fatalf("expected 4 documents, got %d\n%s", len(documents), output)
+	}
+
+	// everything that isn't selected is written through as it is
+	if !strings.Contains(documents[0], `mode:   "fast"`) || !strings.Contains(documents[3], "banner: hello") {
+		t.Fatalf("expected the other documents to be untouched\n%s", output)
+	}
+	for i, name := range map[int]string{1: "db-credentials", 2: "api"} {
+		if !strings.Contains(documents[i], "kind: EncryptedSecret") || !strings.Contains(documents[i], "name: "+name) ||
+			!strings.HasPrefix(documents[i], "# Source: app/templates/") {
+			t.Fatalf("expected %s to be encrypted\n%s", name, documents[i])
+		}
+	}
+	for _, unwanted := range []string{"hunter2", "c2VjcmV0", "secrets.opensecrecy.org/encrypt"} {
+		if strings.Contains(output, unwanted) {
+			t.Fatalf("unexpected %q in\n%s", unwanted, output)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/opensecrecy/encrypted-secrets/pkg/providers"
+)
+
+// runRotate re-encrypts the values of EncryptedSecret files that aren't encrypted
+// with the primary key of their provider and writes the files back
+func runRotate(ctx context.Context, args []string, _ io.Reader, out io.Writer) error {
+	var flags providerFlags
+	fs := newFlagSet("rotate", "<file>...")
+	flags.bind(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errors.New("no files to rotate")
+	}
+
+	for _, path := range fs.Args() {
+		changed, err := rotateFile(ctx, &flags, path)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if changed {
+			fmt.Fprintf(out, "%s rotated\n", path)
+		} else {
+			fmt.Fprintf(out, "%s is up to date\n", path)
+		}
+	}
+	return nil
+}
+
+// rotateFile rotates the EncryptedSecret at path and reports whether it changed
+func rotateFile(ctx context.Context, flags *providerFlags, path string) (bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	encryptedSecret, err := decodeEncryptedSecret(data)
+	if err != nil {
+		return false, err
+	}
+	cfg, err := flags.config(&encryptedSecret.ObjectMeta)
+	if err != nil {
+		return false, err
+	}
+	provider, err := newProvider(ctx, cfg)
+	if err != nil {
+		return false, err
+	}
+
+	rotated, changed, err := providers.ReencryptWithProvider(ctx, provider, encryptedSecret)
+	if err != nil || !changed {
+		return false, err
+	}
+	manifest, err := encodeManifest(rotated)
+	if err != nil {
+		return false, err
+	}
+	return true, writeFile(path, manifest)
+}
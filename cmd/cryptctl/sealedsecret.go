@@ -0,0 +1,323 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+
+	secretsv1alpha1 "github.com/opensecrecy/encrypted-secrets/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	sealedSecretKind       = "SealedSecret"
+	sealedSecretAPIVersion = "bitnami.com/v1alpha1"
+
+	// the annotations of a SealedSecret that widen the scope it can be unsealed in
+	sealedSecretsNamespaceWide = "sealedsecrets.bitnami.com/namespace-wide"
+	sealedSecretsClusterWide   = "sealedsecrets.bitnami.com/cluster-wide"
+	sealedSecretsPrefix        = "sealedsecrets.bitnami.com/"
+
+	scopeStrict        = "strict"
+	scopeNamespaceWide = "namespace-wide"
+	scopeClusterWide   = "cluster-wide"
+
+	// sessionKeySize is the size of the AES key every value is sealed with
+	sessionKeySize = 32
+)
+
+// sealedSecret is a SealedSecret of the Bitnami sealed-secrets controller
+type sealedSecret struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              sealedSecretSpec `json:"spec"`
+}
+
+type sealedSecretSpec struct {
+	// Template holds the metadata and type of the secret
+	Template      secretTemplate    `json:"template,omitempty"`
+	EncryptedData map[string]string `json:"encryptedData"`
+}
+
+type secretTemplate struct {
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Type              corev1.SecretType `json:"type,omitempty"`
+	// Data holds templates of values, which aren't supported
+	Data map[string]string `json:"data,omitempty"`
+}
+
+// sealingScope returns the scope of s, which decides the label its values are
+// sealed with
+func (s *sealedSecret) sealingScope() string {
+	switch {
+	case s.Annotations[sealedSecretsClusterWide] == "true":
+		return scopeClusterWide
+	case s.Annotations[sealedSecretsNamespaceWide] == "true":
+		return scopeNamespaceWide
+	default:
+		return scopeStrict
+	}
+}
+
+// sealingLabel is authenticated along with the values of a SealedSecret, which
+// ties them to its name and namespace unless its scope is wider
+func sealingLabel(scope, namespace, name string) []byte {
+	switch scope {
+	case scopeClusterWide:
+		return nil
+	case scopeNamespaceWide:
+		return []byte(namespace)
+	default:
+		return []byte(namespace + "/" + name)
+	}
+}
+
+// unseal decrypts the values of s with one of keys into the DecryptedSecret of the
+// secret the sealed-secrets controller writes for it
+func unseal(s *sealedSecret, keys []*rsa.PrivateKey) (*secretsv1alpha1.DecryptedSecret, error) {
+	if len(s.Spec.Template.Data) > 0 {
+		return nil, fmt.Errorf("SealedSecret %s uses templated data, which can't be imported", s.Name)
+	}
+
+	label := sealingLabel(s.sealingScope(), s.Namespace, s.Name)
+	values := make(map[string]string, len(s.Spec.EncryptedData))
+	for key, value := range s.Spec.EncryptedData {
+		ciphertext, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("SealedSecret %s: invalid value %s %v", s.Name, key, err)
+		}
+		plaintext, err := hybridDecrypt(keys, ciphertext, label)
+		if err != nil {
+			return nil, fmt.Errorf("SealedSecret %s: failed to unseal %s %v", s.Name, key, err)
+		}
+		values[key] = string(plaintext)
+	}
+
+	return &secretsv1alpha1.DecryptedSecret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        s.Name,
+			Namespace:   s.Namespace,
+			Labels:      s.Spec.Template.Labels,
+			Annotations: withoutPrefixes(s.Spec.Template.Annotations, []string{sealedSecretsPrefix}),
+		},
+		Type: s.Spec.Template.Type,
+		Data: values,
+	}, nil
+}
+
+// seal encrypts the values of secret with publicKey into a SealedSecret of scope
+func seal(secret *corev1.Secret, publicKey *rsa.PublicKey, scope string) (*sealedSecret, error) {
+	s := &sealedSecret{
+		TypeMeta: metav1.TypeMeta{Kind: sealedSecretKind, APIVersion: sealedSecretAPIVersion},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      secret.Name,
+			Namespace: secret.Namespace,
+		},
+		Spec: sealedSecretSpec{
+			Template: secretTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        secret.Name,
+					Namespace:   secret.Namespace,
+					Labels:      secret.Labels,
+					Annotations: secret.Annotations,
+				},
+				Type: secret.Type,
+			},
+			EncryptedData: make(map[string]string, len(secret.Data)),
+		},
+	}
+	switch scope {
+	case scopeStrict:
+	case scopeNamespaceWide:
+		metav1.SetMetaDataAnnotation(&s.ObjectMeta, sealedSecretsNamespaceWide, "true")
+	case scopeClusterWide:
+		metav1.SetMetaDataAnnotation(&s.ObjectMeta, sealedSecretsClusterWide, "true")
+	default:
+		return nil, fmt.Errorf("invalid scope %s, expected %s, %s or %s", scope, scopeStrict, scopeNamespaceWide, scopeClusterWide)
+	}
+
+	label := sealingLabel(scope, secret.Namespace, secret.Name)
+	for key, value := range secret.Data {
+		ciphertext, err := hybridEncrypt(publicKey, value, label)
+		if err != nil {
+			return nil, err
+		}
+		s.Spec.EncryptedData[key] = base64.StdEncoding.EncodeToString(ciphertext)
+	}
+	return s, nil
+}
+
+// hybridDecrypt decrypts a value sealed by kubeseal: the length of the RSA-OAEP
+// encrypted session key, the session key and the value encrypted with AES-GCM
+// under it. Every key is tried, as the controller keeps its old keys.
+func hybridDecrypt(keys []*rsa.PrivateKey, ciphertext, label []byte) ([]byte, error) {
+	if len(ciphertext) < 2 {
+		return nil, errors.New("ciphertext too short")
+	}
+	rsaLength := int(binary.BigEndian.Uint16(ciphertext))
+	if len(ciphertext) < rsaLength+2 {
+		return nil, errors.New("ciphertext too short")
+	}
+	rsaCiphertext, aesCiphertext := ciphertext[2:rsaLength+2], ciphertext[rsaLength+2:]
+
+	for _, key := range keys {
+		sessionKey, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, key, rsaCiphertext, label)
+		if err != nil {
+			continue
+		}
+		gcm, err := sessionGCM(sessionKey)
+		if err != nil {
+			return nil, err
+		}
+		// every session key is used once, so the nonce is always zero
+		return gcm.Open(nil, make([]byte, gcm.NonceSize()), aesCiphertext, nil)
+	}
+	return nil, errors.New("no sealing key can decrypt the value")
+}
+
+// hybridEncrypt seals plaintext for publicKey like kubeseal does
+func hybridEncrypt(publicKey *rsa.PublicKey, plaintext, label []byte) ([]byte, error) {
+	sessionKey := make([]byte, sessionKeySize)
+	if _, err := rand.Read(sessionKey); err != nil {
+		return nil, err
+	}
+	gcm, err := sessionGCM(sessionKey)
+	if err != nil {
+		return nil, err
+	}
+	rsaCiphertext, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, publicKey, sessionKey, label)
+	if err != nil {
+		return nil, err
+	}
+
+	ciphertext := binary.BigEndian.AppendUint16(nil, uint16(len(rsaCiphertext)))
+	ciphertext = append(ciphertext, rsaCiphertext...)
+	return gcm.Seal(ciphertext, make([]byte, gcm.NonceSize()), plaintext, nil), nil
+}
+
+func sessionGCM(sessionKey []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(sessionKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// loadSealingKeys reads the private keys of the sealed-secrets controller from the
+// file at path, either PEM encoded or the backup of its key secrets written by
+// kubectl get secret -l sealedsecrets.bitnami.com/sealed-secrets-key -o yaml
+func loadSealingKeys(path string) ([]*rsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Contains(data, []byte("-----BEGIN")) {
+		return parsePrivateKeys(data)
+	}
+
+	var list struct {
+		Kind  string          `json:"kind"`
+		Items []corev1.Secret `json:"items"`
+	}
+	if err := yaml.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("invalid sealing keys %s %v", path, err)
+	}
+	if list.Kind == "Secret" {
+		var secret corev1.Secret
+		if err := yaml.Unmarshal(data, &secret); err != nil {
+			return nil, err
+		}
+		list.Items = []corev1.Secret{secret}
+	}
+	var keys []*rsa.PrivateKey
+	for _, secret := range list.Items {
+		secretKeys, err := parsePrivateKeys(secret.Data[corev1.TLSPrivateKeyKey])
+		if err != nil {
+			return nil, fmt.Errorf("secret %s: %w", secret.Name, err)
+		}
+		keys = append(keys, secretKeys...)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no sealing keys in %s", path)
+	}
+	return keys, nil
+}
+
+// parsePrivateKeys returns the RSA private keys of the PEM blocks in data
+func parsePrivateKeys(data []byte) ([]*rsa.PrivateKey, error) {
+	var keys []*rsa.PrivateKey
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		switch block.Type {
+		case "RSA PRIVATE KEY":
+			key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, key)
+		case "PRIVATE KEY":
+			key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			rsaKey, ok := key.(*rsa.PrivateKey)
+			if !ok {
+				return nil, fmt.Errorf("expected an RSA key, got %T", key)
+			}
+			keys = append(keys, rsaKey)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no RSA private keys")
+	}
+	return keys, nil
+}
+
+// loadSealingCertificate reads the public key of the certificate written by
+// kubeseal --fetch-cert from the file at path
+func loadSealingCertificate(path string) (*rsa.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no PEM encoded certificate in %s", path)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("expected an RSA certificate, got a %T key", cert.PublicKey)
+	}
+	return publicKey, nil
+}
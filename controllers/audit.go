@@ -0,0 +1,71 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	"github.com/opensecrecy/encrypted-secrets/pkg/audit"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	secretsv1alpha1 "github.com/opensecrecy/encrypted-secrets/api/v1alpha1"
+)
+
+// recordAudit passes the decryption of obj to sink unless auditing is disabled.
+// Failing to record it is logged but doesn't fail the reconciliation.
+func recordAudit(ctx context.Context, sink audit.Sink, obj client.Object, kind string, event audit.Event, err error) {
+	if sink == nil {
+		return
+	}
+
+	event.Time = time.Now().UTC()
+	if event.Action == "" {
+		event.Action = audit.ActionDecrypt
+	}
+	event.Kind = kind
+	event.Namespace = obj.GetNamespace()
+	event.Name = obj.GetName()
+	event.UID = string(obj.GetUID())
+	event.Outcome = audit.OutcomeSuccess
+	if err != nil {
+		event.Outcome = audit.OutcomeFailure
+		event.Error = err.Error()
+	}
+	if recordErr := sink.Record(ctx, event); recordErr != nil {
+		log.FromContext(ctx).Error(recordErr, "Failed to record audit event")
+	}
+}
+
+// decryptionTrigger tells why a resource with status is decrypted again, given
+// the fingerprint of its current values and keys
+func decryptionTrigger(status string, failures int32, fingerprint, currentFingerprint string) string {
+	switch {
+	case status == "":
+		return audit.TriggerCreated
+	case failures > 0:
+		return audit.TriggerRetry
+	case fingerprint != currentFingerprint:
+		return audit.TriggerChanged
+	case status == secretsv1alpha1.EncryptedSecretStatusReady:
+		// an unchanged resource is only decrypted again when its secret differs
+		return audit.TriggerDrift
+	default:
+		return audit.TriggerRefresh
+	}
+}
@@ -0,0 +1,449 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/opensecrecy/encrypted-secrets/pkg/audit"
+	"github.com/opensecrecy/encrypted-secrets/pkg/providers"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	secretsv1alpha1 "github.com/opensecrecy/encrypted-secrets/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+const (
+	// ClusterEncryptedSecretLabel marks the secrets written for a ClusterEncryptedSecret
+	// with the UID of the ClusterEncryptedSecret
+	ClusterEncryptedSecretLabel = "secrets.opensecrecy.org/cluster-encrypted-secret"
+	// KeyNamespaceAnnotation names the namespace holding the keys of the k8s provider
+	// for a ClusterEncryptedSecret
+	KeyNamespaceAnnotation = "secrets.opensecrecy.org/key-namespace"
+)
+
+// ClusterEncryptedSecretReconciler reconciles a ClusterEncryptedSecret object
+type ClusterEncryptedSecretReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+	log    logr.Logger
+
+	// Policy restricts the providers and keys of every ClusterEncryptedSecret.
+	// The policy annotations of a namespace restrict the secrets written there.
+	Policy providers.Policy
+	// KeyNamespace holds the keys of the k8s provider for ClusterEncryptedSecrets
+	// without a key-namespace annotation
+	KeyNamespace string
+	// DriftPolicy applies to ClusterEncryptedSecrets without a drift policy
+	DriftPolicy string
+	// RefreshInterval applies to ClusterEncryptedSecrets without a refresh interval
+	RefreshInterval time.Duration
+	// Audit records every decryption, nothing is recorded when it's nil
+	Audit audit.Sink
+	// Recorder emits events on the ClusterEncryptedSecrets. SetupWithManager creates one when
+	// it isn't set.
+	Recorder record.EventRecorder
+}
+
+//+kubebuilder:rbac:groups=secrets.opensecrecy.org,resources=clusterencryptedsecrets,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=secrets.opensecrecy.org,resources=clusterencryptedsecrets/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=secrets.opensecrecy.org,resources=clusterencryptedsecrets/finalizers,verbs=update
+//+kubebuilder:rbac:groups=core,resources=namespaces,verbs=get;list;watch
+//+kubebuilder:rbac:groups=secrets.opensecrecy.org,resources=clusterencryptionproviders,verbs=get;list;watch
+//+kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
+
+func (r *ClusterEncryptedSecretReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	r.log = log.FromContext(ctx).WithValues("ClusterEncryptedSecret", req.Name)
+	r.log.Info("Started clusterencryptedsecret reconciliation")
+
+	ctx, span := tracer.Start(ctx, "ClusterEncryptedSecret.Reconcile", trace.WithAttributes(
+		attributeNamespace.String(req.Namespace),
+		attributeName.String(req.Name),
+	))
+	defer span.End()
+
+	instance := &secretsv1alpha1.ClusterEncryptedSecret{}
+
+	if err := r.Get(ctx, req.NamespacedName, instance); err != nil {
+		r.log.Info("Unable to fetch clusterencryptedsecret object")
+		if apierrors.IsNotFound(err) {
+			clusterEncryptedSecretMetrics.forget(req.NamespacedName)
+		}
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	namespaces, err := r.selectedNamespaces(ctx, instance)
+	if err != nil {
+		instance.Status.Status = secretsv1alpha1.EncryptedSecretStatusError
+		instance.Status.Message = fmt.Sprintf("failed to select namespaces %s", err.Error())
+		return r.retry(ctx, instance)
+	}
+
+	targetPolicies, err := r.namespacePolicies(ctx, namespaces)
+	if err != nil {
+		instance.Status.Status = secretsv1alpha1.EncryptedSecretStatusError
+		instance.Status.Message = fmt.Sprintf("failed to get policy %s", err.Error())
+		return r.retry(ctx, instance)
+	}
+
+	// nothing the secrets are derived from changed since they were written last,
+	// so there is no need to decrypt again
+	driftPolicy := resolveDriftPolicy(instance.DriftPolicy, r.DriftPolicy)
+	encryptedSecret, cfg, policies, provider, err := r.provider(ctx, instance)
+	currentFingerprint := ""
+	if err == nil {
+		if primaryKeyVersion, err := provider.PrimaryKeyVersion(ctx); err == nil {
+			currentFingerprint = clusterFingerprint(encryptedSecret, namespaces, cfg, policies, targetPolicies,
+				primaryKeyVersion, driftPolicy)
+		}
+	}
+	if currentFingerprint != "" && currentFingerprint == instance.Status.Fingerprint &&
+		instance.Status.Status == secretsv1alpha1.EncryptedSecretStatusReady {
+		upToDate, err := r.secretsUpToDate(ctx, instance, namespaces)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if upToDate {
+			r.log.Info("Clusterencryptedsecret is unchanged, skipping decryption")
+			clusterEncryptedSecretMetrics.cacheResult(true)
+			span.SetAttributes(attributeOutcome.String("Unchanged"))
+			clusterEncryptedSecretMetrics.observe(req.NamespacedName, instance.Status.Status)
+			clusterEncryptedSecretMetrics.synced(req.NamespacedName)
+			return refreshResult(instance.RefreshInterval, r.RefreshInterval), nil
+		}
+	}
+
+	var decryptedObj *secretsv1alpha1.DecryptedSecret
+	var keyVersions []string
+	if err == nil {
+		clusterEncryptedSecretMetrics.cacheResult(false)
+		decryptedObj, keyVersions, err = providers.DecryptWithProvider(ctx, provider, encryptedSecret)
+	}
+	auditEvent := audit.Event{
+		Provider: cfg.Provider,
+		KeyIDs:   keyVersions,
+		Keys:     sortedDataKeys(instance.Data),
+		Trigger: decryptionTrigger(instance.Status.Status, instance.Status.Failures,
+			instance.Status.Fingerprint, currentFingerprint),
+	}
+	if err != nil {
+		recordAudit(ctx, r.Audit, instance, "ClusterEncryptedSecret", auditEvent, err)
+		r.log.Error(err, "Failed to decrypt")
+		recordDecryptFailure(r.recorder(), instance, err)
+		instance.Status.Status = errorStatus(err)
+		instance.Status.Message = fmt.Sprintf("failed to decrypt value for %s", err.Error())
+		return r.retry(ctx, instance)
+	}
+
+	// the secrets carry the labels of the ClusterEncryptedSecret and the label
+	// used to find them again once their namespace isn't selected anymore
+	secretLabels := map[string]string{}
+	for key, value := range instance.Labels {
+		secretLabels[key] = value
+	}
+	secretLabels[ClusterEncryptedSecretLabel] = string(instance.UID)
+
+	failed := 0
+	var allowed []string
+	instance.Status.Namespaces = nil
+	for _, namespace := range namespaces {
+		namespaceStatus := secretsv1alpha1.NamespaceStatus{
+			Namespace: namespace,
+			Status:    secretsv1alpha1.EncryptedSecretStatusReady,
+		}
+		// the values are never written into a namespace whose policy refuses them
+		if err := checkPolicies(targetPolicies[namespace], cfg.Provider, keyVersions); err != nil {
+			r.log.Error(err, "Refused to write secret", "namespace", namespace)
+			recordDecryptFailure(r.recorder(), instance, fmt.Errorf("namespace %s: %w", namespace, err))
+			namespaceStatus.Status = errorStatus(err)
+			namespaceStatus.Message = err.Error()
+			instance.Status.Namespaces = append(instance.Status.Namespaces, namespaceStatus)
+			failed++
+			continue
+		}
+		allowed = append(allowed, namespace)
+
+		write, err := r.writeNamespaceSecret(ctx, instance, namespace, secretLabels, decryptedObj)
+		if err == nil {
+			auditEvent.Secrets = append(auditEvent.Secrets, namespace+"/"+instance.Name)
+		}
+		if err != nil {
+			r.log.Error(err, "Failed to write secret", "namespace", namespace)
+			recordSecretConflict(r.recorder(), instance, err)
+			namespaceStatus.Status = secretsv1alpha1.EncryptedSecretStatusError
+			namespaceStatus.Message = err.Error()
+			failed++
+		} else if recordDrift(r.recorder(), instance, namespace, write) {
+			namespaceStatus.Status = secretsv1alpha1.EncryptedSecretStatusDrifted
+			namespaceStatus.Message = "secret was changed by hand, keeping the changes"
+		}
+		instance.Status.Namespaces = append(instance.Status.Namespaces, namespaceStatus)
+	}
+
+	var writeErr error
+	if failed > 0 {
+		writeErr = fmt.Errorf("failed to write secret %s to %d of %d namespaces", instance.Name, failed, len(namespaces))
+	}
+	recordAudit(ctx, r.Audit, instance, "ClusterEncryptedSecret", auditEvent, writeErr)
+
+	if err := r.cleanupSecrets(ctx, instance, allowed); err != nil {
+		instance.Status.Status = secretsv1alpha1.EncryptedSecretStatusError
+		instance.Status.Message = fmt.Sprintf("failed to clean up secrets %s", err.Error())
+		return r.retry(ctx, instance)
+	}
+
+	instance.Status.KeyVersion = strings.Join(keyVersions, ",")
+	if failed > 0 {
+		instance.Status.Status = secretsv1alpha1.EncryptedSecretStatusError
+		instance.Status.Message = fmt.Sprintf("failed to write secret %s to %d of %d namespaces", instance.Name, failed, len(namespaces))
+		return r.retry(ctx, instance)
+	}
+
+	instance.Status.Fingerprint = currentFingerprint
+	instance.Status.Status = secretsv1alpha1.EncryptedSecretStatusReady
+	instance.Status.Message = fmt.Sprintf("cluster encrypted secrets %s is ready to be used in %d namespaces", instance.Name, len(namespaces))
+	return r.refresh(ctx, instance)
+}
+
+// selectedNamespaces returns the sorted names of the namespaces matching the
+// namespace selector of instance
+func (r *ClusterEncryptedSecretReconciler) selectedNamespaces(ctx context.Context, instance *secretsv1alpha1.ClusterEncryptedSecret) ([]string, error) {
+	matches, err := namespaceMatcher(&instance.NamespaceSelector)
+	if err != nil {
+		return nil, err
+	}
+
+	namespaceList := &corev1.NamespaceList{}
+	if err := r.List(ctx, namespaceList); err != nil {
+		return nil, err
+	}
+
+	var namespaces []string
+	for _, namespace := range namespaceList.Items {
+		// secrets can't be created in terminating namespaces
+		if namespace.Status.Phase == corev1.NamespaceTerminating {
+			continue
+		}
+		if matches(&namespace) {
+			namespaces = append(namespaces, namespace.Name)
+		}
+	}
+	sort.Strings(namespaces)
+	return namespaces, nil
+}
+
+// provider returns the provider the data of instance is decrypted with once for
+// all namespaces, using the keys of the key namespace for the k8s provider. The
+// data is returned as an EncryptedSecret in the key namespace.
+func (r *ClusterEncryptedSecretReconciler) provider(ctx context.Context, instance *secretsv1alpha1.ClusterEncryptedSecret) (
+	*secretsv1alpha1.EncryptedSecret, providers.Config, []providers.Policy, providers.Provider, error) {
+
+	if ref := instance.ProviderRef; ref != nil && ref.Kind != secretsv1alpha1.ClusterEncryptionProviderKind {
+		return nil, providers.Config{}, nil, nil, fmt.Errorf("cluster scoped resources can only reference a %s", secretsv1alpha1.ClusterEncryptionProviderKind)
+	}
+
+	keyNamespace := instance.Annotations[KeyNamespaceAnnotation]
+	if keyNamespace == "" {
+		keyNamespace = r.KeyNamespace
+	}
+	if keyNamespace == "" && instance.ProviderRef == nil && instance.Annotations[providers.ProviderAnnotation] == providers.K8sProvider {
+		return nil, providers.Config{}, nil, nil, fmt.Errorf("no key namespace, set the %s annotation", KeyNamespaceAnnotation)
+	}
+
+	cfg, policies, err := resolveProvider(ctx, r.Client, instance, instance.ProviderRef, keyNamespace, r.Policy)
+	if err != nil {
+		return nil, cfg, nil, nil, err
+	}
+	provider, err := buildProvider(ctx, cfg, policies)
+	if err != nil {
+		return nil, cfg, nil, nil, err
+	}
+
+	encryptedSecret := &secretsv1alpha1.EncryptedSecret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        instance.Name,
+			Namespace:   keyNamespace,
+			Labels:      instance.Labels,
+			Annotations: instance.Annotations,
+		},
+		Data: instance.Data,
+	}
+	return encryptedSecret, cfg, policies, provider, nil
+}
+
+// namespacePolicies returns the policies restricting the secrets of each of namespaces
+func (r *ClusterEncryptedSecretReconciler) namespacePolicies(ctx context.Context, namespaces []string) (map[string][]providers.Policy, error) {
+	policies := make(map[string][]providers.Policy, len(namespaces))
+	for _, namespace := range namespaces {
+		forNamespace, err := namespacePolicies(ctx, r.Client, namespace, r.Policy)
+		if err != nil {
+			return nil, err
+		}
+		policies[namespace] = forNamespace
+	}
+	return policies, nil
+}
+
+// secretsUpToDate reports whether the secrets of instance in namespaces all
+// still hold the values written last
+func (r *ClusterEncryptedSecretReconciler) secretsUpToDate(ctx context.Context, instance *secretsv1alpha1.ClusterEncryptedSecret,
+	namespaces []string) (bool, error) {
+
+	for _, namespace := range namespaces {
+		upToDate, err := secretUpToDate(ctx, r.Client, types.NamespacedName{Namespace: namespace, Name: instance.Name})
+		if err != nil || !upToDate {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// writeNamespaceSecret writes the secret into namespace, unless a secret with the
+// same name that doesn't belong to instance is in the way
+func (r *ClusterEncryptedSecretReconciler) writeNamespaceSecret(ctx context.Context, instance *secretsv1alpha1.ClusterEncryptedSecret,
+	namespace string, secretLabels map[string]string, decryptedObj *secretsv1alpha1.DecryptedSecret) (secretWrite, error) {
+
+	existing := &corev1.Secret{}
+	err := r.Get(ctx, types.NamespacedName{Namespace: namespace, Name: instance.Name}, existing)
+	if err == nil && existing.Labels[ClusterEncryptedSecretLabel] != string(instance.UID) {
+		return secretWrite{}, &secretConflictError{msg: fmt.Sprintf("secret %s/%s already exists and is not managed by this cluster encrypted secret",
+			namespace, instance.Name)}
+	}
+	if err != nil && !apierrors.IsNotFound(err) {
+		return secretWrite{}, err
+	}
+
+	return writeSecret(ctx, r.Client, r.Scheme, instance, namespace, secretLabels, decryptedObj,
+		resolveDriftPolicy(instance.DriftPolicy, r.DriftPolicy))
+}
+
+// cleanupSecrets deletes the secrets of instance in namespaces that aren't selected
+// anymore or whose policy refuses them
+func (r *ClusterEncryptedSecretReconciler) cleanupSecrets(ctx context.Context, instance *secretsv1alpha1.ClusterEncryptedSecret, namespaces []string) error {
+	selected := make(map[string]bool, len(namespaces))
+	for _, namespace := range namespaces {
+		selected[namespace] = true
+	}
+
+	secretList := &corev1.SecretList{}
+	if err := r.List(ctx, secretList, client.MatchingLabels{ClusterEncryptedSecretLabel: string(instance.UID)}); err != nil {
+		return err
+	}
+
+	for i := range secretList.Items {
+		secret := &secretList.Items[i]
+		if selected[secret.Namespace] {
+			continue
+		}
+		r.log.Info("Deleting secret of unselected namespace", "namespace", secret.Namespace)
+		if err := r.Delete(ctx, secret); client.IgnoreNotFound(err) != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recorder returns the recorder of the events on the ClusterEncryptedSecrets. Reconcilers
+// built without one, like those of the tests, drop the events.
+func (r *ClusterEncryptedSecretReconciler) recorder() record.EventRecorder {
+	return eventRecorder(r.Recorder)
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *ClusterEncryptedSecretReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	if r.Recorder == nil {
+		r.Recorder = mgr.GetEventRecorderFor("clusterencryptedsecret-controller")
+	}
+	return ctrl.NewControllerManagedBy(mgr).
+		// status updates don't need another reconciliation
+		For(&secretsv1alpha1.ClusterEncryptedSecret{}, builder.WithPredicates(predicate.Or(
+			predicate.GenerationChangedPredicate{},
+			predicate.AnnotationChangedPredicate{},
+			predicate.LabelChangedPredicate{},
+		))).
+		Owns(&corev1.Secret{}).
+		Watches(&corev1.Namespace{}, handler.EnqueueRequestsFromMapFunc(r.requestsForNamespace)).
+		Watches(&secretsv1alpha1.ClusterEncryptionProvider{}, handler.EnqueueRequestsFromMapFunc(r.requestsForNamespace),
+			builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Complete(r)
+}
+
+// requestsForNamespace reconciles every ClusterEncryptedSecret when a namespace
+// changes, since its labels may now match a different set of selectors. It does
+// the same for changes of a ClusterEncryptionProvider.
+func (r *ClusterEncryptedSecretReconciler) requestsForNamespace(ctx context.Context, _ client.Object) []reconcile.Request {
+	list := &secretsv1alpha1.ClusterEncryptedSecretList{}
+	if err := r.List(ctx, list); err != nil {
+		return nil
+	}
+
+	requests := make([]reconcile.Request, 0, len(list.Items))
+	for _, item := range list.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: item.Name}})
+	}
+	return requests
+}
+
+// ensureStatus makes sure that proper status is applied to the ClusterEncryptedSecret instance
+func (r *ClusterEncryptedSecretReconciler) ensureStatus(ctx context.Context, instance *secretsv1alpha1.ClusterEncryptedSecret, result ctrl.Result) (ctrl.Result, error) {
+
+	trace.SpanFromContext(ctx).SetAttributes(
+		attributeOutcome.String(instance.Status.Status),
+		attributeKeyCount.Int(len(instance.Data)),
+	)
+
+	err := r.Status().Update(ctx, instance)
+	if err != nil {
+		r.log.Error(err, "Failed to update status")
+		return ctrl.Result{Requeue: true}, nil
+	}
+
+	clusterEncryptedSecretMetrics.observe(client.ObjectKeyFromObject(instance), instance.Status.Status)
+	return result, nil
+}
+
+// retry records another failed reconciliation and retries it after a backoff
+func (r *ClusterEncryptedSecretReconciler) retry(ctx context.Context, instance *secretsv1alpha1.ClusterEncryptedSecret) (ctrl.Result, error) {
+	instance.Status.Failures++
+	return r.ensureStatus(ctx, instance, retryResult(instance.Status.Failures, instance.RefreshInterval, r.RefreshInterval))
+}
+
+// refresh resets the failures of a successful reconciliation and refreshes the
+// secret after the refresh interval
+func (r *ClusterEncryptedSecretReconciler) refresh(ctx context.Context, instance *secretsv1alpha1.ClusterEncryptedSecret) (ctrl.Result, error) {
+	instance.Status.Failures = 0
+	clusterEncryptedSecretMetrics.synced(client.ObjectKeyFromObject(instance))
+	return r.ensureStatus(ctx, instance, refreshResult(instance.RefreshInterval, r.RefreshInterval))
+}
@@ -0,0 +1,256 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/opensecrecy/encrypted-secrets/pkg/audit"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	secretsv1alpha1 "github.com/opensecrecy/encrypted-secrets/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+var _ = Describe("ClusterEncryptedSecrets", func() {
+
+	Context("Verify controller", func() {
+		ctx := context.Background()
+
+		It("Reconcile non-existent object", func() {
+			res, err := clusterReconciler.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Name: "test-cluster-secret-non-existent"}})
+			Expect(err).To(BeNil())
+			Expect(res.Requeue).To(BeFalse())
+		})
+		It("Write the secret into every selected namespace", func() {
+			for name, labels := range map[string]map[string]string{
+				"cluster-keys": nil,
+				"team-a":       {"registry-credentials": "true"},
+				"team-b":       {"registry-credentials": "true"},
+				"team-c":       nil,
+				"team-d":       nil,
+			} {
+				Expect(k8sClient.Create(ctx, &corev1.Namespace{
+					ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels},
+				})).To(Succeed())
+			}
+
+			decryptionKey := &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "cryptctl-key",
+					Namespace: "cluster-keys",
+				},
+				Data: map[string][]byte{
+					"tls.crt": []byte("justRandomEncryptionKey"),
+				},
+			}
+			Expect(k8sClient.Create(ctx, decryptionKey)).To(Succeed())
+
+			// a secret that isn't managed by the cluster encrypted secret must be left alone
+			unmanaged := &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "registry-credentials",
+					Namespace: "team-d",
+				},
+				Data: map[string][]byte{
+					"secret": []byte("do-not-touch"),
+				},
+			}
+			Expect(k8sClient.Create(ctx, unmanaged)).To(Succeed())
+
+			instance := &secretsv1alpha1.ClusterEncryptedSecret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "registry-credentials",
+					Annotations: map[string]string{
+						"secrets.opensecrecy.org/provider":      "k8s",
+						"secrets.opensecrecy.org/key-namespace": "cluster-keys",
+					},
+				},
+				NamespaceSelector: secretsv1alpha1.NamespaceSelector{
+					LabelSelector: &metav1.LabelSelector{
+						MatchLabels: map[string]string{"registry-credentials": "true"},
+					},
+					Names: []string{"team-c"},
+				},
+				Data: map[string]string{
+					"secret": "VdnNsF55TFX9kRiorzy0XPJQRK0FlICFntVqgEMeGOqq+IZfpHmr",
+				},
+			}
+			Expect(k8sClient.Create(ctx, instance)).Should(Succeed())
+
+			namespacedName := types.NamespacedName{Name: instance.Name}
+			_, err := clusterReconciler.Reconcile(ctx, ctrl.Request{NamespacedName: namespacedName})
+			Expect(err).To(BeNil())
+
+			Expect(k8sClient.Get(ctx, namespacedName, instance)).To(Succeed())
+			Expect(instance.Status.Status).To(Equal(secretsv1alpha1.EncryptedSecretStatusReady))
+			Expect(instance.Status.Namespaces).To(HaveLen(3))
+
+			for _, namespace := range []string{"team-a", "team-b", "team-c"} {
+				secret := &corev1.Secret{}
+				Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: namespace, Name: instance.Name}, secret)).To(Succeed())
+				Expect(secret.Data["secret"]).To(Equal([]byte("hello-world")))
+			}
+
+			// selecting team-d conflicts with the unmanaged secret
+			instance.NamespaceSelector.Names = []string{"team-d"}
+			Expect(k8sClient.Update(ctx, instance)).To(Succeed())
+			_, err = clusterReconciler.Reconcile(ctx, ctrl.Request{NamespacedName: namespacedName})
+			Expect(err).To(BeNil())
+
+			Expect(k8sClient.Get(ctx, namespacedName, instance)).To(Succeed())
+			Expect(instance.Status.Status).To(Equal(secretsv1alpha1.EncryptedSecretStatusError))
+			Expect(instance.Status.Namespaces).To(ContainElement(secretsv1alpha1.NamespaceStatus{
+				Namespace: "team-d",
+				Status:    secretsv1alpha1.EncryptedSecretStatusError,
+				Message:   "secret registry-credentials already exists and is not managed by this cluster encrypted secret",
+			}))
+
+			secret := &corev1.Secret{}
+			Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: "team-d", Name: instance.Name}, secret)).To(Succeed())
+			Expect(secret.Data["secret"]).To(Equal([]byte("do-not-touch")))
+
+			// team-c isn't selected anymore, so its secret is cleaned up
+			err = k8sClient.Get(ctx, types.NamespacedName{Namespace: "team-c", Name: instance.Name}, secret)
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("not found"))
+		})
+
+		It("Only write into namespaces whose policy allows the keys", func() {
+			for name, annotations := range map[string]map[string]string{
+				"cluster-policy-keys":    nil,
+				"cluster-policy-allowed": nil,
+				"cluster-policy-refused": {"secrets.opensecrecy.org/allowed-key-ids": "team-z-*"},
+			} {
+				err := k8sClient.Create(ctx, &corev1.Namespace{
+					ObjectMeta: metav1.ObjectMeta{Name: name, Annotations: annotations},
+				})
+				Expect(client.IgnoreAlreadyExists(err)).To(Succeed())
+			}
+			err := k8sClient.Create(ctx, &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "cryptctl-key", Namespace: "cluster-policy-keys"},
+				Data:       map[string][]byte{"tls.crt": []byte("justRandomEncryptionKey")},
+			})
+			Expect(client.IgnoreAlreadyExists(err)).To(Succeed())
+
+			instance := &secretsv1alpha1.ClusterEncryptedSecret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "cluster-policy-credentials",
+					Annotations: map[string]string{
+						"secrets.opensecrecy.org/provider":      "k8s",
+						"secrets.opensecrecy.org/key-namespace": "cluster-policy-keys",
+					},
+				},
+				NamespaceSelector: secretsv1alpha1.NamespaceSelector{
+					Names: []string{"cluster-policy-allowed", "cluster-policy-refused"},
+				},
+				Data: map[string]string{
+					"secret": "VdnNsF55TFX9kRiorzy0XPJQRK0FlICFntVqgEMeGOqq+IZfpHmr",
+				},
+			}
+			Expect(client.IgnoreAlreadyExists(k8sClient.Create(ctx, instance))).Should(Succeed())
+
+			namespacedName := types.NamespacedName{Name: instance.Name}
+			_, err = clusterReconciler.Reconcile(ctx, ctrl.Request{NamespacedName: namespacedName})
+			Expect(err).To(BeNil())
+
+			Expect(k8sClient.Get(ctx, namespacedName, instance)).To(Succeed())
+			Expect(instance.Status.Status).To(Equal(secretsv1alpha1.EncryptedSecretStatusError))
+			Expect(instance.Status.Namespaces).To(HaveLen(2))
+			Expect(instance.Status.Namespaces[0].Status).To(Equal(secretsv1alpha1.EncryptedSecretStatusReady))
+			Expect(instance.Status.Namespaces[1].Namespace).To(Equal("cluster-policy-refused"))
+			Expect(instance.Status.Namespaces[1].Status).To(Equal(secretsv1alpha1.EncryptedSecretStatusForbidden))
+
+			secret := &corev1.Secret{}
+			Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: "cluster-policy-allowed", Name: instance.Name}, secret)).To(Succeed())
+			Expect(secret.Data["secret"]).To(Equal([]byte("hello-world")))
+			Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: "cluster-policy-refused", Name: instance.Name}, secret)).NotTo(Succeed())
+		})
+
+		It("Skip unchanged secrets and record why they are decrypted", func() {
+			for _, name := range []string{"audit-keys", "audit-team"} {
+				err := k8sClient.Create(ctx, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}})
+				Expect(client.IgnoreAlreadyExists(err)).To(Succeed())
+			}
+			err := k8sClient.Create(ctx, &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "cryptctl-key", Namespace: "audit-keys"},
+				Data:       map[string][]byte{"tls.crt": []byte("justRandomEncryptionKey")},
+			})
+			Expect(client.IgnoreAlreadyExists(err)).To(Succeed())
+
+			var records bytes.Buffer
+			reconciler := &ClusterEncryptedSecretReconciler{
+				Client:   k8sClient,
+				Scheme:   clusterReconciler.Scheme,
+				Audit:    audit.NewWriterSink(&records),
+				Recorder: record.NewFakeRecorder(100),
+			}
+			instance := &secretsv1alpha1.ClusterEncryptedSecret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "audited-credentials",
+					Annotations: map[string]string{
+						"secrets.opensecrecy.org/provider":      "k8s",
+						"secrets.opensecrecy.org/key-namespace": "audit-keys",
+					},
+				},
+				NamespaceSelector: secretsv1alpha1.NamespaceSelector{Names: []string{"audit-team"}},
+				Data: map[string]string{
+					"secret": "VdnNsF55TFX9kRiorzy0XPJQRK0FlICFntVqgEMeGOqq+IZfpHmr",
+				},
+			}
+			Expect(k8sClient.Create(ctx, instance)).Should(Succeed())
+
+			namespacedName := types.NamespacedName{Name: instance.Name}
+			secretName := types.NamespacedName{Namespace: "audit-team", Name: instance.Name}
+			hits := testutil.ToFloat64(decryptionCache.WithLabelValues("ClusterEncryptedSecret", "hit"))
+			misses := testutil.ToFloat64(decryptionCache.WithLabelValues("ClusterEncryptedSecret", "miss"))
+			for i := 0; i < 2; i++ {
+				_, err = reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: namespacedName})
+				Expect(err).To(BeNil())
+			}
+			Expect(testutil.ToFloat64(decryptionCache.WithLabelValues("ClusterEncryptedSecret", "hit"))).To(Equal(hits + 1))
+			Expect(testutil.ToFloat64(decryptionCache.WithLabelValues("ClusterEncryptedSecret", "miss"))).To(Equal(misses + 1))
+			// the secret is deleted by hand
+			Expect(k8sClient.Delete(ctx, &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Namespace: secretName.Namespace, Name: secretName.Name},
+			})).To(Succeed())
+			_, err = reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: namespacedName})
+			Expect(err).To(BeNil())
+			Expect(k8sClient.Get(ctx, secretName, &corev1.Secret{})).To(Succeed())
+
+			// the second reconciliation skipped the decryption
+			var triggers []string
+			for _, line := range strings.Split(strings.TrimSpace(records.String()), "\n") {
+				var event audit.Event
+				Expect(json.Unmarshal([]byte(line), &event)).To(Succeed())
+				triggers = append(triggers, event.Trigger)
+			}
+			Expect(triggers).To(Equal([]string{audit.TriggerCreated, audit.TriggerDrift}))
+		})
+	})
+})
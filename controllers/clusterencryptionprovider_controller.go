@@ -0,0 +1,110 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-logr/logr"
+	"github.com/opensecrecy/encrypted-secrets/pkg/providers"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	secretsv1alpha1 "github.com/opensecrecy/encrypted-secrets/api/v1alpha1"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+// ClusterEncryptionProviderReconciler reconciles a ClusterEncryptionProvider object
+type ClusterEncryptionProviderReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+	log    logr.Logger
+}
+
+//+kubebuilder:rbac:groups=secrets.opensecrecy.org,resources=clusterencryptionproviders,verbs=get;list;watch
+//+kubebuilder:rbac:groups=secrets.opensecrecy.org,resources=clusterencryptionproviders/status,verbs=get;update;patch
+
+func (r *ClusterEncryptionProviderReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	r.log = log.FromContext(ctx).WithValues("ClusterEncryptionProvider", req.Name)
+	r.log.Info("Started clusterencryptionprovider reconciliation")
+
+	instance := &secretsv1alpha1.ClusterEncryptionProvider{}
+
+	if err := r.Get(ctx, req.NamespacedName, instance); err != nil {
+		r.log.Info("Unable to fetch clusterencryptionprovider object")
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	// the k8s and sops providers read the keys from the namespace of every
+	// EncryptedSecret unless they reference key secrets, so there is nothing to check
+	if keysInEachNamespace(instance.Spec.EncryptionProviderSpec) {
+		instance.Status.Status = secretsv1alpha1.EncryptedSecretStatusReady
+		instance.Status.Message = fmt.Sprintf("provider %s reads the keys from the namespace of each encrypted secret", instance.Name)
+		instance.Status.KeyVersion = ""
+		return r.ensureStatus(ctx, instance, ctrl.Result{})
+	}
+
+	keyVersion, err := checkProvider(ctx, r.Client, instance.Spec.EncryptionProviderSpec, "", true, true)
+	if err != nil {
+		r.log.Error(err, "Provider is not ready")
+		instance.Status.Status = secretsv1alpha1.EncryptedSecretStatusError
+		instance.Status.Message = fmt.Sprintf("provider is not ready %s", err.Error())
+		instance.Status.KeyVersion = ""
+		return r.ensureStatus(ctx, instance, ctrl.Result{RequeueAfter: providerCheckInterval})
+	}
+
+	instance.Status.Status = secretsv1alpha1.EncryptedSecretStatusReady
+	instance.Status.Message = fmt.Sprintf("provider %s is ready to be used", instance.Name)
+	instance.Status.KeyVersion = keyVersion
+	return r.ensureStatus(ctx, instance, ctrl.Result{RequeueAfter: providerCheckInterval})
+}
+
+// keysInEachNamespace reports whether the provider configured by spec reads its
+// keys from the default key secrets of the namespace it is used in
+func keysInEachNamespace(spec secretsv1alpha1.EncryptionProviderSpec) bool {
+	switch spec.Type {
+	case providers.K8sProvider:
+		return spec.K8s == nil || spec.K8s.KeySecretRef == nil
+	case providers.SOPSProvider:
+		return spec.Sops == nil || (spec.Sops.AgeKeySecretRef == nil && spec.Sops.PGPKeySecretRef == nil)
+	default:
+		return false
+	}
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *ClusterEncryptionProviderReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&secretsv1alpha1.ClusterEncryptionProvider{}, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Complete(r)
+}
+
+// ensureStatus makes sure that proper status is applied to the ClusterEncryptionProvider instance
+func (r *ClusterEncryptionProviderReconciler) ensureStatus(ctx context.Context, instance *secretsv1alpha1.ClusterEncryptionProvider, result ctrl.Result) (ctrl.Result, error) {
+
+	err := r.Status().Update(ctx, instance)
+	if err != nil {
+		r.log.Error(err, "Failed to update status")
+		return ctrl.Result{Requeue: true}, nil
+	}
+
+	return result, nil
+}
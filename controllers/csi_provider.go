@@ -0,0 +1,211 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strconv"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+
+	secretsv1alpha1 "github.com/opensecrecy/encrypted-secrets/api/v1alpha1"
+	"github.com/opensecrecy/encrypted-secrets/pkg/audit"
+	"github.com/opensecrecy/encrypted-secrets/pkg/csi"
+	"github.com/opensecrecy/encrypted-secrets/pkg/providers"
+)
+
+const (
+	// CSIOnlyAnnotation keeps the EncryptedSecret reconciler from writing a secret
+	// when it is "true", the values are only mounted by the CSI provider
+	CSIOnlyAnnotation = "secrets.opensecrecy.org/csi-only"
+
+	// csiObjectsParameter is the parameter of a SecretProviderClass listing the
+	// values to mount
+	csiObjectsParameter = "objects"
+	// csiPodNamespaceAttribute is added to the parameters by the driver
+	csiPodNamespaceAttribute = "csi.storage.k8s.io/pod.namespace"
+
+	csiAPIVersion  = "v1alpha1"
+	csiRuntimeName = "encrypted-secrets"
+	// csiFileMode is the mode of the files when the driver doesn't ask for one,
+	// only their owner can read the decrypted values
+	csiFileMode = 0o600
+)
+
+// csiObject selects values of an EncryptedSecret in the namespace of the pod
+type csiObject struct {
+	// Name is the name of the EncryptedSecret
+	Name string `json:"name"`
+	// Key selects a single value, every value is mounted when it's empty
+	Key string `json:"key,omitempty"`
+	// Path is the file of the value, or the directory of the values when Key is
+	// empty. It defaults to the key, or the top of the volume.
+	Path string `json:"path,omitempty"`
+}
+
+// CSIProvider is a provider of the Secrets Store CSI driver that mounts the
+// values of EncryptedSecrets into pods without writing a secret. The values
+// are decrypted with the provider of the EncryptedSecret restricted by the
+// policies of its namespace, like the reconciler does.
+type CSIProvider struct {
+	Client client.Client
+	// Policy applies to every namespace, the policy annotations of a namespace
+	// can only narrow it
+	Policy providers.Policy
+	// Audit records every mount, nothing is recorded when it's nil
+	Audit audit.Sink
+	// SOPSOperatorKeys lets the sops provider decrypt with the age identities, AWS
+	// credentials and gpg keyring of the operator, besides the keys of the
+	// namespace or provider
+	SOPSOperatorKeys bool
+	// OperatorAWSCredentials lets the aws-kms providers of EncryptionProviders
+	// without the SecretRef auth method use the AWS credentials of the operator
+	OperatorAWSCredentials bool
+}
+
+// Version implements csi.ProviderServer
+func (p *CSIProvider) Version(_ context.Context, _ *csi.VersionRequest) (*csi.VersionResponse, error) {
+	return &csi.VersionResponse{Version: csiAPIVersion, RuntimeName: csiRuntimeName, RuntimeVersion: csiAPIVersion}, nil
+}
+
+// Mount implements csi.ProviderServer. It returns the files of the objects
+// parameter of the SecretProviderClass, a YAML list of csiObjects.
+func (p *CSIProvider) Mount(ctx context.Context, req *csi.MountRequest) (*csi.MountResponse, error) {
+	var attributes map[string]string
+	if err := json.Unmarshal([]byte(req.Attributes), &attributes); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid attributes %v", err)
+	}
+	mode := int32(csiFileMode)
+	if req.Permission != "" {
+		if err := json.Unmarshal([]byte(req.Permission), &mode); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid permission %v", err)
+		}
+	}
+	namespace := attributes[csiPodNamespaceAttribute]
+	if namespace == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "missing attribute %s", csiPodNamespaceAttribute)
+	}
+	var objects []csiObject
+	if err := yaml.Unmarshal([]byte(attributes[csiObjectsParameter]), &objects); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid %s parameter %v", csiObjectsParameter, err)
+	}
+	if len(objects) == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "the %s parameter selects no EncryptedSecret", csiObjectsParameter)
+	}
+
+	policies, err := namespacePolicies(ctx, p.Client, namespace, p.Policy)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	resp := &csi.MountResponse{}
+	decrypted := make(map[string]*secretsv1alpha1.DecryptedSecret)
+	paths := make(map[string]string)
+	for _, object := range objects {
+		decryptedObj, ok := decrypted[object.Name]
+		if !ok {
+			instance, obj, err := p.decrypt(ctx, namespace, object.Name, policies)
+			if err != nil {
+				return nil, err
+			}
+			decryptedObj = obj
+			decrypted[object.Name] = obj
+			resp.ObjectVersions = append(resp.ObjectVersions, &csi.ObjectVersion{
+				ID:      "encryptedsecret/" + object.Name,
+				Version: strconv.FormatInt(instance.Generation, 10),
+			})
+		}
+
+		keys := []string{object.Key}
+		if object.Key == "" {
+			keys = sortedDataKeys(decryptedObj.Data)
+		}
+		for _, key := range keys {
+			value, ok := decryptedObj.Data[key]
+			if !ok {
+				return nil, status.Errorf(codes.NotFound, "EncryptedSecret %s has no key %s", object.Name, key)
+			}
+			file := key
+			switch {
+			case object.Key != "" && object.Path != "":
+				file = object.Path
+			case object.Key == "" && object.Path != "":
+				file = path.Join(object.Path, key)
+			}
+			if !validCSIPath(file) {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid path %s of EncryptedSecret %s", file, object.Name)
+			}
+			if previous, ok := paths[file]; ok {
+				return nil, status.Errorf(codes.InvalidArgument, "path %s is used by %s and %s", file, previous, object.Name)
+			}
+			paths[file] = object.Name
+			resp.Files = append(resp.Files, &csi.File{Path: file, Mode: mode, Contents: []byte(value)})
+		}
+	}
+	return resp, nil
+}
+
+// decrypt decrypts the EncryptedSecret name of namespace with its provider
+// restricted by the policies of the namespace
+func (p *CSIProvider) decrypt(ctx context.Context, namespace, name string, policies []providers.Policy) (
+	*secretsv1alpha1.EncryptedSecret, *secretsv1alpha1.DecryptedSecret, error) {
+
+	instance := &secretsv1alpha1.EncryptedSecret{}
+	if err := p.Client.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, instance); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil, status.Errorf(codes.NotFound, "EncryptedSecret %s not found in namespace %s", name, namespace)
+		}
+		return nil, nil, status.Error(codes.Internal, err.Error())
+	}
+
+	auditEvent := audit.Event{Keys: sortedDataKeys(instance.Data), Trigger: audit.TriggerMount}
+	cfg, policies, err := resolveProvider(ctx, p.Client, instance, instance.ProviderRef, namespace, policies...)
+	cfg.SOPSOperatorKeys = p.SOPSOperatorKeys
+	cfg.OperatorAWSCredentials = p.OperatorAWSCredentials
+	var provider providers.Provider
+	if err == nil {
+		auditEvent.Provider = cfg.Provider
+		provider, err = buildProvider(ctx, cfg, policies)
+	}
+	var decryptedObj *secretsv1alpha1.DecryptedSecret
+	if err == nil {
+		decryptedObj, auditEvent.KeyIDs, err = providers.DecryptWithProvider(ctx, provider, instance)
+	}
+	recordAudit(ctx, p.Audit, instance, "EncryptedSecret", auditEvent, err)
+	if err != nil {
+		code := codes.Internal
+		if providers.IsPolicyError(err) {
+			code = codes.PermissionDenied
+		}
+		return nil, nil, status.Error(code, fmt.Sprintf("failed to decrypt EncryptedSecret %s %v", name, err))
+	}
+	return instance, decryptedObj, nil
+}
+
+// validCSIPath reports whether file stays inside the volume
+func validCSIPath(file string) bool {
+	return filepath.IsLocal(file) && path.Clean(file) == file
+}
@@ -0,0 +1,128 @@
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	secretsv1alpha1 "github.com/opensecrecy/encrypted-secrets/api/v1alpha1"
+	"github.com/opensecrecy/encrypted-secrets/pkg/csi"
+)
+
+var _ = Describe("CSI provider", func() {
+
+	Context("Mount EncryptedSecrets", func() {
+		ctx := context.Background()
+
+		mountRequest := func(namespace, objects string) *csi.MountRequest {
+			return &csi.MountRequest{
+				Attributes: `{"csi.storage.k8s.io/pod.namespace":"` + namespace + `","csi.storage.k8s.io/pod.name":"app",` +
+					`"objects":` + objects + `}`,
+				TargetPath: "/var/lib/kubelet/pods/uid/volumes/kubernetes.io~csi/secrets/mount",
+				Permission: "256",
+			}
+		}
+
+		// createCSIOnly creates the csi-only EncryptedSecret namespacedName of "hello-world"
+		createCSIOnly := func(namespacedName types.NamespacedName) *secretsv1alpha1.EncryptedSecret {
+			createKeyNamespace(ctx, namespacedName.Namespace)
+			instance := &secretsv1alpha1.EncryptedSecret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      namespacedName.Name,
+					Namespace: namespacedName.Namespace,
+					Annotations: map[string]string{
+						"secrets.opensecrecy.org/provider": "k8s",
+						CSIOnlyAnnotation:                  "true",
+					},
+				},
+				Data: map[string]string{
+					"secret": "VdnNsF55TFX9kRiorzy0XPJQRK0FlICFntVqgEMeGOqq+IZfpHmr",
+				},
+			}
+			Expect(k8sClient.Create(ctx, instance)).To(Succeed())
+			return instance
+		}
+
+		It("Mount values without writing a secret", func() {
+			namespacedName := types.NamespacedName{Namespace: "csi-mount", Name: "test-encrypted-secret-csi"}
+			instance := createCSIOnly(namespacedName)
+
+			// the reconciler leaves csi-only EncryptedSecrets to the CSI provider
+			_, err := reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: namespacedName})
+			Expect(err).To(BeNil())
+			Expect(k8sClient.Get(ctx, namespacedName, instance)).To(Succeed())
+			Expect(instance.Status.Status).To(Equal(secretsv1alpha1.EncryptedSecretStatusReady))
+			err = k8sClient.Get(ctx, namespacedName, &corev1.Secret{})
+			Expect(apierrors.IsNotFound(err)).To(BeTrue())
+
+			provider := &CSIProvider{Client: k8sClient}
+			resp, err := provider.Mount(ctx, mountRequest(namespacedName.Namespace, `"- name: test-encrypted-secret-csi\n`+
+				`- name: test-encrypted-secret-csi\n  key: secret\n  path: app/token\n"`))
+			Expect(err).To(BeNil())
+			Expect(resp.Files).To(HaveLen(2))
+			Expect(resp.Files[0].Path).To(Equal("secret"))
+			Expect(resp.Files[1].Path).To(Equal("app/token"))
+			for _, file := range resp.Files {
+				Expect(file.Mode).To(Equal(int32(0o400)))
+				Expect(string(file.Contents)).To(Equal("hello-world"))
+			}
+			Expect(resp.ObjectVersions).To(HaveLen(1))
+			Expect(resp.ObjectVersions[0].ID).To(Equal("encryptedsecret/test-encrypted-secret-csi"))
+		})
+
+		It("Delete the secret of an EncryptedSecret that becomes csi-only", func() {
+			name := types.NamespacedName{Namespace: "csi-later", Name: "test-encrypted-secret-csi-later"}
+			createKeyNamespace(ctx, name.Namespace)
+			instance := &secretsv1alpha1.EncryptedSecret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        name.Name,
+					Namespace:   name.Namespace,
+					Annotations: map[string]string{"secrets.opensecrecy.org/provider": "k8s"},
+				},
+				Data: map[string]string{
+					"secret": "VdnNsF55TFX9kRiorzy0XPJQRK0FlICFntVqgEMeGOqq+IZfpHmr",
+				},
+			}
+			Expect(k8sClient.Create(ctx, instance)).To(Succeed())
+			_, err := reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: name})
+			Expect(err).To(BeNil())
+			Expect(k8sClient.Get(ctx, name, &corev1.Secret{})).To(Succeed())
+
+			// the values must not stay in etcd once only the CSI provider mounts them
+			Expect(k8sClient.Get(ctx, name, instance)).To(Succeed())
+			instance.Annotations[CSIOnlyAnnotation] = "true"
+			Expect(k8sClient.Update(ctx, instance)).To(Succeed())
+			_, err = reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: name})
+			Expect(err).To(BeNil())
+			err = k8sClient.Get(ctx, name, &corev1.Secret{})
+			Expect(apierrors.IsNotFound(err)).To(BeTrue())
+		})
+
+		It("Reject objects that can't be mounted", func() {
+			namespace := "csi-reject"
+			createCSIOnly(types.NamespacedName{Namespace: namespace, Name: "test-encrypted-secret-csi"})
+			provider := &CSIProvider{Client: k8sClient}
+
+			_, err := provider.Mount(ctx, mountRequest(namespace, `"- name: missing\n"`))
+			Expect(status.Code(err)).To(Equal(codes.NotFound))
+
+			_, err = provider.Mount(ctx, mountRequest(namespace, `"- name: test-encrypted-secret-csi\n  key: missing\n"`))
+			Expect(status.Code(err)).To(Equal(codes.NotFound))
+
+			_, err = provider.Mount(ctx, mountRequest(namespace, `"- name: test-encrypted-secret-csi\n  key: secret\n  path: ../escape\n"`))
+			Expect(status.Code(err)).To(Equal(codes.InvalidArgument))
+
+			_, err = provider.Mount(ctx, mountRequest(namespace, `"- name: test-encrypted-secret-csi\n`+
+				`- name: test-encrypted-secret-csi\n  key: secret\n"`))
+			Expect(err).To(MatchError(ContainSubstring("path secret is used")))
+		})
+	})
+})
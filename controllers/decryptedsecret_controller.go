@@ -0,0 +1,112 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	secretsv1alpha1 "github.com/opensecrecy/encrypted-secrets/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+// DecryptedSecretReconciler replaces DecryptedSecrets encrypted on admission with
+// EncryptedSecrets of the same name
+type DecryptedSecretReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+	log    logr.Logger
+}
+
+//+kubebuilder:rbac:groups=secrets.opensecrecy.org,resources=decryptedsecrets,verbs=get;list;watch;delete
+
+func (r *DecryptedSecretReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	r.log = log.FromContext(ctx).WithValues("DecryptedSecret", req.NamespacedName)
+	r.log.Info("Started decryptedsecret reconciliation")
+
+	instance := &secretsv1alpha1.DecryptedSecret{}
+
+	if err := r.Get(ctx, req.NamespacedName, instance); err != nil {
+		r.log.Info("Unable to fetch decryptedsecret object")
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	if err := storeEncryptedSecret(ctx, r.Client, instance, instance.ProviderRef, instance.Type, instance.Data); err != nil {
+		r.log.Error(err, "Failed to store encryptedsecret")
+		return ctrl.Result{}, err
+	}
+
+	r.log.Info("Replaced decryptedsecret with an encryptedsecret")
+	return ctrl.Result{}, client.IgnoreNotFound(r.Delete(ctx, instance))
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *DecryptedSecretReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&secretsv1alpha1.DecryptedSecret{}, builder.WithPredicates(encryptedOnAdmission())).
+		Complete(r)
+}
+
+// encryptedOnAdmission filters objects whose values were encrypted on admission.
+// The others hold plaintext and are left alone.
+func encryptedOnAdmission() predicate.Predicate {
+	return predicate.NewPredicateFuncs(func(obj client.Object) bool {
+		return obj.GetAnnotations()[EncryptedAnnotation] == "true"
+	})
+}
+
+// storeEncryptedSecret creates or updates the EncryptedSecret named after obj with
+// the encrypted values in data, which belong to a secret of type secretType
+func storeEncryptedSecret(ctx context.Context, c client.Client, obj metav1.Object, ref *secretsv1alpha1.ProviderReference,
+	secretType corev1.SecretType, data map[string]string) error {
+	encryptedSecret := &secretsv1alpha1.EncryptedSecret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      obj.GetName(),
+			Namespace: obj.GetNamespace(),
+		},
+	}
+
+	_, err := controllerutil.CreateOrUpdate(ctx, c, encryptedSecret, func() error {
+		// the secret written from the EncryptedSecret isn't encrypted again
+		encryptedSecret.Labels = map[string]string{}
+		for key, value := range obj.GetLabels() {
+			if key != EncryptLabel {
+				encryptedSecret.Labels[key] = value
+			}
+		}
+		encryptedSecret.Annotations = map[string]string{}
+		for key, value := range obj.GetAnnotations() {
+			if key != EncryptedAnnotation {
+				encryptedSecret.Annotations[key] = value
+			}
+		}
+		encryptedSecret.ProviderRef = ref
+		encryptedSecret.Type = secretType
+		encryptedSecret.Data = data
+		return nil
+	})
+	return err
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	secretsv1alpha1 "github.com/opensecrecy/encrypted-secrets/api/v1alpha1"
+	"github.com/opensecrecy/encrypted-secrets/pkg/providers"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+var _ = Describe("DecryptedSecrets", func() {
+
+	Context("Verify encryption on admission", func() {
+		ctx := context.Background()
+
+		It("Replace a DecryptedSecret with an EncryptedSecret", func() {
+			namespacedName := types.NamespacedName{Namespace: "encrypt-decrypted-secret", Name: "test-decrypted-secret"}
+			createKeyNamespace(ctx, namespacedName.Namespace)
+
+			instance := &secretsv1alpha1.DecryptedSecret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      namespacedName.Name,
+					Namespace: namespacedName.Namespace,
+					Annotations: map[string]string{
+						"secrets.opensecrecy.org/provider": "k8s",
+					},
+				},
+				Data: map[string]string{
+					"secret": "hello-world",
+				},
+			}
+
+			encrypter := &DecryptedSecretEncrypter{Client: k8sClient}
+			admissionCtx := admission.NewContextWithRequest(ctx, admission.Request{
+				AdmissionRequest: admissionv1.AdmissionRequest{
+					Operation: admissionv1.Create,
+					Namespace: namespacedName.Namespace,
+				},
+			})
+			Expect(encrypter.Default(admissionCtx, instance)).To(Succeed())
+			Expect(instance.Data["secret"]).NotTo(Equal("hello-world"))
+			Expect(instance.Annotations[EncryptedAnnotation]).To(Equal("true"))
+			Expect(k8sClient.Create(ctx, instance)).To(Succeed())
+
+			decryptedReconciler := &DecryptedSecretReconciler{Client: k8sClient, Scheme: scheme.Scheme}
+			_, err := decryptedReconciler.Reconcile(ctx, ctrl.Request{NamespacedName: namespacedName})
+			Expect(err).To(BeNil())
+
+			Expect(k8sClient.Get(ctx, namespacedName, &secretsv1alpha1.DecryptedSecret{})).NotTo(Succeed())
+
+			encryptedSecret := &secretsv1alpha1.EncryptedSecret{}
+			Expect(k8sClient.Get(ctx, namespacedName, encryptedSecret)).To(Succeed())
+			Expect(encryptedSecret.Annotations).NotTo(HaveKey(EncryptedAnnotation))
+			decrypted, err := providers.DecodeAndDecrypt(encryptedSecret)
+			Expect(err).To(BeNil())
+			Expect(decrypted.Data["secret"]).To(Equal("hello-world"))
+		})
+
+		It("Only trust the encrypted annotation of labeled secrets", func() {
+			namespacedName := types.NamespacedName{Namespace: "encrypt-secret", Name: "test-labeled-secret"}
+			createKeyNamespace(ctx, namespacedName.Namespace)
+			encrypter := &secretEncrypter{&DecryptedSecretEncrypter{Client: k8sClient}}
+			admissionCtx := admission.NewContextWithRequest(ctx, admission.Request{
+				AdmissionRequest: admissionv1.AdmissionRequest{
+					Operation: admissionv1.Create,
+					Namespace: namespacedName.Namespace,
+				},
+			})
+
+			// a client can't mark plaintext values as encrypted
+			secret := &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "test-unlabeled-secret",
+					Namespace:   namespacedName.Namespace,
+					Annotations: map[string]string{EncryptedAnnotation: "true"},
+				},
+				StringData: map[string]string{"secret": "hello-world"},
+			}
+			Expect(encrypter.Default(admissionCtx, secret)).To(Succeed())
+			Expect(secret.Annotations).NotTo(HaveKey(EncryptedAnnotation))
+			Expect(secret.StringData["secret"]).To(Equal("hello-world"))
+
+			secret = &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      namespacedName.Name,
+					Namespace: namespacedName.Namespace,
+					Labels:    map[string]string{EncryptLabel: "true", "app": "db"},
+					Annotations: map[string]string{
+						"secrets.opensecrecy.org/provider": "k8s",
+					},
+				},
+				StringData: map[string]string{"secret": "hello-world"},
+			}
+			Expect(encrypter.Default(admissionCtx, secret)).To(Succeed())
+			Expect(secret.Annotations[EncryptedAnnotation]).To(Equal("true"))
+			Expect(string(secret.Data["secret"])).NotTo(Equal("hello-world"))
+			Expect(k8sClient.Create(ctx, secret)).To(Succeed())
+
+			secretReconciler := &SecretEncryptionReconciler{Client: k8sClient, Scheme: scheme.Scheme}
+			_, err := secretReconciler.Reconcile(ctx, ctrl.Request{NamespacedName: namespacedName})
+			Expect(err).To(BeNil())
+
+			// the secret written from the EncryptedSecret isn't marked again
+			encryptedSecret := &secretsv1alpha1.EncryptedSecret{}
+			Expect(k8sClient.Get(ctx, namespacedName, encryptedSecret)).To(Succeed())
+			Expect(encryptedSecret.Labels).To(Equal(map[string]string{"app": "db"}))
+			Expect(encryptedSecret.Annotations).NotTo(HaveKey(EncryptedAnnotation))
+		})
+	})
+})
@@ -0,0 +1,203 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/opensecrecy/encrypted-secrets/pkg/providers"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	secretsv1alpha1 "github.com/opensecrecy/encrypted-secrets/api/v1alpha1"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+const (
+	// EncryptLabel marks secrets whose values are encrypted on admission and moved
+	// into an EncryptedSecret of the same name. The webhook for secrets only
+	// selects secrets with the label.
+	EncryptLabel = "secrets.opensecrecy.org/encrypt"
+	// EncryptedAnnotation is set on admission once the values of a DecryptedSecret
+	// or a marked secret are encrypted. The webhooks overwrite it, clients can't
+	// set it.
+	EncryptedAnnotation = "secrets.opensecrecy.org/encrypted"
+)
+
+// DecryptedSecretEncrypter encrypts the values of DecryptedSecrets and of secrets
+// with the encrypt annotation before they are stored, so that their plaintext
+// never reaches etcd. The DecryptedSecretReconciler and SecretEncryptionReconciler
+// replace them with EncryptedSecrets afterwards.
+type DecryptedSecretEncrypter struct {
+	Client client.Client
+
+	// Policy restricts the providers and keys of every namespace, the policy
+	// annotations of a namespace can only narrow it
+	Policy providers.Policy
+	// OperatorAWSCredentials lets the aws-kms providers of EncryptionProviders
+	// without the SecretRef auth method use the AWS credentials of the operator
+	OperatorAWSCredentials bool
+}
+
+//+kubebuilder:webhook:path=/mutate-secrets-opensecrecy-org-v1alpha1-decryptedsecret,mutating=true,failurePolicy=fail,sideEffects=None,groups=secrets.opensecrecy.org,resources=decryptedsecrets,verbs=create;update,versions=v1alpha1,name=mdecryptedsecret.opensecrecy.org,admissionReviewVersions=v1
+//+kubebuilder:webhook:path=/mutate--v1-secret,mutating=true,failurePolicy=fail,sideEffects=None,groups="",resources=secrets,verbs=create;update,versions=v1,name=msecret.opensecrecy.org,admissionReviewVersions=v1
+
+// SetupWebhookWithManager registers the webhooks with the webhook server of the Manager.
+func (e *DecryptedSecretEncrypter) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	if err := ctrl.NewWebhookManagedBy(mgr).
+		For(&secretsv1alpha1.DecryptedSecret{}).
+		WithDefaulter(e).
+		Complete(); err != nil {
+		return err
+	}
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(&corev1.Secret{}).
+		WithDefaulter(&secretEncrypter{e}).
+		Complete()
+}
+
+// Default implements admission.CustomDefaulter
+func (e *DecryptedSecretEncrypter) Default(ctx context.Context, obj runtime.Object) error {
+	instance, ok := obj.(*secretsv1alpha1.DecryptedSecret)
+	if !ok {
+		return fmt.Errorf("expected a DecryptedSecret but got a %T", obj)
+	}
+
+	old := &secretsv1alpha1.DecryptedSecret{}
+	if err := oldObject(ctx, old); err != nil {
+		return err
+	}
+
+	data, err := e.encrypt(ctx, instance, instance.ProviderRef, instance.Data, encryptedValues(old, old.Data))
+	if err != nil {
+		return err
+	}
+	instance.Data = data
+	metav1.SetMetaDataAnnotation(&instance.ObjectMeta, EncryptedAnnotation, "true")
+	return nil
+}
+
+// secretEncrypter is the DecryptedSecretEncrypter of secrets
+type secretEncrypter struct {
+	*DecryptedSecretEncrypter
+}
+
+// Default implements admission.CustomDefaulter
+func (e *secretEncrypter) Default(ctx context.Context, obj runtime.Object) error {
+	secret, ok := obj.(*corev1.Secret)
+	if !ok {
+		return fmt.Errorf("expected a Secret but got a %T", obj)
+	}
+	if secret.Labels[EncryptLabel] != "true" {
+		// only the webhook marks the values of a secret as encrypted
+		delete(secret.Annotations, EncryptedAnnotation)
+		return nil
+	}
+
+	old := &corev1.Secret{}
+	if err := oldObject(ctx, old); err != nil {
+		return err
+	}
+
+	data, err := e.encrypt(ctx, secret, nil, secretValues(secret), encryptedValues(old, secretValues(old)))
+	if err != nil {
+		return err
+	}
+	secret.Data = make(map[string][]byte, len(data))
+	for key, value := range data {
+		secret.Data[key] = []byte(value)
+	}
+	secret.StringData = nil
+	metav1.SetMetaDataAnnotation(&secret.ObjectMeta, EncryptedAnnotation, "true")
+	return nil
+}
+
+// encrypt encrypts the values of data with the provider of obj. Values that are
+// the same as in encrypted were encrypted before and are kept.
+func (e *DecryptedSecretEncrypter) encrypt(ctx context.Context, obj metav1.Object, ref *secretsv1alpha1.ProviderReference,
+	data map[string]string, encrypted map[string]string) (map[string]string, error) {
+
+	namespace := obj.GetNamespace()
+	if namespace == "" {
+		req, err := admission.RequestFromContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+		namespace = req.Namespace
+	}
+
+	policies, err := namespacePolicies(ctx, e.Client, namespace, e.Policy)
+	if err != nil {
+		return nil, err
+	}
+	provider, err := newProviderFor(ctx, e.Client, obj, ref, namespace, e.OperatorAWSCredentials, policies...)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]string, len(data))
+	for key, value := range data {
+		if previous, ok := encrypted[key]; ok && previous == value {
+			result[key] = value
+			continue
+		}
+		result[key], err = provider.Encrypt(ctx, value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt %s %v", key, err)
+		}
+	}
+	return result, nil
+}
+
+// oldObject decodes the object an update replaces into old. It leaves old empty
+// for other operations.
+func oldObject(ctx context.Context, old runtime.Object) error {
+	req, err := admission.RequestFromContext(ctx)
+	if err != nil {
+		return err
+	}
+	if req.Operation != admissionv1.Update || len(req.OldObject.Raw) == 0 {
+		return nil
+	}
+	return json.Unmarshal(req.OldObject.Raw, old)
+}
+
+// encryptedValues returns data when obj was encrypted on admission before
+func encryptedValues(obj metav1.Object, data map[string]string) map[string]string {
+	if obj.GetAnnotations()[EncryptedAnnotation] != "true" {
+		return nil
+	}
+	return data
+}
+
+// secretValues returns the values of secret as strings, including those in stringData
+func secretValues(secret *corev1.Secret) map[string]string {
+	values := make(map[string]string, len(secret.Data)+len(secret.StringData))
+	for key, value := range secret.Data {
+		values[key] = string(value)
+	}
+	for key, value := range secret.StringData {
+		values[key] = value
+	}
+	return values
+}
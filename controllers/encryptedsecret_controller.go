@@ -19,17 +19,27 @@ package controllers
 import (
 	"context"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/go-logr/logr"
+	"github.com/opensecrecy/encrypted-secrets/pkg/audit"
 	"github.com/opensecrecy/encrypted-secrets/pkg/providers"
+	"go.opentelemetry.io/otel/trace"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
 	secretsv1alpha1 "github.com/opensecrecy/encrypted-secrets/api/v1alpha1"
 	corev1 "k8s.io/api/core/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	ctrl "sigs.k8s.io/controller-runtime"
 )
 
@@ -38,92 +48,279 @@ type EncryptedSecretReconciler struct {
 	client.Client
 	Scheme *runtime.Scheme
 	log    logr.Logger
+
+	// RotateKeys makes the reconciler re-encrypt values that aren't encrypted
+	// with the primary key of their provider and write them back
+	RotateKeys bool
+	// Policy restricts the providers and keys of every namespace, the policy
+	// annotations of a namespace can only narrow it
+	Policy providers.Policy
+	// DriftPolicy applies to EncryptedSecrets without a drift policy
+	DriftPolicy string
+	// RefreshInterval applies to EncryptedSecrets without a refresh interval
+	RefreshInterval time.Duration
+	// Audit records every decryption, nothing is recorded when it's nil
+	Audit audit.Sink
+	// SOPSOperatorKeys lets the sops provider decrypt with the age identities, AWS
+	// credentials and gpg keyring of the operator, besides the keys of the
+	// namespace or provider
+	SOPSOperatorKeys bool
+	// OperatorAWSCredentials lets the aws-kms providers of EncryptionProviders
+	// without the SecretRef auth method use the AWS credentials of the operator
+	OperatorAWSCredentials bool
+	// Recorder emits events on the EncryptedSecrets. SetupWithManager creates one when
+	// it isn't set.
+	Recorder record.EventRecorder
 }
 
 //+kubebuilder:rbac:groups=secrets.opensecrecy.org,resources=encryptedsecrets,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=secrets.opensecrecy.org,resources=encryptedsecrets/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=secrets.opensecrecy.org,resources=encryptedsecrets/finalizers,verbs=update
 //+kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=secrets.opensecrecy.org,resources=encryptionproviders,verbs=get;list;watch
+//+kubebuilder:rbac:groups=secrets.opensecrecy.org,resources=clusterencryptionproviders,verbs=get;list;watch
+//+kubebuilder:rbac:groups=core,resources=namespaces,verbs=get;list;watch
+//+kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
 
 func (r *EncryptedSecretReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	r.log = log.FromContext(ctx).WithValues("EncryptedSecret", req.NamespacedName)
 	r.log.Info("Started encryptedsecret reconciliation")
 
+	ctx, span := tracer.Start(ctx, "EncryptedSecret.Reconcile", trace.WithAttributes(
+		attributeNamespace.String(req.Namespace),
+		attributeName.String(req.Name),
+	))
+	defer span.End()
+
 	instance := &secretsv1alpha1.EncryptedSecret{}
 
 	if err := r.Get(ctx, req.NamespacedName, instance); err != nil {
 		r.log.Info("Unable to fetch encryptedsecret object")
+		if apierrors.IsNotFound(err) {
+			encryptedSecretMetrics.forget(req.NamespacedName)
+		}
 		return ctrl.Result{}, client.IgnoreNotFound(err)
 
 	}
 
-	decryptedObj, err := providers.DecodeAndDecrypt(instance)
-	if err != nil {
-		r.log.Error(err, "Failed to decrypt")
-		instance.Status.Status = secretsv1alpha1.EncryptedSecretStatusError
-		instance.Status.Message = fmt.Sprintf("failed to decrypt value for %s", err.Error())
+	// the values are only decrypted when the CSI driver mounts them
+	if instance.Annotations[CSIOnlyAnnotation] == "true" {
+		r.log.Info("Encryptedsecret is only mounted by the CSI provider, skipping the secret")
+		// a secret written before the annotation was set would keep the values in etcd
+		deleted, err := deleteOwnedSecret(ctx, r.Client, instance, instance.Namespace)
+		if err != nil {
+			r.log.Error(err, "Failed to delete the secret of a csi-only encryptedsecret")
+			return ctrl.Result{}, err
+		}
+		if deleted {
+			r.log.Info("Deleted the secret of a csi-only encryptedsecret")
+		}
+		instance.Status.Status = secretsv1alpha1.EncryptedSecretStatusReady
+		instance.Status.Message = fmt.Sprintf("encrypted secrets %s is only mounted by the CSI provider", instance.Name)
+		instance.Status.Failures = 0
 		return r.ensureStatus(ctx, instance, ctrl.Result{})
 	}
 
-	// create a secret to hold the decrypted secrets
-	secretInstance := corev1.Secret{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      instance.Name,
-			Namespace: instance.Namespace,
-		},
+	policies, err := namespacePolicies(ctx, r.Client, instance.Namespace, r.Policy)
+	if err != nil {
+		r.log.Error(err, "Failed to get policy")
+		instance.Status.Status = secretsv1alpha1.EncryptedSecretStatusError
+		instance.Status.Message = fmt.Sprintf("failed to get policy %s", err.Error())
+		return r.retry(ctx, instance)
 	}
 
-	// map to hold decryptedData in map[string][]byte format
-	// ToDo: figure out optimal way to do this. There is absolutely no need to increase space complexity here
-	decryptedData := make(map[string][]byte)
-	for key, value := range decryptedObj.Data {
-		decryptedData[key] = []byte(value)
+	var provider providers.Provider
+	cfg, policies, err := resolveProvider(ctx, r.Client, instance, instance.ProviderRef, instance.Namespace, policies...)
+	cfg.SOPSOperatorKeys = r.SOPSOperatorKeys
+	cfg.OperatorAWSCredentials = r.OperatorAWSCredentials
+	if err == nil {
+		span.SetAttributes(attributeProvider.String(cfg.Provider))
+		provider, err = buildProvider(ctx, cfg, policies)
+	}
+	if err != nil {
+		r.log.Error(err, "Failed to get provider")
+		recordDecryptFailure(r.recorder(), instance, err)
+		instance.Status.Status = errorStatus(err)
+		instance.Status.Message = fmt.Sprintf("failed to decrypt value for %s", err.Error())
+		return r.retry(ctx, instance)
 	}
 
-	_, err = controllerutil.CreateOrUpdate(ctx, r.Client, &secretInstance, func() error {
-		// set Labels and Annotations
-		secretInstance.Labels = instance.Labels
-		secretInstance.Annotations = instance.Annotations
+	// nothing the secret is derived from changed since it was written last, so
+	// there is no need to decrypt again
+	driftPolicy := resolveDriftPolicy(instance.DriftPolicy, r.DriftPolicy)
+	currentFingerprint := ""
+	if primaryKeyVersion, err := provider.PrimaryKeyVersion(ctx); err == nil {
+		currentFingerprint = fingerprint(instance, cfg, policies, primaryKeyVersion, driftPolicy)
+	}
+	if currentFingerprint != "" && currentFingerprint == instance.Status.Fingerprint &&
+		instance.Status.Status == secretsv1alpha1.EncryptedSecretStatusReady {
+		upToDate, err := secretUpToDate(ctx, r.Client, req.NamespacedName)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if upToDate {
+			r.log.Info("Encryptedsecret is unchanged, skipping decryption")
+			encryptedSecretMetrics.cacheResult(true)
+			span.SetAttributes(attributeOutcome.String("Unchanged"))
+			encryptedSecretMetrics.observe(req.NamespacedName, instance.Status.Status)
+			encryptedSecretMetrics.synced(req.NamespacedName)
+			return refreshResult(instance.RefreshInterval, r.RefreshInterval), nil
+		}
+	}
 
-		// Add the data
-		secretInstance.Data = decryptedData
+	encryptedSecretMetrics.cacheResult(false)
+	auditEvent := audit.Event{
+		Provider: cfg.Provider,
+		Keys:     sortedDataKeys(instance.Data),
+		Trigger: decryptionTrigger(instance.Status.Status, instance.Status.Failures,
+			instance.Status.Fingerprint, currentFingerprint),
+	}
 
-		// set ownerReference
-		err := controllerutil.SetOwnerReference(instance, &secretInstance, r.Scheme)
+	if r.RotateKeys {
+		rotated, changed, err := providers.ReencryptWithProvider(ctx, provider, instance)
+		if err != nil || changed {
+			rotateEvent := auditEvent
+			rotateEvent.Action = audit.ActionReencrypt
+			recordAudit(ctx, r.Audit, instance, "EncryptedSecret", rotateEvent, err)
+		}
 		if err != nil {
-			instance.Status.Status = secretsv1alpha1.EncryptedSecretStatusError
-			instance.Status.Message = fmt.Sprintf("error setting owner reference %s", err.Error())
-			return r.Status().Update(ctx, instance)
+			r.log.Error(err, "Failed to rotate keys")
+			recordDecryptFailure(r.recorder(), instance, err)
+			instance.Status.Status = errorStatus(err)
+			instance.Status.Message = fmt.Sprintf("failed to rotate keys %s", err.Error())
+			return r.retry(ctx, instance)
 		}
-		return nil
-	})
+		if changed {
+			// the update triggers another reconciliation which decrypts with the new key
+			r.log.Info("Re-encrypting encryptedsecret with the primary key")
+			instance.Data = rotated.Data
+			return ctrl.Result{}, r.Update(ctx, instance)
+		}
+	}
+
+	decryptedObj, keyVersions, err := providers.DecryptWithProvider(ctx, provider, instance)
+	if err != nil {
+		recordAudit(ctx, r.Audit, instance, "EncryptedSecret", auditEvent, err)
+		r.log.Error(err, "Failed to decrypt")
+		recordDecryptFailure(r.recorder(), instance, err)
+		instance.Status.Status = errorStatus(err)
+		instance.Status.Message = fmt.Sprintf("failed to decrypt value for %s", err.Error())
+		return r.retry(ctx, instance)
+	}
+
+	wasReady := instance.Status.Status == secretsv1alpha1.EncryptedSecretStatusReady
+	write, err := writeSecret(ctx, r.Client, r.Scheme, instance, instance.Namespace, instance.Labels, decryptedObj, driftPolicy)
+	auditEvent.KeyIDs = keyVersions
+	if err == nil {
+		auditEvent.Secrets = []string{instance.Namespace + "/" + instance.Name}
+	}
+	recordAudit(ctx, r.Audit, instance, "EncryptedSecret", auditEvent, err)
 	if err != nil {
+		recordSecretConflict(r.recorder(), instance, err)
 		instance.Status.Status = secretsv1alpha1.EncryptedSecretStatusError
 		instance.Status.Message = fmt.Sprintf("error getting secret %s", err.Error())
-		return r.ensureStatus(ctx, instance, ctrl.Result{})
+		return r.retry(ctx, instance)
+	}
+
+	instance.Status.KeyVersion = strings.Join(keyVersions, ",")
+	instance.Status.Fingerprint = currentFingerprint
+	if recordDrift(r.recorder(), instance, instance.Namespace, write) {
+		instance.Status.Status = secretsv1alpha1.EncryptedSecretStatusDrifted
+		instance.Status.Message = fmt.Sprintf("secret %s was changed by hand, keeping the changes", instance.Name)
+		return r.refresh(ctx, instance)
+	}
+	switch {
+	case write.Result == controllerutil.OperationResultCreated && wasReady:
+		r.recorder().Eventf(instance, corev1.EventTypeNormal, ReasonDriftCorrected, "recreated secret %s after it was deleted", instance.Name)
+	case write.Result != controllerutil.OperationResultNone && !write.Drifted:
+		r.recorder().Eventf(instance, corev1.EventTypeNormal, ReasonDecrypted, "decrypted %d values into secret %s", len(decryptedObj.Data), instance.Name)
 	}
 
 	instance.Status.Status = secretsv1alpha1.EncryptedSecretStatusReady
 	instance.Status.Message = fmt.Sprintf("encrypted secrets %s is ready to be used", instance.Name)
-	return r.ensureStatus(ctx, instance, ctrl.Result{})
+	if write.Drifted {
+		instance.Status.Message = fmt.Sprintf("encrypted secrets %s is ready to be used, restored changes made by hand", instance.Name)
+	}
+	return r.refresh(ctx, instance)
+}
+
+// recorder returns the recorder of the events on the EncryptedSecrets. Reconcilers
+// built without one, like those of the tests, drop the events.
+func (r *EncryptedSecretReconciler) recorder() record.EventRecorder {
+	return eventRecorder(r.Recorder)
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *EncryptedSecretReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	if r.Recorder == nil {
+		r.Recorder = mgr.GetEventRecorderFor("encryptedsecret-controller")
+	}
 	return ctrl.NewControllerManagedBy(mgr).
-		For(&secretsv1alpha1.EncryptedSecret{}).
+		// status updates don't need another reconciliation
+		For(&secretsv1alpha1.EncryptedSecret{}, builder.WithPredicates(predicate.Or(
+			predicate.GenerationChangedPredicate{},
+			predicate.AnnotationChangedPredicate{},
+			predicate.LabelChangedPredicate{},
+		))).
 		Owns(&corev1.Secret{}).
+		Watches(&secretsv1alpha1.EncryptionProvider{}, handler.EnqueueRequestsFromMapFunc(r.requestsForProvider),
+			builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Watches(&secretsv1alpha1.ClusterEncryptionProvider{}, handler.EnqueueRequestsFromMapFunc(r.requestsForProvider),
+			builder.WithPredicates(predicate.GenerationChangedPredicate{})).
 		Complete(r)
 }
 
+// requestsForProvider reconciles the EncryptedSecrets referencing a provider when it changes
+func (r *EncryptedSecretReconciler) requestsForProvider(ctx context.Context, obj client.Object) []reconcile.Request {
+	kind := secretsv1alpha1.EncryptionProviderKind
+	if obj.GetNamespace() == "" {
+		kind = secretsv1alpha1.ClusterEncryptionProviderKind
+	}
+
+	list := &secretsv1alpha1.EncryptedSecretList{}
+	if err := r.List(ctx, list, client.InNamespace(obj.GetNamespace())); err != nil {
+		return nil
+	}
+
+	var requests []reconcile.Request
+	for _, item := range list.Items {
+		ref := item.ProviderRef
+		if ref == nil || ref.Name != obj.GetName() || (ref.Kind != kind && !(ref.Kind == "" && kind == secretsv1alpha1.EncryptionProviderKind)) {
+			continue
+		}
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: item.Namespace, Name: item.Name}})
+	}
+	return requests
+}
+
 // ensureStatus makes sure that proper status is applied to the EncryptedSecret instance
 func (r *EncryptedSecretReconciler) ensureStatus(ctx context.Context, instance *secretsv1alpha1.EncryptedSecret, result ctrl.Result) (ctrl.Result, error) {
 
+	trace.SpanFromContext(ctx).SetAttributes(
+		attributeOutcome.String(instance.Status.Status),
+		attributeKeyCount.Int(len(instance.Data)),
+	)
+
 	err := r.Status().Update(ctx, instance)
 	if err != nil {
 		r.log.Error(err, "Failed to update status")
 		return ctrl.Result{Requeue: true}, nil
 	}
 
+	encryptedSecretMetrics.observe(client.ObjectKeyFromObject(instance), instance.Status.Status)
 	return result, nil
 }
+
+// retry records another failed reconciliation and retries it after a backoff
+func (r *EncryptedSecretReconciler) retry(ctx context.Context, instance *secretsv1alpha1.EncryptedSecret) (ctrl.Result, error) {
+	instance.Status.Failures++
+	return r.ensureStatus(ctx, instance, retryResult(instance.Status.Failures, instance.RefreshInterval, r.RefreshInterval))
+}
+
+// refresh resets the failures of a successful reconciliation and refreshes the
+// secret after the refresh interval
+func (r *EncryptedSecretReconciler) refresh(ctx context.Context, instance *secretsv1alpha1.EncryptedSecret) (ctrl.Result, error) {
+	instance.Status.Failures = 0
+	encryptedSecretMetrics.synced(client.ObjectKeyFromObject(instance))
+	return r.ensureStatus(ctx, instance, refreshResult(instance.RefreshInterval, r.RefreshInterval))
+}
@@ -21,10 +21,13 @@ import (
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 
 	secretsv1alpha1 "github.com/opensecrecy/encrypted-secrets/api/v1alpha1"
+	"github.com/opensecrecy/encrypted-secrets/pkg/providers"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	ctrl "sigs.k8s.io/controller-runtime"
@@ -72,6 +75,16 @@ var _ = Describe("EncryptedSecrets", func() {
 			_ = k8sClient.Get(ctx, namespacedName, instance)
 			Expect(instance.Status.Status).To(Equal(secretsv1alpha1.EncryptedSecretStatusError))
 			Expect(instance.Status.Message).To(ContainSubstring("failed to decrypt"))
+			Expect(instance.Status.Failures).To(Equal(int32(1)))
+			Expect(recordedEvents()).To(ContainElement(ContainSubstring(ReasonKeyMissing)))
+			Expect(res.RequeueAfter).To(BeNumerically(">", 0))
+
+			// every further failure doubles the backoff
+			retry, err := reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: namespacedName})
+			Expect(err).To(BeNil())
+			Expect(retry.RequeueAfter).To(BeNumerically(">", res.RequeueAfter))
+			_ = k8sClient.Get(ctx, namespacedName, instance)
+			Expect(instance.Status.Failures).To(Equal(int32(2)))
 
 			// check for failure since the secret is not created
 			secret := &corev1.Secret{}
@@ -125,7 +138,328 @@ var _ = Describe("EncryptedSecrets", func() {
 			Expect(err).To(BeNil())
 			Expect(secret.Data["secret"]).To(Equal([]byte("hello-world")))
 
+			// the events report the decryption without the plaintext
+			events := recordedEvents()
+			Expect(events).To(ContainElement(ContainSubstring(ReasonDecrypted)))
+			Expect(events).NotTo(ContainElement(ContainSubstring("hello-world")))
+
+			// the metrics count the decryption and the resource
+			Expect(testutil.ToFloat64(providerOperations.WithLabelValues(providers.K8sProvider, operationDecrypt, outcomeSuccess))).
+				To(BeNumerically(">", 0))
+			Expect(testutil.ToFloat64(resourcesByStatus.WithLabelValues("EncryptedSecret", secretsv1alpha1.EncryptedSecretStatusReady))).
+				To(BeNumerically(">", 0))
+			Expect(testutil.ToFloat64(lastSuccessfulSync.WithLabelValues("EncryptedSecret", namespacedName.Namespace, namespacedName.Name))).
+				To(BeNumerically(">", 0))
+		})
+		It("Re-encrypt values with the primary key when rotating keys", func() {
+			namespacedName := types.NamespacedName{Namespace: "rotation", Name: "test-encrypted-secret-rotation"}
+			Expect(k8sClient.Create(ctx, &corev1.Namespace{
+				ObjectMeta: metav1.ObjectMeta{Name: namespacedName.Namespace},
+			})).To(Succeed())
+
+			// version 2 is the primary key, version 1 has been retired
+			decryptionKey := &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "cryptctl-key",
+					Namespace: namespacedName.Namespace,
+					Annotations: map[string]string{
+						"secrets.opensecrecy.org/key-version": "2",
+					},
+				},
+				Data: map[string][]byte{
+					"tls.crt":   []byte("anotherRandomEncryptionKey"),
+					"tls.crt.1": []byte("justRandomEncryptionKey"),
+				},
+			}
+			Expect(k8sClient.Create(ctx, decryptionKey)).To(Succeed())
+
+			oldValue := "VdnNsF55TFX9kRiorzy0XPJQRK0FlICFntVqgEMeGOqq+IZfpHmr"
+			instance := &secretsv1alpha1.EncryptedSecret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      namespacedName.Name,
+					Namespace: namespacedName.Namespace,
+					Annotations: map[string]string{
+						"secrets.opensecrecy.org/provider": "k8s",
+					},
+				},
+				Data: map[string]string{
+					"secret": oldValue,
+				},
+			}
+			Expect(k8sClient.Create(ctx, instance)).Should(Succeed())
+
+			rotatingReconciler := &EncryptedSecretReconciler{
+				Client:     k8sClient,
+				Scheme:     reconciler.Scheme,
+				RotateKeys: true,
+			}
+
+			// the first reconciliation writes the re-encrypted values back
+			_, err := rotatingReconciler.Reconcile(ctx, ctrl.Request{NamespacedName: namespacedName})
+			Expect(err).To(BeNil())
+			Expect(k8sClient.Get(ctx, namespacedName, instance)).To(Succeed())
+			Expect(instance.Data["secret"]).NotTo(Equal(oldValue))
+
+			// the next one decrypts them with the new key
+			_, err = rotatingReconciler.Reconcile(ctx, ctrl.Request{NamespacedName: namespacedName})
+			Expect(err).To(BeNil())
+			Expect(k8sClient.Get(ctx, namespacedName, instance)).To(Succeed())
+			Expect(instance.Status.Status).To(Equal(secretsv1alpha1.EncryptedSecretStatusReady))
+			Expect(instance.Status.KeyVersion).To(Equal("2"))
+
+			secret := &corev1.Secret{}
+			Expect(k8sClient.Get(ctx, namespacedName, secret)).To(Succeed())
+			Expect(secret.Data["secret"]).To(Equal([]byte("hello-world")))
+		})
+		It("Decrypt values with the key named in their header", func() {
+			namespacedName := types.NamespacedName{Namespace: "keyring", Name: "test-encrypted-secret-keyring"}
+			Expect(k8sClient.Create(ctx, &corev1.Namespace{
+				ObjectMeta: metav1.ObjectMeta{Name: namespacedName.Namespace},
+			})).To(Succeed())
+
+			keyring := &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "cryptctl-keyring",
+					Namespace: namespacedName.Namespace,
+					Annotations: map[string]string{
+						"secrets.opensecrecy.org/primary-key": "team-a-2023",
+					},
+				},
+				Data: map[string][]byte{
+					"team-a-2022": []byte("justRandomEncryptionKey"),
+					"team-a-2023": []byte("anotherRandomEncryptionKey"),
+				},
+			}
+			Expect(k8sClient.Create(ctx, keyring)).To(Succeed())
+
+			encrypted, err := providers.EncryptAndEncode(secretsv1alpha1.DecryptedSecret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      namespacedName.Name,
+					Namespace: namespacedName.Namespace,
+					Annotations: map[string]string{
+						"secrets.opensecrecy.org/provider": "k8s",
+					},
+				},
+				Data: map[string]string{
+					"secret": "hello-world",
+				},
+			})
+			Expect(err).To(BeNil())
+			keyID, ok := providers.KeyID(encrypted.Data["secret"])
+			Expect(ok).To(BeTrue())
+			Expect(keyID).To(Equal("team-a-2023"))
+
+			// values without a header are still decrypted with whichever key fits
+			encrypted.Data["legacy"] = "VdnNsF55TFX9kRiorzy0XPJQRK0FlICFntVqgEMeGOqq+IZfpHmr"
+			Expect(k8sClient.Create(ctx, encrypted)).Should(Succeed())
+
+			_, err = reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: namespacedName})
+			Expect(err).To(BeNil())
+
+			instance := &secretsv1alpha1.EncryptedSecret{}
+			Expect(k8sClient.Get(ctx, namespacedName, instance)).To(Succeed())
+			Expect(instance.Status.Status).To(Equal(secretsv1alpha1.EncryptedSecretStatusReady))
+			Expect(instance.Status.KeyVersion).To(Equal("team-a-2022,team-a-2023"))
+
+			secret := &corev1.Secret{}
+			Expect(k8sClient.Get(ctx, namespacedName, secret)).To(Succeed())
+			Expect(secret.Data["secret"]).To(Equal([]byte("hello-world")))
+			Expect(secret.Data["legacy"]).To(Equal([]byte("hello-world")))
+		})
+
+		It("Refuse to decrypt with a provider the namespace policy doesn't allow", func() {
+			namespacedName := types.NamespacedName{Namespace: "policy", Name: "test-encrypted-secret-policy"}
+			Expect(k8sClient.Create(ctx, &corev1.Namespace{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: namespacedName.Namespace,
+					Annotations: map[string]string{
+						"secrets.opensecrecy.org/allowed-providers": "aws-kms",
+					},
+				},
+			})).To(Succeed())
+
+			encryptedSecret := &secretsv1alpha1.EncryptedSecret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      namespacedName.Name,
+					Namespace: namespacedName.Namespace,
+					Annotations: map[string]string{
+						"secrets.opensecrecy.org/provider": "k8s",
+					},
+				},
+				Data: map[string]string{
+					"secret": "VdnNsF55TFX9kRiorzy0XPJQRK0FlICFntVqgEMeGOqq+IZfpHmr",
+				},
+			}
+			Expect(k8sClient.Create(ctx, encryptedSecret)).Should(Succeed())
+
+			_, err := reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: namespacedName})
+			Expect(err).To(BeNil())
+
+			instance := &secretsv1alpha1.EncryptedSecret{}
+			Expect(k8sClient.Get(ctx, namespacedName, instance)).To(Succeed())
+			Expect(instance.Status.Status).To(Equal(secretsv1alpha1.EncryptedSecretStatusForbidden))
+			Expect(k8sClient.Get(ctx, namespacedName, &corev1.Secret{})).NotTo(Succeed())
+		})
+
+		It("Keep the operator policy for namespaces that only restrict the keys", func() {
+			namespacedName := types.NamespacedName{Namespace: "policy-key-ids", Name: "test-encrypted-secret-policy-key-ids"}
+			Expect(k8sClient.Create(ctx, &corev1.Namespace{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: namespacedName.Namespace,
+					Annotations: map[string]string{
+						"secrets.opensecrecy.org/allowed-key-ids": "*",
+					},
+				},
+			})).To(Succeed())
+
+			encryptedSecret := &secretsv1alpha1.EncryptedSecret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      namespacedName.Name,
+					Namespace: namespacedName.Namespace,
+					Annotations: map[string]string{
+						"secrets.opensecrecy.org/provider": "aws-kms",
+					},
+				},
+				Data: map[string]string{
+					"secret": "VdnNsF55TFX9kRiorzy0XPJQRK0FlICFntVqgEMeGOqq+IZfpHmr",
+				},
+			}
+			Expect(k8sClient.Create(ctx, encryptedSecret)).Should(Succeed())
+
+			// the namespace allows every key, but not a provider the operator refuses
+			restrictedReconciler := &EncryptedSecretReconciler{
+				Client: k8sClient,
+				Scheme: reconciler.Scheme,
+				Policy: providers.Policy{Providers: []string{"k8s"}},
+			}
+			_, err := restrictedReconciler.Reconcile(ctx, ctrl.Request{NamespacedName: namespacedName})
+			Expect(err).To(BeNil())
+
+			instance := &secretsv1alpha1.EncryptedSecret{}
+			Expect(k8sClient.Get(ctx, namespacedName, instance)).To(Succeed())
+			Expect(instance.Status.Status).To(Equal(secretsv1alpha1.EncryptedSecretStatusForbidden))
+			Expect(instance.Status.Message).To(ContainSubstring("provider aws-kms is not allowed by policy"))
+			Expect(k8sClient.Get(ctx, namespacedName, &corev1.Secret{})).NotTo(Succeed())
+		})
+
+		It("Restore or keep secrets changed by hand depending on the drift policy", func() {
+			namespacedName := types.NamespacedName{Namespace: "drift", Name: "test-encrypted-secret-drift"}
+			Expect(k8sClient.Create(ctx, &corev1.Namespace{
+				ObjectMeta: metav1.ObjectMeta{Name: namespacedName.Namespace},
+			})).To(Succeed())
+			Expect(k8sClient.Create(ctx, &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "cryptctl-key", Namespace: namespacedName.Namespace},
+				Data:       map[string][]byte{"tls.crt": []byte("justRandomEncryptionKey")},
+			})).To(Succeed())
+
+			instance := &secretsv1alpha1.EncryptedSecret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      namespacedName.Name,
+					Namespace: namespacedName.Namespace,
+					Annotations: map[string]string{
+						"secrets.opensecrecy.org/provider": "k8s",
+					},
+				},
+				Data: map[string]string{
+					"secret": "VdnNsF55TFX9kRiorzy0XPJQRK0FlICFntVqgEMeGOqq+IZfpHmr",
+				},
+			}
+			Expect(k8sClient.Create(ctx, instance)).Should(Succeed())
+			_, err := reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: namespacedName})
+			Expect(err).To(BeNil())
+
+			editSecret := func() {
+				secret := &corev1.Secret{}
+				Expect(k8sClient.Get(ctx, namespacedName, secret)).To(Succeed())
+				Expect(secret.Annotations).To(HaveKey(ContentHashAnnotation))
+				secret.Data["secret"] = []byte("changed-by-hand")
+				Expect(k8sClient.Update(ctx, secret)).To(Succeed())
+			}
+
+			// the default policy restores the values
+			editSecret()
+			_, err = reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: namespacedName})
+			Expect(err).To(BeNil())
+			secret := &corev1.Secret{}
+			Expect(k8sClient.Get(ctx, namespacedName, secret)).To(Succeed())
+			Expect(secret.Data["secret"]).To(Equal([]byte("hello-world")))
+
+			// the warn policy keeps them
+			Expect(k8sClient.Get(ctx, namespacedName, instance)).To(Succeed())
+			instance.DriftPolicy = secretsv1alpha1.DriftPolicyWarn
+			Expect(k8sClient.Update(ctx, instance)).To(Succeed())
+			editSecret()
+			_, err = reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: namespacedName})
+			Expect(err).To(BeNil())
+			Expect(k8sClient.Get(ctx, namespacedName, secret)).To(Succeed())
+			Expect(secret.Data["secret"]).To(Equal([]byte("changed-by-hand")))
+			Expect(k8sClient.Get(ctx, namespacedName, instance)).To(Succeed())
+			Expect(instance.Status.Status).To(Equal(secretsv1alpha1.EncryptedSecretStatusDrifted))
+		})
+
+		It("Skip decryption while the ciphertexts and keys don't change", func() {
+			namespacedName := types.NamespacedName{Namespace: "fingerprint", Name: "test-encrypted-secret-fingerprint"}
+			Expect(k8sClient.Create(ctx, &corev1.Namespace{
+				ObjectMeta: metav1.ObjectMeta{Name: namespacedName.Namespace},
+			})).To(Succeed())
+			Expect(k8sClient.Create(ctx, &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "cryptctl-key", Namespace: namespacedName.Namespace},
+				Data:       map[string][]byte{"tls.crt": []byte("justRandomEncryptionKey")},
+			})).To(Succeed())
+
+			instance := &secretsv1alpha1.EncryptedSecret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      namespacedName.Name,
+					Namespace: namespacedName.Namespace,
+					Annotations: map[string]string{
+						"secrets.opensecrecy.org/provider": "k8s",
+					},
+				},
+				Data: map[string]string{
+					"secret": "VdnNsF55TFX9kRiorzy0XPJQRK0FlICFntVqgEMeGOqq+IZfpHmr",
+				},
+			}
+			Expect(k8sClient.Create(ctx, instance)).Should(Succeed())
+			_, err := reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: namespacedName})
+			Expect(err).To(BeNil())
+			Expect(k8sClient.Get(ctx, namespacedName, instance)).To(Succeed())
+			Expect(instance.Status.Status).To(Equal(secretsv1alpha1.EncryptedSecretStatusReady))
+			Expect(instance.Status.Fingerprint).NotTo(BeEmpty())
+
+			// an unchanged EncryptedSecret leaves the secret and the status alone
+			secret := &corev1.Secret{}
+			Expect(k8sClient.Get(ctx, namespacedName, secret)).To(Succeed())
+			statusVersion := instance.ResourceVersion
+			_, err = reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: namespacedName})
+			Expect(err).To(BeNil())
+			unchanged := &corev1.Secret{}
+			Expect(k8sClient.Get(ctx, namespacedName, unchanged)).To(Succeed())
+			Expect(unchanged.ResourceVersion).To(Equal(secret.ResourceVersion))
+			Expect(k8sClient.Get(ctx, namespacedName, instance)).To(Succeed())
+			Expect(instance.ResourceVersion).To(Equal(statusVersion))
+
+			// a secret changed by hand is still restored
+			unchanged.Data["secret"] = []byte("changed-by-hand")
+			Expect(k8sClient.Update(ctx, unchanged)).To(Succeed())
+			_, err = reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: namespacedName})
+			Expect(err).To(BeNil())
+			Expect(k8sClient.Get(ctx, namespacedName, secret)).To(Succeed())
+			Expect(secret.Data["secret"]).To(Equal([]byte("hello-world")))
 		})
 
 	})
 })
+
+// recordedEvents drains the events recorded by the reconciler so far
+func recordedEvents() []string {
+	var events []string
+	recorder := reconciler.Recorder.(*record.FakeRecorder)
+	for {
+		select {
+		case event := <-recorder.Events:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
@@ -0,0 +1,252 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"slices"
+	"sort"
+
+	"github.com/opensecrecy/encrypted-secrets/pkg/providers"
+	"github.com/opensecrecy/encrypted-secrets/pkg/sops"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	secretsv1alpha1 "github.com/opensecrecy/encrypted-secrets/api/v1alpha1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+// EncryptedSecretValidator rejects EncryptedSecrets that can't be decrypted when
+// they are applied, instead of reporting them in their status after reconciling
+type EncryptedSecretValidator struct {
+	Client client.Client
+
+	// Policy restricts the providers and keys of every namespace, the policy
+	// annotations of a namespace can only narrow it
+	Policy providers.Policy
+	// TrialDecrypt makes the validator decrypt every value. With aws-kms this
+	// costs one KMS call per value on every apply. Without it only the key ids
+	// of the ciphertext headers are checked against the keys of the provider.
+	TrialDecrypt bool
+	// SOPSOperatorKeys lets the sops provider decrypt with the age identities, AWS
+	// credentials and gpg keyring of the operator, besides the keys of the
+	// namespace or provider
+	SOPSOperatorKeys bool
+	// OperatorAWSCredentials lets the aws-kms providers of EncryptionProviders
+	// without the SecretRef auth method use the AWS credentials of the operator
+	OperatorAWSCredentials bool
+}
+
+//+kubebuilder:webhook:path=/validate-secrets-opensecrecy-org-v1alpha1-encryptedsecret,mutating=false,failurePolicy=fail,sideEffects=None,groups=secrets.opensecrecy.org,resources=encryptedsecrets,verbs=create;update,versions=v1alpha1,name=vencryptedsecret.opensecrecy.org,admissionReviewVersions=v1
+
+// SetupWebhookWithManager registers the webhook with the webhook server of the Manager.
+func (v *EncryptedSecretValidator) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(&secretsv1alpha1.EncryptedSecret{}).
+		WithValidator(v).
+		Complete()
+}
+
+// ValidateCreate implements admission.CustomValidator
+func (v *EncryptedSecretValidator) ValidateCreate(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	return v.validate(ctx, obj)
+}
+
+// ValidateUpdate implements admission.CustomValidator
+func (v *EncryptedSecretValidator) ValidateUpdate(ctx context.Context, _, newObj runtime.Object) (admission.Warnings, error) {
+	return v.validate(ctx, newObj)
+}
+
+// ValidateDelete implements admission.CustomValidator
+func (v *EncryptedSecretValidator) ValidateDelete(_ context.Context, _ runtime.Object) (admission.Warnings, error) {
+	return nil, nil
+}
+
+func (v *EncryptedSecretValidator) validate(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	instance, ok := obj.(*secretsv1alpha1.EncryptedSecret)
+	if !ok {
+		return nil, fmt.Errorf("expected an EncryptedSecret but got a %T", obj)
+	}
+
+	policies, err := namespacePolicies(ctx, v.Client, instance.Namespace, v.Policy)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, policies, err := resolveProvider(ctx, v.Client, instance, instance.ProviderRef, instance.Namespace, policies...)
+	cfg.SOPSOperatorKeys = v.SOPSOperatorKeys
+	cfg.OperatorAWSCredentials = v.OperatorAWSCredentials
+	if err != nil {
+		// the provider may be applied together with the EncryptedSecret
+		if apierrors.IsNotFound(err) {
+			return admission.Warnings{err.Error()}, nil
+		}
+		if providers.IsPolicyError(err) {
+			return nil, v.invalid(instance, field.ErrorList{field.Forbidden(providerPath(instance), err.Error())})
+		}
+		return nil, err
+	}
+
+	switch cfg.Provider {
+	case providers.K8sProvider, providers.AWSKMSProvider, providers.SOPSProvider:
+	default:
+		return nil, v.invalid(instance, field.ErrorList{field.NotSupported(providerPath(instance), cfg.Provider,
+			[]string{providers.K8sProvider, providers.AWSKMSProvider, providers.SOPSProvider})})
+	}
+
+	var allErrs field.ErrorList
+	switch {
+	case cfg.Provider == providers.SOPSProvider && len(instance.Data) > 0:
+		allErrs = append(allErrs, field.Forbidden(field.NewPath("data"), "the sops provider decrypts the SOPS document in sops instead"))
+	case cfg.Provider == providers.SOPSProvider && !sops.IsEncrypted([]byte(instance.Sops)):
+		allErrs = append(allErrs, field.Invalid(field.NewPath("sops"), field.OmitValueType{}, "not a document encrypted by SOPS"))
+	case cfg.Provider != providers.SOPSProvider && instance.Sops != "":
+		allErrs = append(allErrs, field.Forbidden(field.NewPath("sops"), "only the sops provider decrypts SOPS documents"))
+	}
+	if len(allErrs) > 0 {
+		return nil, v.invalid(instance, allErrs)
+	}
+
+	for _, key := range sortedDataKeys(instance.Data) {
+		value := instance.Data[key]
+		path := field.NewPath("data").Key(key)
+
+		if _, err := base64.StdEncoding.DecodeString(value); err != nil {
+			allErrs = append(allErrs, field.Invalid(path, field.OmitValueType{}, fmt.Sprintf("not base64 encoded %v", err)))
+			continue
+		}
+
+		keyID, hasHeader := providers.KeyID(value)
+		if !hasHeader {
+			continue
+		}
+		if cfg.Provider != providers.K8sProvider {
+			allErrs = append(allErrs, field.Invalid(path, field.OmitValueType{},
+				fmt.Sprintf("encrypted by the %s provider with key %s, not by %s", providers.K8sProvider, keyID, cfg.Provider)))
+			continue
+		}
+		for _, policy := range policies {
+			if err := policy.CheckKeyID(keyID); err != nil {
+				allErrs = append(allErrs, field.Forbidden(path, err.Error()))
+				break
+			}
+		}
+	}
+	if len(allErrs) > 0 {
+		return nil, v.invalid(instance, allErrs)
+	}
+
+	warnings, allErrs, err := v.checkKeyIDs(ctx, cfg, instance)
+	if err != nil {
+		return nil, err
+	}
+	if len(allErrs) > 0 {
+		return nil, v.invalid(instance, allErrs)
+	}
+
+	if v.TrialDecrypt {
+		provider, err := buildProvider(ctx, cfg, policies)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range sortedDataKeys(instance.Data) {
+			if _, _, err := provider.Decrypt(ctx, instance.Data[key]); err != nil {
+				allErrs = append(allErrs, field.Invalid(field.NewPath("data").Key(key), field.OmitValueType{},
+					fmt.Sprintf("failed to decrypt %v", err)))
+			}
+		}
+		if instance.Sops != "" {
+			if _, _, err := provider.Decrypt(ctx, instance.Sops); err != nil {
+				allErrs = append(allErrs, field.Invalid(field.NewPath("sops"), field.OmitValueType{},
+					fmt.Sprintf("failed to decrypt %v", err)))
+			}
+		}
+		if len(allErrs) > 0 {
+			return nil, v.invalid(instance, allErrs)
+		}
+	}
+
+	return warnings, nil
+}
+
+// checkKeyIDs rejects values whose header names a key the provider doesn't have.
+// Only the keys of the provider are read, nothing is decrypted.
+func (v *EncryptedSecretValidator) checkKeyIDs(ctx context.Context, cfg providers.Config, instance *secretsv1alpha1.EncryptedSecret) (admission.Warnings, field.ErrorList, error) {
+	keyIDs := make(map[string]string)
+	for key, value := range instance.Data {
+		if keyID, ok := providers.KeyID(value); ok {
+			keyIDs[key] = keyID
+		}
+	}
+	if len(keyIDs) == 0 {
+		return nil, nil, nil
+	}
+
+	provider, err := providers.NewProvider(ctx, cfg)
+	if providers.IsKeyMissingError(err) {
+		// the key secret may be applied together with the EncryptedSecret
+		return admission.Warnings{err.Error()}, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	lister, ok := provider.(providers.KeyIDLister)
+	if !ok {
+		return nil, nil, nil
+	}
+	known, err := lister.KeyIDs(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var allErrs field.ErrorList
+	for _, key := range sortedDataKeys(keyIDs) {
+		if !slices.Contains(known, keyIDs[key]) {
+			allErrs = append(allErrs, field.Invalid(field.NewPath("data").Key(key), field.OmitValueType{},
+				fmt.Sprintf("encrypted with key %s, which the %s provider doesn't have", keyIDs[key], cfg.Provider)))
+		}
+	}
+	return nil, allErrs, nil
+}
+
+func (v *EncryptedSecretValidator) invalid(instance *secretsv1alpha1.EncryptedSecret, allErrs field.ErrorList) error {
+	return apierrors.NewInvalid(secretsv1alpha1.GroupVersion.WithKind("EncryptedSecret").GroupKind(), instance.Name, allErrs)
+}
+
+// providerPath returns the field selecting the provider of instance
+func providerPath(instance *secretsv1alpha1.EncryptedSecret) *field.Path {
+	if instance.ProviderRef != nil {
+		return field.NewPath("providerRef")
+	}
+	return field.NewPath("metadata", "annotations").Key(providers.ProviderAnnotation)
+}
+
+// sortedDataKeys returns the keys of data in order, so that errors are reported
+// in a stable order
+func sortedDataKeys(data map[string]string) []string {
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,152 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	secretsv1alpha1 "github.com/opensecrecy/encrypted-secrets/api/v1alpha1"
+	"github.com/opensecrecy/encrypted-secrets/pkg/providers"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var _ = Describe("EncryptedSecret webhook", func() {
+
+	Context("Verify validator", func() {
+		ctx := context.Background()
+		validator := &EncryptedSecretValidator{}
+		// every spec validates in its own namespace
+		var namespace string
+		specs := 0
+
+		BeforeEach(func() {
+			validator.Client = k8sClient
+
+			specs++
+			namespace = fmt.Sprintf("webhook-%d", specs)
+			Expect(k8sClient.Create(ctx, &corev1.Namespace{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: namespace,
+					Annotations: map[string]string{
+						"secrets.opensecrecy.org/allowed-key-ids": "team-a-*",
+					},
+				},
+			})).To(Succeed())
+		})
+
+		encryptedSecret := func(provider string, data map[string]string) *secretsv1alpha1.EncryptedSecret {
+			return &secretsv1alpha1.EncryptedSecret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "test-encrypted-secret-webhook",
+					Namespace: namespace,
+					Annotations: map[string]string{
+						"secrets.opensecrecy.org/provider": provider,
+					},
+				},
+				Data: data,
+			}
+		}
+
+		It("Reject values that can't be decrypted", func() {
+			keyring, err := providers.NewKeyring("team-b-2023", map[string]string{
+				"team-b-2023": "anotherRandomEncryptionKey",
+			})
+			Expect(err).To(BeNil())
+			forbidden, err := keyring.Encrypt("hello-world")
+			Expect(err).To(BeNil())
+
+			_, err = validator.ValidateCreate(ctx, encryptedSecret("vault", map[string]string{
+				"secret": "VdnNsF55TFX9kRiorzy0XPJQRK0FlICFntVqgEMeGOqq+IZfpHmr",
+			}))
+			Expect(err).To(MatchError(ContainSubstring("Unsupported value")))
+
+			_, err = validator.ValidateCreate(ctx, encryptedSecret("k8s", map[string]string{
+				"secret": "not base64",
+			}))
+			Expect(err).To(MatchError(ContainSubstring("not base64 encoded")))
+
+			_, err = validator.ValidateCreate(ctx, encryptedSecret("aws-kms", map[string]string{
+				"secret": forbidden,
+			}))
+			Expect(err).To(MatchError(ContainSubstring("encrypted by the k8s provider")))
+
+			_, err = validator.ValidateCreate(ctx, encryptedSecret("k8s", map[string]string{
+				"secret": forbidden,
+			}))
+			Expect(err).To(MatchError(ContainSubstring("not allowed by policy")))
+		})
+
+		It("Admit values without a key id header", func() {
+			warnings, err := validator.ValidateCreate(ctx, encryptedSecret("k8s", map[string]string{
+				"secret": "VdnNsF55TFX9kRiorzy0XPJQRK0FlICFntVqgEMeGOqq+IZfpHmr",
+			}))
+			Expect(err).To(BeNil())
+			Expect(warnings).To(BeEmpty())
+		})
+
+		It("Reject key ids the provider doesn't have", func() {
+			Expect(k8sClient.Create(ctx, &corev1.Namespace{
+				ObjectMeta: metav1.ObjectMeta{Name: "webhook-key-ids"},
+			})).To(Succeed())
+			Expect(k8sClient.Create(ctx, &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        providers.K8sKeyringSecretName,
+					Namespace:   "webhook-key-ids",
+					Annotations: map[string]string{providers.K8sPrimaryKeyAnnotation: "team-a-2024"},
+				},
+				Data: map[string][]byte{"team-a-2024": []byte("justRandomEncryptionKey")},
+			})).To(Succeed())
+
+			known, err := providers.NewKeyring("team-a-2024", map[string]string{"team-a-2024": "justRandomEncryptionKey"})
+			Expect(err).To(BeNil())
+			unknown, err := providers.NewKeyring("team-a-2023", map[string]string{"team-a-2023": "anotherRandomEncryptionKey"})
+			Expect(err).To(BeNil())
+			knownValue, err := known.Encrypt("hello-world")
+			Expect(err).To(BeNil())
+			unknownValue, err := unknown.Encrypt("hello-world")
+			Expect(err).To(BeNil())
+
+			instance := encryptedSecret("k8s", map[string]string{"current": knownValue, "retired": unknownValue})
+			instance.Namespace = "webhook-key-ids"
+			_, err = validator.ValidateCreate(ctx, instance)
+			Expect(err).To(MatchError(ContainSubstring("encrypted with key team-a-2023, which the k8s provider doesn't have")))
+			Expect(err).NotTo(MatchError(ContainSubstring("current")))
+
+			instance.Data = map[string]string{"current": knownValue}
+			warnings, err := validator.ValidateCreate(ctx, instance)
+			Expect(err).To(BeNil())
+			Expect(warnings).To(BeEmpty())
+		})
+
+		It("Warn about providers that don't exist yet", func() {
+			instance := encryptedSecret("", map[string]string{
+				"secret": "VdnNsF55TFX9kRiorzy0XPJQRK0FlICFntVqgEMeGOqq+IZfpHmr",
+			})
+			instance.ProviderRef = &secretsv1alpha1.ProviderReference{Name: "missing"}
+			warnings, err := validator.ValidateCreate(ctx, instance)
+			Expect(err).To(BeNil())
+			Expect(warnings).To(HaveLen(1))
+		})
+
+		It("Keep SOPS documents to the sops provider", func() {
+			instance := encryptedSecret("k8s", nil)
+			instance.Sops = "password: ENC[AES256_GCM,data:aGk=,iv:aGk=,tag:aGk=,type:str]\n"
+			_, err := validator.ValidateCreate(ctx, instance)
+			Expect(err).To(MatchError(ContainSubstring("only the sops provider")))
+
+			instance = encryptedSecret("sops", map[string]string{
+				"secret": "VdnNsF55TFX9kRiorzy0XPJQRK0FlICFntVqgEMeGOqq+IZfpHmr",
+			})
+			_, err = validator.ValidateCreate(ctx, instance)
+			Expect(err).To(MatchError(ContainSubstring("decrypts the SOPS document")))
+
+			instance = encryptedSecret("sops", nil)
+			instance.Sops = "password: hunter2\n"
+			_, err = validator.ValidateCreate(ctx, instance)
+			Expect(err).To(MatchError(ContainSubstring("not a document encrypted by SOPS")))
+		})
+	})
+})
@@ -0,0 +1,95 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	secretsv1alpha1 "github.com/opensecrecy/encrypted-secrets/api/v1alpha1"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+// providerCheckInterval is how often the readiness of providers is checked again
+const providerCheckInterval = 5 * time.Minute
+
+// EncryptionProviderReconciler reconciles a EncryptionProvider object
+type EncryptionProviderReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+	log    logr.Logger
+
+	// OperatorAWSCredentials lets aws-kms providers without the SecretRef auth
+	// method use the AWS credentials of the operator
+	OperatorAWSCredentials bool
+}
+
+//+kubebuilder:rbac:groups=secrets.opensecrecy.org,resources=encryptionproviders,verbs=get;list;watch
+//+kubebuilder:rbac:groups=secrets.opensecrecy.org,resources=encryptionproviders/status,verbs=get;update;patch
+
+func (r *EncryptionProviderReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	r.log = log.FromContext(ctx).WithValues("EncryptionProvider", req.NamespacedName)
+	r.log.Info("Started encryptionprovider reconciliation")
+
+	instance := &secretsv1alpha1.EncryptionProvider{}
+
+	if err := r.Get(ctx, req.NamespacedName, instance); err != nil {
+		r.log.Info("Unable to fetch encryptionprovider object")
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	keyVersion, err := checkProvider(ctx, r.Client, instance.Spec, instance.Namespace, false, r.OperatorAWSCredentials)
+	if err != nil {
+		r.log.Error(err, "Provider is not ready")
+		instance.Status.Status = errorStatus(err)
+		instance.Status.Message = fmt.Sprintf("provider is not ready %s", err.Error())
+		instance.Status.KeyVersion = ""
+		return r.ensureStatus(ctx, instance, ctrl.Result{RequeueAfter: providerCheckInterval})
+	}
+
+	instance.Status.Status = secretsv1alpha1.EncryptedSecretStatusReady
+	instance.Status.Message = fmt.Sprintf("provider %s is ready to be used", instance.Name)
+	instance.Status.KeyVersion = keyVersion
+	return r.ensureStatus(ctx, instance, ctrl.Result{RequeueAfter: providerCheckInterval})
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *EncryptionProviderReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&secretsv1alpha1.EncryptionProvider{}, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Complete(r)
+}
+
+// ensureStatus makes sure that proper status is applied to the EncryptionProvider instance
+func (r *EncryptionProviderReconciler) ensureStatus(ctx context.Context, instance *secretsv1alpha1.EncryptionProvider, result ctrl.Result) (ctrl.Result, error) {
+
+	err := r.Status().Update(ctx, instance)
+	if err != nil {
+		r.log.Error(err, "Failed to update status")
+		return ctrl.Result{Requeue: true}, nil
+	}
+
+	return result, nil
+}
@@ -0,0 +1,353 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/opensecrecy/encrypted-secrets/pkg/providers"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	secretsv1alpha1 "github.com/opensecrecy/encrypted-secrets/api/v1alpha1"
+)
+
+var _ = Describe("EncryptionProviders", func() {
+
+	Context("Verify providers", func() {
+		ctx := context.Background()
+		// every spec gets its own namespace with the fixtures of BeforeEach
+		var namespace string
+		specs := 0
+
+		// k8sProvider returns an EncryptionProvider of the k8s provider using keySecret
+		k8sProvider := func(name, keySecret string) *secretsv1alpha1.EncryptionProvider {
+			return &secretsv1alpha1.EncryptionProvider{
+				ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+				Spec: secretsv1alpha1.EncryptionProviderSpec{
+					Type: providers.K8sProvider,
+					K8s:  &secretsv1alpha1.K8sProviderSpec{KeySecretRef: &secretsv1alpha1.SecretReference{Name: keySecret}},
+				},
+			}
+		}
+
+		BeforeEach(func() {
+			specs++
+			namespace = fmt.Sprintf("providers-%d", specs)
+			for _, obj := range []client.Object{
+				&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace}},
+				&corev1.Secret{
+					ObjectMeta: metav1.ObjectMeta{Name: "team-key", Namespace: namespace},
+					Data:       map[string][]byte{"tls.crt": []byte("justRandomEncryptionKey")},
+				},
+				&corev1.Secret{
+					ObjectMeta: metav1.ObjectMeta{Name: "kms-credentials", Namespace: namespace},
+					Data: map[string][]byte{
+						awsAccessKeyIDKey:     []byte("AKIAEXAMPLE"),
+						awsSecretAccessKeyKey: []byte("secret"),
+					},
+				},
+				k8sProvider("ready", "team-key"),
+			} {
+				Expect(k8sClient.Create(ctx, obj)).To(Succeed())
+			}
+		})
+
+		It("Report the readiness of an EncryptionProvider", func() {
+			Expect(k8sClient.Create(ctx, k8sProvider("missing-key", "missing"))).To(Succeed())
+			providerReconciler := &EncryptionProviderReconciler{Client: k8sClient, Scheme: scheme.Scheme}
+			for _, name := range []string{"ready", "missing-key"} {
+				_, err := providerReconciler.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Namespace: namespace, Name: name}})
+				Expect(err).To(BeNil())
+			}
+
+			provider := &secretsv1alpha1.EncryptionProvider{}
+			Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: namespace, Name: "ready"}, provider)).To(Succeed())
+			Expect(provider.Status.Status).To(Equal(secretsv1alpha1.EncryptedSecretStatusReady))
+			Expect(provider.Status.KeyVersion).NotTo(BeEmpty())
+
+			Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: namespace, Name: "missing-key"}, provider)).To(Succeed())
+			Expect(provider.Status.Status).To(Equal(secretsv1alpha1.EncryptedSecretStatusError))
+			Expect(provider.Status.KeyVersion).To(BeEmpty())
+		})
+
+		It("Report the readiness of a ClusterEncryptionProvider", func() {
+			providerReconciler := &ClusterEncryptionProviderReconciler{Client: k8sClient, Scheme: scheme.Scheme}
+			for name, spec := range map[string]secretsv1alpha1.EncryptionProviderSpec{
+				// reads the keys of each namespace
+				"each-namespace": {Type: providers.K8sProvider},
+				"team-key": {
+					Type: providers.K8sProvider,
+					K8s: &secretsv1alpha1.K8sProviderSpec{
+						KeySecretRef: &secretsv1alpha1.SecretReference{Name: "team-key", Namespace: namespace},
+					},
+				},
+			} {
+				Expect(k8sClient.Create(ctx, &secretsv1alpha1.ClusterEncryptionProvider{
+					ObjectMeta: metav1.ObjectMeta{Name: name},
+					Spec:       secretsv1alpha1.ClusterEncryptionProviderSpec{EncryptionProviderSpec: spec},
+				})).To(Succeed())
+				_, err := providerReconciler.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Name: name}})
+				Expect(err).To(BeNil())
+
+				provider := &secretsv1alpha1.ClusterEncryptionProvider{}
+				Expect(k8sClient.Get(ctx, types.NamespacedName{Name: name}, provider)).To(Succeed())
+				Expect(provider.Status.Status).To(Equal(secretsv1alpha1.EncryptedSecretStatusReady))
+			}
+		})
+
+		It("Require the namespace of the secrets of a ClusterEncryptionProvider", func() {
+			err := k8sClient.Create(ctx, &secretsv1alpha1.ClusterEncryptionProvider{
+				ObjectMeta: metav1.ObjectMeta{Name: "no-namespace"},
+				Spec: secretsv1alpha1.ClusterEncryptionProviderSpec{EncryptionProviderSpec: secretsv1alpha1.EncryptionProviderSpec{
+					Type: providers.K8sProvider,
+					K8s:  &secretsv1alpha1.K8sProviderSpec{KeySecretRef: &secretsv1alpha1.SecretReference{Name: "team-key"}},
+				}},
+			})
+			Expect(err).To(MatchError(ContainSubstring("k8s.keySecretRef needs a namespace")))
+
+			// providers created before the validation are refused as well
+			spec := secretsv1alpha1.EncryptionProviderSpec{
+				Type: providers.AWSKMSProvider,
+				AWSKMS: &secretsv1alpha1.AWSKMSProviderSpec{Auth: secretsv1alpha1.AWSAuth{
+					Method:    secretsv1alpha1.AWSAuthMethodSecretRef,
+					SecretRef: &secretsv1alpha1.SecretReference{Name: "kms-credentials"},
+				}},
+			}
+			_, err = configFromSpec(ctx, k8sClient, spec, namespace, true)
+			Expect(err).To(MatchError(ContainSubstring("awsKms.auth.secretRef of a ClusterEncryptionProvider needs a namespace")))
+		})
+
+		It("Turn provider specs into configurations", func() {
+			// a namespaced provider always reads its secrets from its own namespace
+			cfg, err := configFromSpec(ctx, k8sClient, secretsv1alpha1.EncryptionProviderSpec{
+				Type: providers.K8sProvider,
+				K8s: &secretsv1alpha1.K8sProviderSpec{
+					KeySecretRef: &secretsv1alpha1.SecretReference{Name: "team-key", Namespace: "elsewhere"},
+				},
+			}, namespace, false)
+			Expect(err).To(BeNil())
+			Expect(cfg).To(Equal(providers.Config{Provider: providers.K8sProvider, Namespace: namespace, KeySecretName: "team-key"}))
+
+			kmsSpec := secretsv1alpha1.EncryptionProviderSpec{
+				Type: providers.AWSKMSProvider,
+				AWSKMS: &secretsv1alpha1.AWSKMSProviderSpec{
+					KeyID:  "alias/team",
+					Region: "eu-west-1",
+					Auth: secretsv1alpha1.AWSAuth{
+						Method:    secretsv1alpha1.AWSAuthMethodSecretRef,
+						SecretRef: &secretsv1alpha1.SecretReference{Name: "kms-credentials", Namespace: namespace},
+						RoleARN:   "arn:aws:iam::111122223333:role/team",
+					},
+				},
+			}
+			cfg, err = configFromSpec(ctx, k8sClient, kmsSpec, "", true)
+			Expect(err).To(BeNil())
+			Expect(cfg.KMSKeyID).To(Equal("alias/team"))
+			Expect(cfg.Region).To(Equal("eu-west-1"))
+			Expect(cfg.RoleARN).To(Equal("arn:aws:iam::111122223333:role/team"))
+			credentials, err := cfg.Credentials.Retrieve(ctx)
+			Expect(err).To(BeNil())
+			Expect(credentials.AccessKeyID).To(Equal("AKIAEXAMPLE"))
+
+			// the sops provider reads both key secrets from one namespace
+			cfg, err = configFromSpec(ctx, k8sClient, secretsv1alpha1.EncryptionProviderSpec{
+				Type: providers.SOPSProvider,
+				Sops: &secretsv1alpha1.SOPSProviderSpec{
+					AgeKeySecretRef: &secretsv1alpha1.SecretReference{Name: "team-age", Namespace: namespace},
+					PGPKeySecretRef: &secretsv1alpha1.SecretReference{Name: "team-pgp", Namespace: "elsewhere"},
+				},
+			}, "", true)
+			Expect(err).To(MatchError(ContainSubstring("same namespace")))
+
+			// the operator credentials of a namespaced provider need the opt in
+			sopsSpec := secretsv1alpha1.EncryptionProviderSpec{
+				Type: providers.SOPSProvider,
+				Sops: &secretsv1alpha1.SOPSProviderSpec{KMS: &secretsv1alpha1.SOPSKMSSpec{}},
+			}
+			cfg, err = configFromSpec(ctx, k8sClient, sopsSpec, namespace, false)
+			Expect(err).To(BeNil())
+			Expect(cfg.SOPSKMS).To(BeFalse())
+			sopsSpec.Sops.KMS.Auth = kmsSpec.AWSKMS.Auth
+			cfg, err = configFromSpec(ctx, k8sClient, sopsSpec, namespace, false)
+			Expect(err).To(BeNil())
+			Expect(cfg.SOPSKMS).To(BeTrue())
+			Expect(cfg.Credentials).NotTo(BeNil())
+		})
+
+		It("Refuse the AWS credentials of the operator to namespaced providers", func() {
+			// the role would be assumed with the credentials of the operator
+			operatorCredentials := &secretsv1alpha1.EncryptionProvider{
+				ObjectMeta: metav1.ObjectMeta{Name: "operator-credentials", Namespace: namespace},
+				Spec: secretsv1alpha1.EncryptionProviderSpec{
+					Type: providers.AWSKMSProvider,
+					AWSKMS: &secretsv1alpha1.AWSKMSProviderSpec{
+						KeyID: "alias/operator",
+						Auth: secretsv1alpha1.AWSAuth{
+							Method:  secretsv1alpha1.AWSAuthMethodDefault,
+							RoleARN: "arn:aws:iam::111122223333:role/operator",
+						},
+					},
+				},
+			}
+			Expect(k8sClient.Create(ctx, operatorCredentials)).To(Succeed())
+
+			providerReconciler := &EncryptionProviderReconciler{Client: k8sClient, Scheme: scheme.Scheme}
+			namespacedName := types.NamespacedName{Namespace: namespace, Name: operatorCredentials.Name}
+			_, err := providerReconciler.Reconcile(ctx, ctrl.Request{NamespacedName: namespacedName})
+			Expect(err).To(BeNil())
+			Expect(k8sClient.Get(ctx, namespacedName, operatorCredentials)).To(Succeed())
+			Expect(operatorCredentials.Status.Status).To(Equal(secretsv1alpha1.EncryptedSecretStatusForbidden))
+			Expect(operatorCredentials.Status.Message).To(ContainSubstring("needs the SecretRef auth method"))
+
+			// EncryptedSecrets referencing it are refused before KMS is called
+			obj := &secretsv1alpha1.EncryptedSecret{ObjectMeta: metav1.ObjectMeta{Name: "operator-credentials", Namespace: namespace}}
+			cfg, policies, err := resolveProvider(ctx, k8sClient, obj, &secretsv1alpha1.ProviderReference{Name: operatorCredentials.Name}, namespace)
+			Expect(err).To(BeNil())
+			_, err = buildProvider(ctx, cfg, policies)
+			Expect(providers.IsPolicyError(err)).To(BeTrue())
+
+			// unless the operator allows it
+			cfg.OperatorAWSCredentials = true
+			_, err = buildProvider(ctx, cfg, policies)
+			Expect(err).To(BeNil())
+
+			// a role assumed with credentials of the namespace is fine
+			cfg, err = configFromSpec(ctx, k8sClient, secretsv1alpha1.EncryptionProviderSpec{
+				Type: providers.AWSKMSProvider,
+				AWSKMS: &secretsv1alpha1.AWSKMSProviderSpec{Auth: secretsv1alpha1.AWSAuth{
+					Method:    secretsv1alpha1.AWSAuthMethodSecretRef,
+					SecretRef: &secretsv1alpha1.SecretReference{Name: "kms-credentials"},
+					RoleARN:   "arn:aws:iam::111122223333:role/team",
+				}},
+			}, namespace, false)
+			Expect(err).To(BeNil())
+			_, err = buildProvider(ctx, cfg, nil)
+			Expect(err).To(BeNil())
+		})
+
+		It("Resolve provider references", func() {
+			Expect(k8sClient.Create(ctx, &secretsv1alpha1.ClusterEncryptionProvider{
+				ObjectMeta: metav1.ObjectMeta{Name: "named-namespaces"},
+				Spec: secretsv1alpha1.ClusterEncryptionProviderSpec{
+					EncryptionProviderSpec: secretsv1alpha1.EncryptionProviderSpec{
+						Type:          providers.K8sProvider,
+						AllowedKeyIDs: []string{"v1"},
+					},
+					AllowedNamespaces: &secretsv1alpha1.NamespaceSelector{Names: []string{namespace}},
+				},
+			})).To(Succeed())
+
+			obj := &secretsv1alpha1.EncryptedSecret{ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: namespace}}
+			cfg, policy, err := providerConfig(ctx, k8sClient, obj, &secretsv1alpha1.ProviderReference{Name: "ready"}, namespace)
+			Expect(err).To(BeNil())
+			Expect(cfg.KeySecretName).To(Equal("team-key"))
+			Expect(policy.KeyIDs).To(BeEmpty())
+
+			cfg, policy, err = providerConfig(ctx, k8sClient, obj, &secretsv1alpha1.ProviderReference{
+				Kind: secretsv1alpha1.ClusterEncryptionProviderKind, Name: "named-namespaces"}, namespace)
+			Expect(err).To(BeNil())
+			Expect(cfg.Namespace).To(Equal(namespace))
+			Expect(policy.KeyIDs).To(Equal([]string{"v1"}))
+
+			other := &secretsv1alpha1.EncryptedSecret{ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default"}}
+			_, _, err = providerConfig(ctx, k8sClient, other, &secretsv1alpha1.ProviderReference{
+				Kind: secretsv1alpha1.ClusterEncryptionProviderKind, Name: "named-namespaces"}, "default")
+			Expect(providers.IsPolicyError(err)).To(BeTrue())
+
+			// cluster scoped objects can't reference an EncryptionProvider
+			clusterObj := &secretsv1alpha1.ClusterEncryptedSecret{ObjectMeta: metav1.ObjectMeta{Name: "db"}}
+			_, _, err = providerConfig(ctx, k8sClient, clusterObj, &secretsv1alpha1.ProviderReference{Name: "ready"}, "")
+			Expect(err).To(MatchError(ContainSubstring("can only reference a ClusterEncryptionProvider")))
+
+			_, _, err = providerConfig(ctx, k8sClient, obj, &secretsv1alpha1.ProviderReference{Name: "missing"}, namespace)
+			Expect(err).NotTo(BeNil())
+		})
+
+		It("Only encrypt deterministically in the encrypting webhooks", func() {
+			obj := &secretsv1alpha1.EncryptedSecret{ObjectMeta: metav1.ObjectMeta{
+				Name:      "deterministic",
+				Namespace: namespace,
+				Annotations: map[string]string{
+					providers.ProviderAnnotation:      providers.AWSKMSProvider,
+					providers.DeterministicAnnotation: "true",
+				},
+			}}
+			// --rotate-keys re-encrypts with the configuration of the decrypting controllers
+			cfg, _, err := resolveProvider(ctx, k8sClient, obj, nil, namespace)
+			Expect(err).To(BeNil())
+			Expect(cfg.Deterministic).To(BeFalse())
+
+			cfg, _, err = resolveProvider(ctx, k8sClient, obj, &secretsv1alpha1.ProviderReference{Name: "ready"}, namespace)
+			Expect(err).To(BeNil())
+			Expect(cfg.Deterministic).To(BeFalse())
+		})
+
+		It("Reuse the primary key version of aws-kms", func() {
+			cache := &keyVersionCache{versions: map[string]cachedKeyVersion{}}
+			calls := 0
+			kms := &keyVersionProvider{version: func() (string, error) {
+				calls++
+				return "arn:aws:kms:eu-west-1:111122223333:key/1234", nil
+			}}
+			cfg := providers.Config{Provider: providers.AWSKMSProvider, KMSKeyID: "alias/cryptctl-key"}
+			for i := 0; i < 2; i++ {
+				version, err := cache.wrap(kms, cfg).PrimaryKeyVersion(ctx)
+				Expect(err).To(BeNil())
+				Expect(version).To(Equal("arn:aws:kms:eu-west-1:111122223333:key/1234"))
+			}
+			Expect(calls).To(Equal(1))
+
+			// another key is a different provider
+			cfg.KMSKeyID = "alias/other-key"
+			_, err := cache.wrap(kms, cfg).PrimaryKeyVersion(ctx)
+			Expect(err).To(BeNil())
+			Expect(calls).To(Equal(2))
+
+			// failures are retried
+			kms.version = func() (string, error) {
+				calls++
+				return "", errors.New("unreachable")
+			}
+			cfg.KMSKeyID = "alias/failing-key"
+			for i := 0; i < 2; i++ {
+				_, err = cache.wrap(kms, cfg).PrimaryKeyVersion(ctx)
+				Expect(err).NotTo(BeNil())
+			}
+			Expect(calls).To(Equal(4))
+		})
+	})
+})
+
+// keyVersionProvider returns the primary key version of its version function
+type keyVersionProvider struct {
+	providers.Provider
+	version func() (string, error)
+}
+
+func (p *keyVersionProvider) PrimaryKeyVersion(_ context.Context) (string, error) {
+	return p.version()
+}
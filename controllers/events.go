@@ -0,0 +1,76 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"github.com/opensecrecy/encrypted-secrets/pkg/providers"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Reasons of the events emitted by the controllers
+const (
+	// ReasonPolicyViolation is emitted when a policy refuses the provider or keys
+	ReasonPolicyViolation = "PolicyViolation"
+	// ReasonDriftDetected is emitted when changes made by hand to a secret are kept
+	ReasonDriftDetected = "DriftDetected"
+	// ReasonDriftCorrected is emitted when a secret changed or deleted by hand is restored
+	ReasonDriftCorrected = "DriftCorrected"
+	// ReasonDecrypted is emitted when a secret is written with newly decrypted values
+	ReasonDecrypted = "Decrypted"
+	// ReasonDecryptFailed is emitted when the values can't be decrypted
+	ReasonDecryptFailed = "DecryptFailed"
+	// ReasonKeyMissing is emitted when the key the values are encrypted with doesn't exist
+	ReasonKeyMissing = "KeyMissing"
+	// ReasonSecretConflict is emitted when the secret to write is managed by someone else
+	ReasonSecretConflict = "SecretConflict"
+)
+
+// discardEvents drops the events of reconcilers built without a recorder
+var discardEvents record.EventRecorder = &record.FakeRecorder{}
+
+// eventRecorder returns recorder, or discardEvents when it is nil
+func eventRecorder(recorder record.EventRecorder) record.EventRecorder {
+	if recorder == nil {
+		return discardEvents
+	}
+	return recorder
+}
+
+// recordDecryptFailure emits a warning event on obj about err, which was returned
+// when getting the provider or decrypting. The errors of the providers never
+// contain plaintext.
+func recordDecryptFailure(recorder record.EventRecorder, obj runtime.Object, err error) {
+	switch {
+	case providers.IsPolicyError(err):
+		recorder.Event(obj, corev1.EventTypeWarning, ReasonPolicyViolation, err.Error())
+	case providers.IsKeyMissingError(err):
+		recorder.Event(obj, corev1.EventTypeWarning, ReasonKeyMissing, err.Error())
+	default:
+		recorder.Event(obj, corev1.EventTypeWarning, ReasonDecryptFailed, err.Error())
+	}
+}
+
+// recordSecretConflict emits a warning event on obj when err was returned because
+// its secret is managed by someone else
+func recordSecretConflict(recorder record.EventRecorder, obj runtime.Object, err error) {
+	if isSecretConflict(err) {
+		recorder.Event(obj, corev1.EventTypeWarning, ReasonSecretConflict, err.Error())
+	}
+}
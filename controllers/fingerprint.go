@@ -0,0 +1,102 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/opensecrecy/encrypted-secrets/pkg/providers"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	secretsv1alpha1 "github.com/opensecrecy/encrypted-secrets/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// fingerprint returns a hash of everything the secret of instance is derived from:
+// the ciphertexts or SOPS document, the metadata copied to the secret, the provider with its
+// policies and the version of its primary key. The plaintext is left out, so
+// the fingerprint can be compared without decrypting.
+func fingerprint(instance *secretsv1alpha1.EncryptedSecret, cfg providers.Config, policies []providers.Policy,
+	primaryKeyVersion, driftPolicy string) string {
+
+	hash := sha256.New()
+	// json sorts the keys of maps, which makes the encoding deterministic
+	_ = json.NewEncoder(hash).Encode(struct {
+		Data              map[string]string
+		Sops              string
+		Labels            map[string]string
+		Annotations       map[string]string
+		Provider          string
+		Namespace         string
+		KeySecretName     string
+		KMSKeyID          string
+		Region            string
+		RoleARN           string
+		Policies          []providers.Policy
+		PrimaryKeyVersion string
+		DriftPolicy       string
+	}{
+		Data:              instance.Data,
+		Sops:              instance.Sops,
+		Labels:            instance.Labels,
+		Annotations:       instance.Annotations,
+		Provider:          cfg.Provider,
+		Namespace:         cfg.Namespace,
+		KeySecretName:     cfg.KeySecretName,
+		KMSKeyID:          cfg.KMSKeyID,
+		Region:            cfg.Region,
+		RoleARN:           cfg.RoleARN,
+		Policies:          policies,
+		PrimaryKeyVersion: primaryKeyVersion,
+		DriftPolicy:       driftPolicy,
+	})
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// clusterFingerprint returns the fingerprint of a ClusterEncryptedSecret decrypted
+// as encryptedSecret. The selected namespaces and their policies are part of it,
+// since the secrets are written into each of them.
+func clusterFingerprint(encryptedSecret *secretsv1alpha1.EncryptedSecret, namespaces []string, cfg providers.Config,
+	policies []providers.Policy, namespacePolicies map[string][]providers.Policy, primaryKeyVersion, driftPolicy string) string {
+
+	hash := sha256.New()
+	_ = json.NewEncoder(hash).Encode(struct {
+		Fingerprint       string
+		Namespaces        []string
+		NamespacePolicies map[string][]providers.Policy
+	}{
+		Fingerprint:       fingerprint(encryptedSecret, cfg, policies, primaryKeyVersion, driftPolicy),
+		Namespaces:        namespaces,
+		NamespacePolicies: namespacePolicies,
+	})
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// secretUpToDate reports whether the secret key exists and still holds the
+// values written last, so that it doesn't need to be written again
+func secretUpToDate(ctx context.Context, c client.Client, key types.NamespacedName) (bool, error) {
+	secret := &corev1.Secret{}
+	if err := c.Get(ctx, key, secret); err != nil {
+		return false, client.IgnoreNotFound(err)
+	}
+	recordedHash, hashed := secret.Annotations[ContentHashAnnotation]
+	return hashed && contentHash(secret.Data) == recordedHash, nil
+}
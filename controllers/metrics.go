@@ -0,0 +1,186 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/opensecrecy/encrypted-secrets/pkg/providers"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var (
+	providerOperations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "encryptedsecrets_provider_operations_total",
+		Help: "Number of encrypt and decrypt calls to the providers by outcome",
+	}, []string{"provider", "operation", "outcome"})
+	providerOperationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "encryptedsecrets_provider_operation_duration_seconds",
+		Help:    "Latency of the calls to the providers, including the round trip to KMS",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+	}, []string{"provider", "operation"})
+	resourcesByStatus = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "encryptedsecrets_resources",
+		Help: "Number of EncryptedSecrets and ClusterEncryptedSecrets by status",
+	}, []string{"kind", "status"})
+	lastSuccessfulSync = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "encryptedsecrets_last_successful_sync_timestamp_seconds",
+		Help: "Unix time the secret of a resource was last synced successfully",
+	}, []string{"kind", "namespace", "name"})
+	decryptionCache = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "encryptedsecrets_decryption_cache_total",
+		Help: "Number of reconciliations that skipped decryption because nothing changed (hit) or decrypted (miss)",
+	}, []string{"kind", "result"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(providerOperations, providerOperationDuration, resourcesByStatus,
+		lastSuccessfulSync, decryptionCache)
+}
+
+// Operations and outcomes of the provider metrics
+const (
+	operationEncrypt           = "encrypt"
+	operationDecrypt           = "decrypt"
+	operationPrimaryKeyVersion = "primary_key_version"
+
+	outcomeSuccess   = "success"
+	outcomeError     = "error"
+	outcomeForbidden = "forbidden"
+)
+
+// instrument returns provider reporting its calls to the provider metrics and
+// as spans under name
+func instrument(provider providers.Provider, name string) providers.Provider {
+	return &instrumentedProvider{provider: provider, name: name}
+}
+
+type instrumentedProvider struct {
+	provider providers.Provider
+	name     string
+}
+
+// start starts the span of a call of operation
+func (p *instrumentedProvider) start(ctx context.Context, operation string) (context.Context, trace.Span, time.Time) {
+	ctx, span := tracer.Start(ctx, "Provider."+operation, trace.WithAttributes(
+		attributeProvider.String(p.name),
+		attributeOperation.String(operation),
+	))
+	return ctx, span, time.Now()
+}
+
+// observe records a call of operation that started at start and returned err
+func (p *instrumentedProvider) observe(span trace.Span, operation string, start time.Time, err error) {
+	outcome := outcomeSuccess
+	switch {
+	case providers.IsPolicyError(err):
+		outcome = outcomeForbidden
+	case err != nil:
+		outcome = outcomeError
+	}
+	providerOperations.WithLabelValues(p.name, operation, outcome).Inc()
+	providerOperationDuration.WithLabelValues(p.name, operation).Observe(time.Since(start).Seconds())
+
+	span.SetAttributes(attributeOutcome.String(outcome))
+	endSpan(span, err)
+}
+
+func (p *instrumentedProvider) Encrypt(ctx context.Context, value string) (string, error) {
+	ctx, span, start := p.start(ctx, operationEncrypt)
+	encoded, err := p.provider.Encrypt(ctx, value)
+	p.observe(span, operationEncrypt, start, err)
+	return encoded, err
+}
+
+func (p *instrumentedProvider) Decrypt(ctx context.Context, encoded string) (string, string, error) {
+	ctx, span, start := p.start(ctx, operationDecrypt)
+	decoded, keyVersion, err := p.provider.Decrypt(ctx, encoded)
+	p.observe(span, operationDecrypt, start, err)
+	return decoded, keyVersion, err
+}
+
+func (p *instrumentedProvider) PrimaryKeyVersion(ctx context.Context) (string, error) {
+	ctx, span, start := p.start(ctx, operationPrimaryKeyVersion)
+	keyVersion, err := p.provider.PrimaryKeyVersion(ctx)
+	p.observe(span, operationPrimaryKeyVersion, start, err)
+	return keyVersion, err
+}
+
+// resourceMetrics keeps the metrics about the resources of one kind
+type resourceMetrics struct {
+	kind string
+
+	mu       sync.Mutex
+	statuses map[types.NamespacedName]string
+}
+
+var (
+	encryptedSecretMetrics        = newResourceMetrics("EncryptedSecret")
+	clusterEncryptedSecretMetrics = newResourceMetrics("ClusterEncryptedSecret")
+)
+
+func newResourceMetrics(kind string) *resourceMetrics {
+	return &resourceMetrics{kind: kind, statuses: map[types.NamespacedName]string{}}
+}
+
+// observe counts the resource called name under status
+func (m *resourceMetrics) observe(name types.NamespacedName, status string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	old, known := m.statuses[name]
+	if known && old == status {
+		return
+	}
+	if known {
+		resourcesByStatus.WithLabelValues(m.kind, old).Dec()
+	}
+	m.statuses[name] = status
+	resourcesByStatus.WithLabelValues(m.kind, status).Inc()
+}
+
+// forget drops the deleted resource called name from the metrics
+func (m *resourceMetrics) forget(name types.NamespacedName) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if old, known := m.statuses[name]; known {
+		resourcesByStatus.WithLabelValues(m.kind, old).Dec()
+		delete(m.statuses, name)
+	}
+	lastSuccessfulSync.DeleteLabelValues(m.kind, name.Namespace, name.Name)
+}
+
+// synced records a successful sync of the secret of the resource called name
+func (m *resourceMetrics) synced(name types.NamespacedName) {
+	lastSuccessfulSync.WithLabelValues(m.kind, name.Namespace, name.Name).SetToCurrentTime()
+}
+
+// cacheResult counts a reconciliation that skipped decryption when hit is set,
+// or decrypted otherwise
+func (m *resourceMetrics) cacheResult(hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	decryptionCache.WithLabelValues(m.kind, result).Inc()
+}
@@ -0,0 +1,104 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/opensecrecy/encrypted-secrets/pkg/providers"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	secretsv1alpha1 "github.com/opensecrecy/encrypted-secrets/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// namespaceMatcher returns a function reporting whether a namespace is selected by
+// selector, either by name or by its labels
+func namespaceMatcher(selector *secretsv1alpha1.NamespaceSelector) (func(*corev1.Namespace) bool, error) {
+	labelSelector := labels.Nothing()
+	if selector.LabelSelector != nil {
+		var err error
+		labelSelector, err = metav1.LabelSelectorAsSelector(selector.LabelSelector)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	names := make(map[string]bool, len(selector.Names))
+	for _, name := range selector.Names {
+		names[name] = true
+	}
+
+	return func(namespace *corev1.Namespace) bool {
+		return names[namespace.Name] || labelSelector.Matches(labels.Set(namespace.Labels))
+	}, nil
+}
+
+// namespaceAllowed reports whether the namespace called name is selected by selector
+func namespaceAllowed(ctx context.Context, c client.Client, name string, selector *secretsv1alpha1.NamespaceSelector) (bool, error) {
+	matches, err := namespaceMatcher(selector)
+	if err != nil {
+		return false, err
+	}
+	namespace := &corev1.Namespace{}
+	if err := c.Get(ctx, types.NamespacedName{Name: name}, namespace); err != nil {
+		return false, fmt.Errorf("failed to get namespace %s %v", name, err)
+	}
+	return matches(namespace), nil
+}
+
+// namespacePolicies returns the policies for the EncryptedSecrets of the namespace
+// called name: operatorPolicy, and the one in its annotations when it has one.
+// Both apply, so the annotations can only narrow what the operator allows.
+func namespacePolicies(ctx context.Context, c client.Client, name string, operatorPolicy providers.Policy) ([]providers.Policy, error) {
+	namespace := &corev1.Namespace{}
+	if err := c.Get(ctx, types.NamespacedName{Name: name}, namespace); err != nil {
+		return nil, fmt.Errorf("failed to get namespace %s %v", name, err)
+	}
+	if policy, ok := providers.PolicyFromAnnotations(namespace); ok {
+		return []providers.Policy{operatorPolicy, policy}, nil
+	}
+	return []providers.Policy{operatorPolicy}, nil
+}
+
+// checkPolicies returns a PolicyError unless every policy allows the provider
+// called provider and every key of keyIDs
+func checkPolicies(policies []providers.Policy, provider string, keyIDs []string) error {
+	for _, policy := range policies {
+		if err := policy.CheckProvider(provider); err != nil {
+			return err
+		}
+		for _, keyID := range keyIDs {
+			if err := policy.CheckKeyID(keyID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// errorStatus returns the status reporting err, Forbidden when a policy refused it
+func errorStatus(err error) string {
+	if providers.IsPolicyError(err) {
+		return secretsv1alpha1.EncryptedSecretStatusForbidden
+	}
+	return secretsv1alpha1.EncryptedSecretStatusError
+}
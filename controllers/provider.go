@@ -0,0 +1,388 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/opensecrecy/encrypted-secrets/pkg/providers"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	secretsv1alpha1 "github.com/opensecrecy/encrypted-secrets/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// keyVersionTTL is how long the primary key version of a provider is reused.
+// Retargeting a KMS alias is noticed after it passed.
+const keyVersionTTL = 5 * time.Minute
+
+const (
+	// keys of the secret referenced by the SecretRef auth method of aws-kms
+	awsAccessKeyIDKey     = "access-key-id"
+	awsSecretAccessKeyKey = "secret-access-key"
+	awsSessionTokenKey    = "session-token"
+)
+
+// newProviderFor returns the provider of obj, either the one referenced by ref or
+// the one selected by the annotations of obj. namespace holds the keys of the k8s
+// provider when the provider doesn't name a namespace itself. The provider is
+// restricted by policies and by the policy of the referenced provider. It
+// encrypts deterministically when obj asks for it. operatorAWSCredentials lets
+// namespaced EncryptionProviders use the AWS credentials of the operator.
+func newProviderFor(ctx context.Context, c client.Client, obj metav1.Object, ref *secretsv1alpha1.ProviderReference, namespace string,
+	operatorAWSCredentials bool, policies ...providers.Policy) (providers.Provider, error) {
+
+	cfg, policies, err := resolveProvider(ctx, c, obj, ref, namespace, policies...)
+	if err != nil {
+		return nil, err
+	}
+	cfg.OperatorAWSCredentials = operatorAWSCredentials
+	// the mode of encryption belongs to the object, not the provider
+	cfg.Deterministic = providers.ConfigFromAnnotations(obj).Deterministic
+	return buildProvider(ctx, cfg, policies)
+}
+
+// buildProvider returns the provider configured by cfg, restricted by policies
+func buildProvider(ctx context.Context, cfg providers.Config, policies []providers.Policy) (providers.Provider, error) {
+	// the k8s provider reads its keys here, aws-kms loads its credentials
+	ctx, span := tracer.Start(ctx, "Provider.New", trace.WithAttributes(attributeProvider.String(cfg.Provider)))
+	provider, err := providers.NewProvider(ctx, cfg)
+	endSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+	instrumented := instrument(providers.WithPolicies(provider, policies...), cfg.Provider)
+	// the primary key of aws-kms is a DescribeKey call, the other providers know it
+	// once they are built
+	if cfg.Provider == providers.AWSKMSProvider {
+		return primaryKeyVersions.wrap(instrumented, cfg), nil
+	}
+	return instrumented, nil
+}
+
+// keyVersionCache remembers the primary key versions of providers for
+// keyVersionTTL, so that reconciliations skipping unchanged resources don't call
+// KMS. Providers are told apart by their whole configuration.
+type keyVersionCache struct {
+	mu       sync.Mutex
+	versions map[string]cachedKeyVersion
+}
+
+type cachedKeyVersion struct {
+	version string
+	expires time.Time
+}
+
+// primaryKeyVersions is shared by the providers of all reconcilers
+var primaryKeyVersions = &keyVersionCache{versions: map[string]cachedKeyVersion{}}
+
+// wrap returns provider with its primary key version cached under cfg
+func (c *keyVersionCache) wrap(provider providers.Provider, cfg providers.Config) providers.Provider {
+	// the configuration may hold credentials, so only its hash is kept
+	encoded, err := json.Marshal(struct {
+		KMSKeyID    string
+		Region      string
+		RoleARN     string
+		Credentials aws.CredentialsProvider
+	}{
+		KMSKeyID:    cfg.KMSKeyID,
+		Region:      cfg.Region,
+		RoleARN:     cfg.RoleARN,
+		Credentials: cfg.Credentials,
+	})
+	if err != nil {
+		return provider
+	}
+	hash := sha256.Sum256(encoded)
+	return &keyVersionCachingProvider{Provider: provider, cache: c, key: hex.EncodeToString(hash[:])}
+}
+
+func (c *keyVersionCache) get(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cached, ok := c.versions[key]
+	if !ok || time.Now().After(cached.expires) {
+		delete(c.versions, key)
+		return "", false
+	}
+	return cached.version, true
+}
+
+func (c *keyVersionCache) set(key, version string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.versions[key] = cachedKeyVersion{version: version, expires: time.Now().Add(keyVersionTTL)}
+}
+
+// keyVersionCachingProvider answers PrimaryKeyVersion from its cache. Failures
+// aren't cached.
+type keyVersionCachingProvider struct {
+	providers.Provider
+	cache *keyVersionCache
+	key   string
+}
+
+func (p *keyVersionCachingProvider) PrimaryKeyVersion(ctx context.Context) (string, error) {
+	if version, ok := p.cache.get(p.key); ok {
+		return version, nil
+	}
+	version, err := p.Provider.PrimaryKeyVersion(ctx)
+	if err != nil {
+		return "", err
+	}
+	p.cache.set(p.key, version)
+	return version, nil
+}
+
+// resolveProvider returns the configuration of the provider of obj like
+// newProviderFor, together with every policy restricting it. It fails when a
+// policy doesn't allow the provider. The configuration is the one of the
+// decrypting controllers, which ignore the deterministic annotation.
+func resolveProvider(ctx context.Context, c client.Client, obj metav1.Object, ref *secretsv1alpha1.ProviderReference, namespace string,
+	policies ...providers.Policy) (providers.Config, []providers.Policy, error) {
+
+	var cfg providers.Config
+	if ref == nil {
+		cfg = providers.ConfigFromAnnotations(obj)
+		cfg.Namespace = namespace
+	} else {
+		var providerPolicy providers.Policy
+		var err error
+		cfg, providerPolicy, err = providerConfig(ctx, c, obj, ref, namespace)
+		if err != nil {
+			return providers.Config{}, nil, err
+		}
+		policies = append(policies, providerPolicy)
+	}
+	// decrypting doesn't depend on it, and --rotate-keys re-encrypts with the
+	// randomized encryption every provider supports
+	cfg.Deterministic = false
+
+	for _, policy := range policies {
+		if err := policy.CheckProvider(cfg.Provider); err != nil {
+			return providers.Config{}, nil, err
+		}
+	}
+	return cfg, policies, nil
+}
+
+// providerConfig resolves ref into the configuration and policy of the provider it
+// references. Namespaced objects may only reference a ClusterEncryptionProvider
+// that allows their namespace.
+func providerConfig(ctx context.Context, c client.Client, obj metav1.Object, ref *secretsv1alpha1.ProviderReference, namespace string) (providers.Config, providers.Policy, error) {
+	switch ref.Kind {
+	case "", secretsv1alpha1.EncryptionProviderKind:
+		if namespace == "" {
+			return providers.Config{}, providers.Policy{}, fmt.Errorf("cluster scoped resources can only reference a %s", secretsv1alpha1.ClusterEncryptionProviderKind)
+		}
+		provider := &secretsv1alpha1.EncryptionProvider{}
+		if err := c.Get(ctx, types.NamespacedName{Namespace: namespace, Name: ref.Name}, provider); err != nil {
+			return providers.Config{}, providers.Policy{}, fmt.Errorf("failed to get %s %s %w", secretsv1alpha1.EncryptionProviderKind, ref.Name, err)
+		}
+		cfg, err := configFromSpec(ctx, c, provider.Spec, namespace, false)
+		return cfg, specPolicy(provider.Spec), err
+
+	case secretsv1alpha1.ClusterEncryptionProviderKind:
+		provider := &secretsv1alpha1.ClusterEncryptionProvider{}
+		if err := c.Get(ctx, types.NamespacedName{Name: ref.Name}, provider); err != nil {
+			return providers.Config{}, providers.Policy{}, fmt.Errorf("failed to get %s %s %w", secretsv1alpha1.ClusterEncryptionProviderKind, ref.Name, err)
+		}
+		if obj.GetNamespace() != "" && provider.Spec.AllowedNamespaces != nil {
+			allowed, err := namespaceAllowed(ctx, c, obj.GetNamespace(), provider.Spec.AllowedNamespaces)
+			if err != nil {
+				return providers.Config{}, providers.Policy{}, err
+			}
+			if !allowed {
+				return providers.Config{}, providers.Policy{}, providers.NewPolicyError(fmt.Sprintf("namespace %s may not use %s %s",
+					obj.GetNamespace(), secretsv1alpha1.ClusterEncryptionProviderKind, ref.Name))
+			}
+		}
+		cfg, err := configFromSpec(ctx, c, provider.Spec.EncryptionProviderSpec, namespace, true)
+		return cfg, specPolicy(provider.Spec.EncryptionProviderSpec), err
+
+	default:
+		return providers.Config{}, providers.Policy{}, fmt.Errorf("invalid provider kind %s", ref.Kind)
+	}
+}
+
+// configFromSpec turns spec into a provider configuration. Secrets referenced by a
+// namespaced provider always live in namespace, those referenced by a cluster
+// scoped provider live in the namespace they must name.
+func configFromSpec(ctx context.Context, c client.Client, spec secretsv1alpha1.EncryptionProviderSpec, namespace string, clusterScoped bool) (providers.Config, error) {
+	if clusterScoped {
+		if err := checkSecretNamespaces(spec); err != nil {
+			return providers.Config{}, err
+		}
+	}
+	secretNamespace := func(ref *secretsv1alpha1.SecretReference) string {
+		if clusterScoped {
+			return ref.Namespace
+		}
+		return namespace
+	}
+
+	cfg := providers.Config{Provider: spec.Type, Namespace: namespace}
+
+	switch spec.Type {
+	case providers.K8sProvider:
+		if spec.K8s != nil && spec.K8s.KeySecretRef != nil {
+			cfg.KeySecretName = spec.K8s.KeySecretRef.Name
+			cfg.Namespace = secretNamespace(spec.K8s.KeySecretRef)
+		}
+		if cfg.Namespace == "" {
+			return providers.Config{}, fmt.Errorf("no namespace for the keys of the %s provider", spec.Type)
+		}
+
+	case providers.AWSKMSProvider:
+		// a namespaced provider may only use the credentials of the operator, or
+		// assume a role with them, when they are enabled for every namespace
+		cfg.NamespacedAWSAuth = !clusterScoped
+		if spec.AWSKMS == nil {
+			return cfg, nil
+		}
+		cfg.KMSKeyID = spec.AWSKMS.KeyID
+		cfg.Region = spec.AWSKMS.Region
+		if err := setAWSAuth(ctx, c, &cfg, spec.AWSKMS.Auth, secretNamespace); err != nil {
+			return providers.Config{}, err
+		}
+
+	case providers.SOPSProvider:
+		sopsSpec := spec.Sops
+		if sopsSpec == nil {
+			sopsSpec = &secretsv1alpha1.SOPSProviderSpec{}
+		}
+		// the provider reads both key secrets from a single namespace
+		var keyNamespaces []string
+		if ref := sopsSpec.AgeKeySecretRef; ref != nil {
+			cfg.KeySecretName = ref.Name
+			keyNamespaces = append(keyNamespaces, secretNamespace(ref))
+		}
+		if ref := sopsSpec.PGPKeySecretRef; ref != nil {
+			cfg.PGPKeySecretName = ref.Name
+			keyNamespaces = append(keyNamespaces, secretNamespace(ref))
+		}
+		if len(keyNamespaces) == 2 && keyNamespaces[0] != keyNamespaces[1] {
+			return providers.Config{}, fmt.Errorf("the age and PGP key secrets of the %s provider must be in the same namespace", spec.Type)
+		}
+		if len(keyNamespaces) > 0 {
+			cfg.Namespace = keyNamespaces[0]
+		}
+		if cfg.Namespace == "" {
+			return providers.Config{}, fmt.Errorf("no namespace for the keys of the %s provider", spec.Type)
+		}
+
+		if sopsSpec.KMS != nil {
+			cfg.Region = sopsSpec.KMS.Region
+			if err := setAWSAuth(ctx, c, &cfg, sopsSpec.KMS.Auth, secretNamespace); err != nil {
+				return providers.Config{}, err
+			}
+			// a namespaced provider may only use the credentials of the operator
+			// when they are enabled for every sops provider
+			cfg.SOPSKMS = clusterScoped || sopsSpec.KMS.Auth.Method == secretsv1alpha1.AWSAuthMethodSecretRef
+		}
+	}
+
+	return cfg, nil
+}
+
+// checkSecretNamespaces makes sure every secret referenced by the spec of a cluster
+// scoped provider names its namespace, so that the namespace of the referencing
+// object never selects the secret. The CRD validates it as well.
+func checkSecretNamespaces(spec secretsv1alpha1.EncryptionProviderSpec) error {
+	type secretRef struct {
+		path string
+		ref  *secretsv1alpha1.SecretReference
+	}
+	var refs []secretRef
+	if spec.K8s != nil {
+		refs = append(refs, secretRef{"k8s.keySecretRef", spec.K8s.KeySecretRef})
+	}
+	if spec.AWSKMS != nil {
+		refs = append(refs, secretRef{"awsKms.auth.secretRef", spec.AWSKMS.Auth.SecretRef})
+	}
+	if spec.Sops != nil {
+		refs = append(refs, secretRef{"sops.ageKeySecretRef", spec.Sops.AgeKeySecretRef},
+			secretRef{"sops.pgpKeySecretRef", spec.Sops.PGPKeySecretRef})
+		if spec.Sops.KMS != nil {
+			refs = append(refs, secretRef{"sops.kms.auth.secretRef", spec.Sops.KMS.Auth.SecretRef})
+		}
+	}
+	for _, r := range refs {
+		if r.ref != nil && r.ref.Namespace == "" {
+			return fmt.Errorf("%s of a %s needs a namespace", r.path, secretsv1alpha1.ClusterEncryptionProviderKind)
+		}
+	}
+	return nil
+}
+
+// setAWSAuth sets the AWS credentials and role of cfg selected by auth
+func setAWSAuth(ctx context.Context, c client.Client, cfg *providers.Config, auth secretsv1alpha1.AWSAuth,
+	secretNamespace func(*secretsv1alpha1.SecretReference) string) error {
+
+	cfg.RoleARN = auth.RoleARN
+	if auth.Method != secretsv1alpha1.AWSAuthMethodSecretRef {
+		return nil
+	}
+	ref := auth.SecretRef
+	if ref == nil {
+		return fmt.Errorf("auth method %s needs a secretRef", secretsv1alpha1.AWSAuthMethodSecretRef)
+	}
+	secret := &corev1.Secret{}
+	if err := c.Get(ctx, types.NamespacedName{Namespace: secretNamespace(ref), Name: ref.Name}, secret); err != nil {
+		return fmt.Errorf("failed to get the credentials secret %v", err)
+	}
+	cfg.Credentials = credentials.NewStaticCredentialsProvider(
+		string(secret.Data[awsAccessKeyIDKey]),
+		string(secret.Data[awsSecretAccessKeyKey]),
+		string(secret.Data[awsSessionTokenKey]),
+	)
+	return nil
+}
+
+// specPolicy returns the policy of a provider spec
+func specPolicy(spec secretsv1alpha1.EncryptionProviderSpec) providers.Policy {
+	return providers.Policy{KeyIDs: spec.AllowedKeyIDs}
+}
+
+// checkProvider makes sure the provider configured by spec can be used and returns
+// the version of its primary key. operatorAWSCredentials lets a namespaced
+// provider use the AWS credentials of the operator.
+func checkProvider(ctx context.Context, c client.Client, spec secretsv1alpha1.EncryptionProviderSpec, namespace string,
+	clusterScoped, operatorAWSCredentials bool) (string, error) {
+
+	cfg, err := configFromSpec(ctx, c, spec, namespace, clusterScoped)
+	if err != nil {
+		return "", err
+	}
+	cfg.OperatorAWSCredentials = operatorAWSCredentials
+	provider, err := providers.NewProvider(ctx, cfg)
+	if err != nil {
+		return "", err
+	}
+	return provider.PrimaryKeyVersion(ctx)
+}
@@ -0,0 +1,98 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/opensecrecy/encrypted-secrets/pkg/providers"
+)
+
+const (
+	// readyCheckInterval is how long the result of a provider check is reused, so
+	// that readiness probes don't call KMS every few seconds
+	readyCheckInterval = time.Minute
+	// readyCheckTimeout bounds a single provider check
+	readyCheckTimeout = 5 * time.Second
+)
+
+// ProviderChecker reports whether a provider can be used on the readiness endpoint.
+// Its Check loads the keys of the provider, which reads the key secret of the k8s
+// provider and calls DescribeKey on the key of aws-kms.
+type ProviderChecker struct {
+	Config providers.Config
+
+	mu      sync.Mutex
+	checked time.Time
+	err     error
+}
+
+// Check implements healthz.Checker
+func (c *ProviderChecker) Check(req *http.Request) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.checked.IsZero() && time.Since(c.checked) < readyCheckInterval {
+		return c.err
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), readyCheckTimeout)
+	defer cancel()
+	c.err = c.check(ctx)
+	c.checked = time.Now()
+	return c.err
+}
+
+func (c *ProviderChecker) check(ctx context.Context) error {
+	provider, err := providers.NewProvider(ctx, c.Config)
+	if err != nil {
+		return fmt.Errorf("provider %s is not ready %v", c.Config.Provider, err)
+	}
+	if _, err := provider.PrimaryKeyVersion(ctx); err != nil {
+		return fmt.Errorf("provider %s is not ready %v", c.Config.Provider, err)
+	}
+	return nil
+}
+
+// ParseReadyProviders parses the comma separated providers checked for readiness.
+// Every provider is given as k8s:<namespace>, k8s:<namespace>/<key secret> or
+// aws-kms:<key id, alias or ARN>.
+func ParseReadyProviders(value string) ([]providers.Config, error) {
+	var configs []providers.Config
+	for _, item := range providers.ParsePolicyList(value) {
+		name, argument, found := strings.Cut(item, ":")
+		if !found || argument == "" {
+			return nil, fmt.Errorf("invalid provider %q, expected <provider>:<argument>", item)
+		}
+
+		switch name {
+		case providers.K8sProvider:
+			namespace, keySecretName, _ := strings.Cut(argument, "/")
+			configs = append(configs, providers.Config{Provider: name, Namespace: namespace, KeySecretName: keySecretName})
+		case providers.AWSKMSProvider:
+			configs = append(configs, providers.Config{Provider: name, KMSKeyID: argument})
+		default:
+			return nil, fmt.Errorf("invalid provider %s", name)
+		}
+	}
+	return configs, nil
+}
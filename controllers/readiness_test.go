@@ -0,0 +1,62 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/opensecrecy/encrypted-secrets/pkg/providers"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var _ = Describe("Readiness", func() {
+
+	Context("Verify provider checks", func() {
+		ctx := context.Background()
+
+		It("Parse the providers to check", func() {
+			configs, err := ParseReadyProviders("k8s:default, k8s:keys/my-keyring,aws-kms:arn:aws:kms:eu-west-1:111122223333:key/1234")
+			Expect(err).To(BeNil())
+			Expect(configs).To(Equal([]providers.Config{
+				{Provider: providers.K8sProvider, Namespace: "default"},
+				{Provider: providers.K8sProvider, Namespace: "keys", KeySecretName: "my-keyring"},
+				{Provider: providers.AWSKMSProvider, KMSKeyID: "arn:aws:kms:eu-west-1:111122223333:key/1234"},
+			}))
+
+			_, err = ParseReadyProviders("k8s")
+			Expect(err).NotTo(BeNil())
+			_, err = ParseReadyProviders("vault:secret")
+			Expect(err).NotTo(BeNil())
+		})
+
+		It("Report a provider without its key secret as not ready", func() {
+			err := k8sClient.Create(ctx, &corev1.Namespace{
+				ObjectMeta: metav1.ObjectMeta{Name: "readiness"},
+			})
+			Expect(client.IgnoreAlreadyExists(err)).To(Succeed())
+
+			checker := &ProviderChecker{Config: providers.Config{Provider: providers.K8sProvider, Namespace: "readiness"}}
+			Expect(checker.Check(httptest.NewRequest("GET", "/readyz", nil))).NotTo(Succeed())
+		})
+	})
+})
@@ -0,0 +1,69 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+const (
+	// DefaultRefreshInterval is how often secrets are decrypted again when neither
+	// the resource nor the operator sets a refresh interval
+	DefaultRefreshInterval = time.Hour
+
+	// retryBaseInterval is the delay after the first failure, it doubles with
+	// every further failure up to retryMaxInterval
+	retryBaseInterval = 5 * time.Second
+	retryMaxInterval  = 10 * time.Minute
+	// retryJitter spreads out the retries of resources that failed together,
+	// e.g. because their KMS endpoint was unavailable
+	retryJitter = 0.2
+)
+
+// refreshResult requeues a resource after its refresh interval, or the default
+// interval when it doesn't set one. An interval of 0 disables refreshing.
+func refreshResult(interval *metav1.Duration, defaultInterval time.Duration) ctrl.Result {
+	if interval != nil {
+		defaultInterval = interval.Duration
+	}
+	if defaultInterval <= 0 {
+		return ctrl.Result{}
+	}
+	return ctrl.Result{RequeueAfter: wait.Jitter(defaultInterval, retryJitter)}
+}
+
+// retryResult requeues a resource after its failures-th failure in a row with
+// an exponential backoff. The refresh interval bounds the backoff when it is
+// shorter than retryMaxInterval.
+func retryResult(failures int32, interval *metav1.Duration, defaultInterval time.Duration) ctrl.Result {
+	backoff := retryBaseInterval
+	for i := int32(1); i < failures && backoff < retryMaxInterval; i++ {
+		backoff *= 2
+	}
+	if backoff > retryMaxInterval {
+		backoff = retryMaxInterval
+	}
+	if refresh := refreshResult(interval, defaultInterval).RequeueAfter; refresh > 0 && refresh < backoff {
+		backoff = refresh
+	}
+	return ctrl.Result{RequeueAfter: wait.Jitter(backoff, retryJitter)}
+}
@@ -0,0 +1,208 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+
+	secretsv1alpha1 "github.com/opensecrecy/encrypted-secrets/api/v1alpha1"
+	"go.opentelemetry.io/otel/trace"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// ContentHashAnnotation holds the hash of the values last written to a secret, so
+// that changes made by hand can be detected
+const ContentHashAnnotation = "secrets.opensecrecy.org/content-hash"
+
+// secretConflictError is returned when the secret to write is controlled by
+// another owner
+type secretConflictError struct {
+	msg string
+}
+
+func (e *secretConflictError) Error() string {
+	return e.msg
+}
+
+// isSecretConflict reports whether err was returned because the secret is
+// controlled by another owner
+func isSecretConflict(err error) bool {
+	var conflictErr *secretConflictError
+	return errors.As(err, &conflictErr)
+}
+
+// secretWrite reports what writeSecret did
+type secretWrite struct {
+	// Result tells whether the secret was created, updated or left unchanged
+	Result controllerutil.OperationResult
+	// Drifted is set when the values of the secret were changed by hand
+	Drifted bool
+}
+
+// writeSecret creates or updates the secret named after owner in namespace, fills
+// it with the decrypted values and makes owner its owner. Values changed by hand
+// are handled according to driftPolicy.
+func writeSecret(ctx context.Context, c client.Client, scheme *runtime.Scheme, owner client.Object, namespace string,
+	labels map[string]string, decryptedObj *secretsv1alpha1.DecryptedSecret, driftPolicy string) (secretWrite, error) {
+
+	ctx, span := tracer.Start(ctx, "Secret.Write", trace.WithAttributes(
+		attributeNamespace.String(namespace),
+		attributeName.String(owner.GetName()),
+		attributeKeyCount.Int(len(decryptedObj.Data)),
+	))
+
+	// create a secret to hold the decrypted secrets
+	secretInstance := corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      owner.GetName(),
+			Namespace: namespace,
+		},
+	}
+
+	// map to hold decryptedData in map[string][]byte format
+	// ToDo: figure out optimal way to do this. There is absolutely no need to increase space complexity here
+	decryptedData := make(map[string][]byte)
+	for key, value := range decryptedObj.Data {
+		decryptedData[key] = []byte(value)
+	}
+
+	var write secretWrite
+	result, err := controllerutil.CreateOrUpdate(ctx, c, &secretInstance, func() error {
+		// never overwrite a secret another controller manages
+		if controller := metav1.GetControllerOf(&secretInstance); controller != nil && controller.UID != owner.GetUID() {
+			return &secretConflictError{msg: fmt.Sprintf("secret %s/%s is managed by %s %s",
+				namespace, secretInstance.Name, controller.Kind, controller.Name)}
+		}
+
+		// secrets written before the content hash was introduced can't have drifted
+		recordedHash, hashed := secretInstance.Annotations[ContentHashAnnotation]
+		write.Drifted = secretInstance.ResourceVersion != "" && hashed && contentHash(secretInstance.Data) != recordedHash
+
+		if write.Drifted {
+			switch driftPolicy {
+			case secretsv1alpha1.DriftPolicyWarn:
+				// keep the changes until the encrypted values change
+				if contentHash(decryptedData) == recordedHash {
+					return nil
+				}
+			case secretsv1alpha1.DriftPolicyMerge:
+				for key, value := range secretInstance.Data {
+					if _, ok := decryptedData[key]; !ok {
+						decryptedData[key] = value
+					}
+				}
+			}
+		}
+
+		// the type of a secret can't be changed once it exists
+		if secretInstance.ResourceVersion == "" {
+			secretInstance.Type = decryptedObj.Type
+		}
+
+		// set Labels and Annotations
+		secretInstance.Labels = labels
+		secretInstance.Annotations = map[string]string{}
+		for key, value := range owner.GetAnnotations() {
+			secretInstance.Annotations[key] = value
+		}
+		secretInstance.Annotations[ContentHashAnnotation] = contentHash(decryptedData)
+
+		// Add the data
+		secretInstance.Data = decryptedData
+
+		// set ownerReference
+		if err := controllerutil.SetOwnerReference(owner, &secretInstance, scheme); err != nil {
+			return fmt.Errorf("error setting owner reference %s", err.Error())
+		}
+		return nil
+	})
+	write.Result = result
+	span.SetAttributes(attributeOutcome.String(string(result)))
+	endSpan(span, err)
+	return write, err
+}
+
+// deleteOwnedSecret deletes the secret named after owner in namespace when owner
+// wrote it. Secrets owner doesn't reference are left alone.
+func deleteOwnedSecret(ctx context.Context, c client.Client, owner client.Object, namespace string) (bool, error) {
+	secret := &corev1.Secret{}
+	if err := c.Get(ctx, types.NamespacedName{Namespace: namespace, Name: owner.GetName()}, secret); err != nil {
+		return false, client.IgnoreNotFound(err)
+	}
+	for _, ref := range secret.OwnerReferences {
+		if ref.UID == owner.GetUID() {
+			return true, client.IgnoreNotFound(c.Delete(ctx, secret))
+		}
+	}
+	return false, nil
+}
+
+// resolveDriftPolicy returns policy, or defaultPolicy when it isn't set
+func resolveDriftPolicy(policy, defaultPolicy string) string {
+	if policy != "" {
+		return policy
+	}
+	if defaultPolicy != "" {
+		return defaultPolicy
+	}
+	return secretsv1alpha1.DriftPolicyOverwrite
+}
+
+// recordDrift emits an event on owner about the changes made by hand to its secret
+// in namespace and reports whether they were kept
+func recordDrift(recorder record.EventRecorder, owner client.Object, namespace string, write secretWrite) bool {
+	if !write.Drifted {
+		return false
+	}
+	if write.Result == controllerutil.OperationResultNone {
+		recorder.Eventf(owner, corev1.EventTypeWarning, ReasonDriftDetected,
+			"secret %s/%s was changed by hand, keeping the changes", namespace, owner.GetName())
+		return true
+	}
+	recorder.Eventf(owner, corev1.EventTypeNormal, ReasonDriftCorrected,
+		"restored secret %s/%s after it was changed by hand", namespace, owner.GetName())
+	return false
+}
+
+// contentHash returns the sha256 hash of the keys and values of data
+func contentHash(data map[string][]byte) string {
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	hash := sha256.New()
+	for _, key := range keys {
+		hash.Write([]byte(key))
+		hash.Write([]byte{0})
+		hash.Write(data[key])
+		hash.Write([]byte{0})
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
@@ -0,0 +1,73 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	corev1 "k8s.io/api/core/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+// SecretEncryptionReconciler moves the values of secrets encrypted on admission
+// into EncryptedSecrets of the same name. The EncryptedSecretReconciler then takes
+// the secret over and writes the decrypted values back.
+type SecretEncryptionReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+	log    logr.Logger
+}
+
+func (r *SecretEncryptionReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	r.log = log.FromContext(ctx).WithValues("Secret", req.NamespacedName)
+	r.log.Info("Started secret encryption reconciliation")
+
+	secret := &corev1.Secret{}
+
+	if err := r.Get(ctx, req.NamespacedName, secret); err != nil {
+		r.log.Info("Unable to fetch secret object")
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	// the secret was taken over by its EncryptedSecret in the meantime
+	if secret.Labels[EncryptLabel] != "true" {
+		return ctrl.Result{}, nil
+	}
+
+	if err := storeEncryptedSecret(ctx, r.Client, secret, nil, secret.Type, secretValues(secret)); err != nil {
+		r.log.Error(err, "Failed to store encryptedsecret")
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{}, nil
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *SecretEncryptionReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("secretencryption").
+		For(&corev1.Secret{}, builder.WithPredicates(encryptedOnAdmission(), predicate.NewPredicateFuncs(func(obj client.Object) bool {
+			return obj.GetLabels()[EncryptLabel] == "true"
+		}))).
+		Complete(r)
+}
@@ -25,15 +25,19 @@ import (
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/envtest"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
 	secretsv1alpha1 "github.com/opensecrecy/encrypted-secrets/api/v1alpha1"
+	"github.com/opensecrecy/encrypted-secrets/pkg/providers"
 	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
 	//+kubebuilder:scaffold:imports
 )
@@ -45,6 +49,7 @@ var cfg *rest.Config
 var k8sClient client.Client
 var testEnv *envtest.Environment
 var reconciler *EncryptedSecretReconciler
+var clusterReconciler *ClusterEncryptedSecretReconciler
 
 func TestAPIs(t *testing.T) {
 	RegisterFailHandler(Fail)
@@ -79,9 +84,17 @@ var _ = BeforeSuite(func() {
 	Expect(k8sClient).NotTo(BeNil())
 
 	reconciler = &EncryptedSecretReconciler{
-		Client: k8sClient,
-		Scheme: scheme.Scheme,
-		log:    logf.FromContext(context.Background()),
+		Client:   k8sClient,
+		Scheme:   scheme.Scheme,
+		log:      logf.FromContext(context.Background()),
+		Recorder: record.NewFakeRecorder(100),
+	}
+
+	clusterReconciler = &ClusterEncryptedSecretReconciler{
+		Client:   k8sClient,
+		Scheme:   scheme.Scheme,
+		log:      logf.FromContext(context.Background()),
+		Recorder: record.NewFakeRecorder(100),
 	}
 
 })
@@ -123,3 +136,13 @@ var _ = AfterSuite(func() {
 	// delete the kubeconfig file
 	Expect(os.Remove("../kubeconfig")).To(Succeed())
 })
+
+// createKeyNamespace creates the namespace name with the key secret of the k8s
+// provider, so that a spec doesn't depend on the fixtures of another
+func createKeyNamespace(ctx context.Context, name string) {
+	Expect(k8sClient.Create(ctx, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}})).To(Succeed())
+	Expect(k8sClient.Create(ctx, &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: providers.K8sKeySecretName, Namespace: name},
+		Data:       map[string][]byte{"tls.crt": []byte("justRandomEncryptionKey")},
+	})).To(Succeed())
+}
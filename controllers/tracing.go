@@ -0,0 +1,47 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the spans of the controllers. The spans carry names, counts and
+// outcomes, never values.
+var tracer = otel.Tracer("github.com/opensecrecy/encrypted-secrets/controllers")
+
+// Attributes of the spans
+const (
+	attributeProvider  = attribute.Key("encryptedsecrets.provider")
+	attributeOperation = attribute.Key("encryptedsecrets.operation")
+	attributeKeyCount  = attribute.Key("encryptedsecrets.key_count")
+	attributeOutcome   = attribute.Key("encryptedsecrets.outcome")
+	attributeNamespace = attribute.Key("k8s.namespace.name")
+	attributeName      = attribute.Key("encryptedsecrets.name")
+)
+
+// endSpan records err on span and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
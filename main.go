@@ -17,8 +17,11 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"os"
+	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
@@ -28,11 +31,16 @@ import (
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
 	secretsv1alpha1 "github.com/opensecrecy/encrypted-secrets/api/v1alpha1"
 	"github.com/opensecrecy/encrypted-secrets/controllers"
+	"github.com/opensecrecy/encrypted-secrets/pkg/audit"
+	"github.com/opensecrecy/encrypted-secrets/pkg/csi"
+	"github.com/opensecrecy/encrypted-secrets/pkg/providers"
+	"github.com/opensecrecy/encrypted-secrets/pkg/tracing"
 	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
 	//+kubebuilder:scaffold:imports
 )
@@ -42,6 +50,9 @@ var (
 	setupLog = ctrl.Log.WithName("setup")
 )
 
+// auditFlushTimeout bounds sending the queued audit records on shutdown
+const auditFlushTimeout = 10 * time.Second
+
 func init() {
 	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
 
@@ -53,11 +64,72 @@ func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
+	var rotateKeys bool
+	var clusterKeyNamespace string
+	var allowedProviders string
+	var allowedKeyIDs string
+	var enableWebhooks bool
+	var webhookTrialDecrypt bool
+	var driftPolicy string
+	var refreshInterval time.Duration
+	var readyProviders string
+	var tracingOpts tracing.Options
+	var auditSink string
+	var csiProviderSocket string
+	var sopsOperatorKeys bool
+	var awsOperatorCredentials bool
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.BoolVar(&rotateKeys, "rotate-keys", false,
+		"Re-encrypt EncryptedSecrets that aren't encrypted with the primary key of their provider "+
+			"and write the result back.")
+	flag.StringVar(&clusterKeyNamespace, "cluster-key-namespace", "",
+		"The namespace holding the keys of the k8s provider for ClusterEncryptedSecrets "+
+			"without a secrets.opensecrecy.org/key-namespace annotation.")
+	flag.StringVar(&allowedProviders, "allowed-providers", "",
+		"Comma separated providers every EncryptedSecret and ClusterEncryptedSecret may use, "+
+			"the policy annotations of a namespace can only narrow it. Every provider is allowed when empty.")
+	flag.StringVar(&allowedKeyIDs, "allowed-key-ids", "",
+		"Comma separated patterns of the keys every EncryptedSecret and ClusterEncryptedSecret may be "+
+			"decrypted with, the policy annotations of a namespace can only narrow it. Every key is allowed when empty.")
+	flag.BoolVar(&enableWebhooks, "enable-webhooks", false,
+		"Serve the admission webhooks. Needs a serving certificate in the certificate directory of the webhook server.")
+	flag.BoolVar(&webhookTrialDecrypt, "webhook-trial-decrypt", false,
+		"Make the validating webhook decrypt every value of an EncryptedSecret before admitting it.")
+	flag.StringVar(&driftPolicy, "drift-policy", secretsv1alpha1.DriftPolicyOverwrite,
+		"What happens to secrets changed by hand when their EncryptedSecret has no drift policy, "+
+			"one of Overwrite, Warn or Merge.")
+	flag.DurationVar(&refreshInterval, "refresh-interval", controllers.DefaultRefreshInterval,
+		"How often secrets are decrypted and written again when their EncryptedSecret has no refresh interval. "+
+			"0 disables refreshing.")
+	flag.StringVar(&readyProviders, "ready-providers", "",
+		"Comma separated providers that must be usable for the operator to be ready besides the keys of "+
+			"--cluster-key-namespace, each one as k8s:<namespace>, k8s:<namespace>/<key secret> or aws-kms:<key id>. "+
+			"EncryptionProviders and ClusterEncryptionProviders report their readiness in their status instead.")
+	flag.StringVar(&tracingOpts.Exporter, "tracing-exporter", tracing.ExporterNone,
+		"Where the traces of reconciliations and provider calls go, one of none, otlp or stdout.")
+	flag.StringVar(&tracingOpts.Endpoint, "tracing-endpoint", "",
+		"The host:port of the OTLP collector. The OTEL_EXPORTER_OTLP_* environment variables apply when empty.")
+	flag.BoolVar(&tracingOpts.Insecure, "tracing-insecure", false,
+		"Connect to the OTLP collector without TLS.")
+	flag.StringVar(&tracingOpts.File, "tracing-file", "",
+		"The file the stdout exporter appends the traces to instead of stdout.")
+	flag.StringVar(&auditSink, "audit-sink", "",
+		"Comma separated destinations of the audit log of decryptions, each one stdout, file:<path> "+
+			"or an http(s) URL the events are posted to. Nothing is audited when empty.")
+	flag.StringVar(&csiProviderSocket, "csi-provider-socket", "",
+		"The unix socket of the Secrets Store CSI driver provider, e.g. "+csi.DefaultSocketPath+". "+
+			"When set only the provider runs, mounting EncryptedSecrets into pods without writing secrets.")
+	flag.BoolVar(&sopsOperatorKeys, "sops-operator-keys", false,
+		"Let the sops provider of every namespace decrypt with the keys of the operator: the age identities of "+
+			"$SOPS_AGE_KEY or $SOPS_AGE_KEY_FILE, its AWS credentials and its gpg keyring. "+
+			"Without it only the key secrets of the namespace and the keys of EncryptionProviders are used.")
+	flag.BoolVar(&awsOperatorCredentials, "aws-operator-credentials", false,
+		"Let the aws-kms providers of EncryptionProviders use the AWS credentials of the operator with the Default "+
+			"auth method, and assume their roleArn with them. Without it they need the SecretRef auth method.")
 	opts := zap.Options{
 		Development: true,
 	}
@@ -66,6 +138,68 @@ func main() {
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
+	readyProviderConfigs, err := controllers.ParseReadyProviders(readyProviders)
+	if err != nil {
+		setupLog.Error(err, "invalid ready providers", "ready-providers", readyProviders)
+		os.Exit(1)
+	}
+
+	auditLog := ctrl.Log.WithName("audit")
+	auditor, err := audit.NewSink(auditSink, func(err error) {
+		auditLog.Error(err, "Failed to record audit event")
+	})
+	if err != nil {
+		setupLog.Error(err, "invalid audit sink", "audit-sink", auditSink)
+		os.Exit(1)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), auditFlushTimeout)
+		defer cancel()
+		if err := audit.Close(ctx, auditor); err != nil {
+			setupLog.Error(err, "problem flushing audit records")
+		}
+	}()
+
+	shutdownTracing, err := tracing.Setup(context.Background(), tracingOpts)
+	if err != nil {
+		setupLog.Error(err, "unable to set up tracing")
+		os.Exit(1)
+	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			setupLog.Error(err, "problem flushing traces")
+		}
+	}()
+
+	switch driftPolicy {
+	case secretsv1alpha1.DriftPolicyOverwrite, secretsv1alpha1.DriftPolicyWarn, secretsv1alpha1.DriftPolicyMerge:
+	default:
+		setupLog.Error(nil, "invalid drift policy", "drift-policy", driftPolicy)
+		os.Exit(1)
+	}
+
+	// policy applies to every namespace, its policy annotations can only narrow it
+	policy := providers.Policy{
+		Providers: providers.ParsePolicyList(allowedProviders),
+		KeyIDs:    providers.ParsePolicyList(allowedKeyIDs),
+	}
+
+	if csiProviderSocket != "" {
+		c, err := client.New(ctrl.GetConfigOrDie(), client.Options{Scheme: scheme})
+		if err != nil {
+			setupLog.Error(err, "unable to create client")
+			os.Exit(1)
+		}
+		setupLog.Info("starting CSI provider", "socket", csiProviderSocket)
+		provider := &controllers.CSIProvider{Client: c, Policy: policy, Audit: auditor, SOPSOperatorKeys: sopsOperatorKeys,
+			OperatorAWSCredentials: awsOperatorCredentials}
+		if err := csi.Serve(ctrl.SetupSignalHandler(), csiProviderSocket, provider); err != nil {
+			setupLog.Error(err, "problem running CSI provider")
+			os.Exit(1)
+		}
+		return
+	}
+
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme: scheme,
 		Metrics: metricsserver.Options{
@@ -92,12 +226,81 @@ func main() {
 	}
 
 	if err = (&controllers.EncryptedSecretReconciler{
+		Client:                 mgr.GetClient(),
+		Scheme:                 mgr.GetScheme(),
+		RotateKeys:             rotateKeys,
+		Policy:                 policy,
+		DriftPolicy:            driftPolicy,
+		RefreshInterval:        refreshInterval,
+		Audit:                  auditor,
+		SOPSOperatorKeys:       sopsOperatorKeys,
+		OperatorAWSCredentials: awsOperatorCredentials,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "EncryptedSecret")
+		os.Exit(1)
+	}
+	if err = (&controllers.ClusterEncryptedSecretReconciler{
+		Client:          mgr.GetClient(),
+		Scheme:          mgr.GetScheme(),
+		Policy:          policy,
+		KeyNamespace:    clusterKeyNamespace,
+		DriftPolicy:     driftPolicy,
+		RefreshInterval: refreshInterval,
+		Audit:           auditor,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "ClusterEncryptedSecret")
+		os.Exit(1)
+	}
+	if err = (&controllers.EncryptionProviderReconciler{
+		Client:                 mgr.GetClient(),
+		Scheme:                 mgr.GetScheme(),
+		OperatorAWSCredentials: awsOperatorCredentials,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "EncryptionProvider")
+		os.Exit(1)
+	}
+	if err = (&controllers.ClusterEncryptionProviderReconciler{
 		Client: mgr.GetClient(),
 		Scheme: mgr.GetScheme(),
 	}).SetupWithManager(mgr); err != nil {
-		setupLog.Error(err, "unable to create controller", "controller", "EncryptedSecret")
+		setupLog.Error(err, "unable to create controller", "controller", "ClusterEncryptionProvider")
 		os.Exit(1)
 	}
+	if enableWebhooks {
+		// the reconcilers trust the values marked as encrypted by the webhook
+		if err = (&controllers.DecryptedSecretReconciler{
+			Client: mgr.GetClient(),
+			Scheme: mgr.GetScheme(),
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "DecryptedSecret")
+			os.Exit(1)
+		}
+		if err = (&controllers.SecretEncryptionReconciler{
+			Client: mgr.GetClient(),
+			Scheme: mgr.GetScheme(),
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "SecretEncryption")
+			os.Exit(1)
+		}
+		if err = (&controllers.EncryptedSecretValidator{
+			Client:                 mgr.GetClient(),
+			Policy:                 policy,
+			TrialDecrypt:           webhookTrialDecrypt,
+			SOPSOperatorKeys:       sopsOperatorKeys,
+			OperatorAWSCredentials: awsOperatorCredentials,
+		}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "EncryptedSecret")
+			os.Exit(1)
+		}
+		if err = (&controllers.DecryptedSecretEncrypter{
+			Client:                 mgr.GetClient(),
+			Policy:                 policy,
+			OperatorAWSCredentials: awsOperatorCredentials,
+		}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "DecryptedSecret")
+			os.Exit(1)
+		}
+	}
 	//+kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
@@ -108,6 +311,18 @@ func main() {
 		setupLog.Error(err, "unable to set up ready check")
 		os.Exit(1)
 	}
+	// the default provider of ClusterEncryptedSecrets is the k8s provider of the
+	// cluster key namespace
+	if clusterKeyNamespace != "" {
+		readyProviderConfigs = append(readyProviderConfigs, providers.Config{Provider: providers.K8sProvider, Namespace: clusterKeyNamespace})
+	}
+	for i, cfg := range readyProviderConfigs {
+		name := fmt.Sprintf("provider-%d-%s", i, cfg.Provider)
+		if err := mgr.AddReadyzCheck(name, (&controllers.ProviderChecker{Config: cfg}).Check); err != nil {
+			setupLog.Error(err, "unable to set up ready check", "check", name)
+			os.Exit(1)
+		}
+	}
 
 	setupLog.Info("starting manager")
 	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
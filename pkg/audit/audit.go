@@ -0,0 +1,272 @@
+// Package audit records every decryption of the operator as JSON lines, apart
+// from the debug log. The records name resources, providers and keys but never
+// hold secret material.
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// ActionDecrypt is recorded for every decryption of an EncryptedSecret or
+	// ClusterEncryptedSecret
+	ActionDecrypt = "decrypt"
+	// ActionReencrypt is recorded when values are decrypted to re-encrypt them
+	// with the primary key
+	ActionReencrypt = "reencrypt"
+
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+
+	// TriggerCreated is recorded for the first decryption of a resource
+	TriggerCreated = "created"
+	// TriggerChanged is recorded when the values, the provider or its key changed
+	TriggerChanged = "changed"
+	// TriggerDrift is recorded when the secret was changed or deleted by hand
+	TriggerDrift = "drift"
+	// TriggerRetry is recorded when a failed decryption is retried
+	TriggerRetry = "retry"
+	// TriggerRefresh is recorded for the periodic refresh and other resyncs
+	TriggerRefresh = "refresh"
+	// TriggerMount is recorded when the CSI driver mounts the values into a pod
+	TriggerMount = "mount"
+
+	// webhookTimeout bounds the delivery of a record to a webhook
+	webhookTimeout = 5 * time.Second
+	// webhookBuffer is the number of records waiting for a webhook before new
+	// records are dropped
+	webhookBuffer = 1024
+)
+
+// Event is a single audit record
+type Event struct {
+	Time      time.Time `json:"time"`
+	Action    string    `json:"action"`
+	Kind      string    `json:"kind"`
+	Namespace string    `json:"namespace,omitempty"`
+	Name      string    `json:"name"`
+	UID       string    `json:"uid,omitempty"`
+	// Provider is the name of the provider that decrypted the values
+	Provider string `json:"provider,omitempty"`
+	// KeyIDs lists the keys the values were encrypted with
+	KeyIDs []string `json:"keyIds,omitempty"`
+	// Keys lists the names of the decrypted values
+	Keys []string `json:"keys,omitempty"`
+	// Secrets lists the secrets written as namespace/name
+	Secrets []string `json:"secrets,omitempty"`
+	// Trigger tells why the decryption happened
+	Trigger string `json:"trigger"`
+	Outcome string `json:"outcome"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Sink receives the audit records
+type Sink interface {
+	Record(ctx context.Context, event Event) error
+}
+
+// closer is implemented by sinks that deliver records in the background
+type closer interface {
+	Close(ctx context.Context) error
+}
+
+// Close delivers the records sink still holds, until ctx is done. It does
+// nothing for sinks that deliver every record right away.
+func Close(ctx context.Context, sink Sink) error {
+	if sink, ok := sink.(closer); ok {
+		return sink.Close(ctx)
+	}
+	return nil
+}
+
+// writerSink writes every record as a JSON line to a writer
+type writerSink struct {
+	mu     sync.Mutex
+	writer io.Writer
+}
+
+// NewWriterSink returns a sink writing JSON lines to writer
+func NewWriterSink(writer io.Writer) Sink {
+	return &writerSink{writer: writer}
+}
+
+func (s *writerSink) Record(_ context.Context, event Event) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.writer.Write(append(line, '\n'))
+	return err
+}
+
+// NewFileSink returns a sink appending JSON lines to the file at path
+func NewFileSink(path string) (Sink, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the audit file %v", err)
+	}
+	return NewWriterSink(file), nil
+}
+
+// webhookSink posts every record as JSON to a URL. Records are buffered and
+// posted in the background, so an endpoint that can't be reached doesn't hold up
+// the reconciliations.
+type webhookSink struct {
+	url     string
+	client  *http.Client
+	onError func(error)
+	records chan Event
+	done    chan struct{}
+
+	// mu guards closing records against queueing more of them
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewWebhookSink returns a sink posting every record as JSON to url. Failing to
+// deliver a record is passed to onError, which may be nil.
+func NewWebhookSink(url string, onError func(error)) Sink {
+	s := &webhookSink{
+		url:     url,
+		client:  &http.Client{Timeout: webhookTimeout},
+		onError: onError,
+		records: make(chan Event, webhookBuffer),
+		done:    make(chan struct{}),
+	}
+	go s.send()
+	return s
+}
+
+// Record queues event and fails without waiting when the buffer is full
+func (s *webhookSink) Record(_ context.Context, event Event) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return fmt.Errorf("failed to send the audit record, the sink for %s is closed", s.url)
+	}
+	select {
+	case s.records <- event:
+		return nil
+	default:
+		return fmt.Errorf("failed to send the audit record, %d records for %s are waiting", webhookBuffer, s.url)
+	}
+}
+
+// send posts the queued records until the sink is closed
+func (s *webhookSink) send() {
+	defer close(s.done)
+	for event := range s.records {
+		if err := s.post(event); err != nil && s.onError != nil {
+			s.onError(err)
+		}
+	}
+}
+
+func (s *webhookSink) post(event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send the audit record %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("failed to send the audit record, %s answered %s", s.url, resp.Status)
+	}
+	return nil
+}
+
+// Close posts the queued records and waits until they are sent or ctx is done
+func (s *webhookSink) Close(ctx context.Context) error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.records)
+	}
+	s.mu.Unlock()
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("failed to send the queued audit records for %s %v", s.url, ctx.Err())
+	}
+}
+
+// multiSink passes every record to all of its sinks
+type multiSink []Sink
+
+func (s multiSink) Record(ctx context.Context, event Event) error {
+	var errs []string
+	for _, sink := range s {
+		if err := sink.Record(ctx, event); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to record the audit event %s", strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+func (s multiSink) Close(ctx context.Context) error {
+	var errs []string
+	for _, sink := range s {
+		if err := Close(ctx, sink); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// NewSink returns the sink for the comma separated list of destinations, where a
+// destination is stdout, file:<path> or an http(s) URL. Records posted to a URL
+// in the background that can't be delivered are passed to onError. It returns
+// nil for an empty list.
+func NewSink(destinations string, onError func(error)) (Sink, error) {
+	var sinks multiSink
+	for _, destination := range strings.Split(destinations, ",") {
+		destination = strings.TrimSpace(destination)
+		switch {
+		case destination == "":
+			continue
+		case destination == "stdout":
+			sinks = append(sinks, NewWriterSink(os.Stdout))
+		case strings.HasPrefix(destination, "file:"):
+			sink, err := NewFileSink(strings.TrimPrefix(destination, "file:"))
+			if err != nil {
+				return nil, err
+			}
+			sinks = append(sinks, sink)
+		case strings.HasPrefix(destination, "http://"), strings.HasPrefix(destination, "https://"):
+			sinks = append(sinks, NewWebhookSink(destination, onError))
+		default:
+			return nil, fmt.Errorf("invalid audit sink %s", destination)
+		}
+	}
+	if len(sinks) == 0 {
+		return nil, nil
+	}
+	return sinks, nil
+}
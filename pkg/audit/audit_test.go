@@ -0,0 +1,130 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriterSinkWritesJSONLines(t *testing.T) {
+	var buf bytes.Buffer
+	sink := NewWriterSink(&buf)
+	event := Event{Action: ActionDecrypt, Kind: "EncryptedSecret", Namespace: "default", Name: "db",
+		Provider: "k8s", Keys: []string{"password"}, Trigger: TriggerCreated, Outcome: OutcomeSuccess}
+	for i := 0; i < 2; i++ {
+		if err := sink.Record(context.Background(), event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %d: %s", len(lines), buf.String())
+	}
+	var decoded Event
+	if err := json.Unmarshal([]byte(lines[0]), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Name != "db" || decoded.Keys[0] != "password" || decoded.Trigger != TriggerCreated {
+		t.Fatalf("unexpected record %+v", decoded)
+	}
+}
+
+func TestWebhookSinkPostsEvents(t *testing.T) {
+	received := make(chan Event, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var event Event
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received <- event
+	}))
+	defer server.Close()
+
+	sink := NewWebhookSink(server.URL, func(err error) { t.Error(err) })
+	if err := sink.Record(context.Background(), Event{Name: "db", Outcome: OutcomeFailure}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Close(context.Background(), sink); err != nil {
+		t.Fatal(err)
+	}
+	event := <-received
+	if event.Name != "db" || event.Outcome != OutcomeFailure {
+		t.Fatalf("unexpected record %+v", event)
+	}
+	if err := sink.Record(context.Background(), Event{}); err == nil {
+		t.Fatal("expected an error for a closed sink")
+	}
+}
+
+func TestWebhookSinkReportsErrorStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	var errs []error
+	sink := NewWebhookSink(server.URL, func(err error) { errs = append(errs, err) })
+	if err := sink.Record(context.Background(), Event{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Close(context.Background(), sink); err != nil {
+		t.Fatal(err)
+	}
+	if len(errs) != 1 {
+		t.Fatalf("expected an error for a failing webhook, got %v", errs)
+	}
+}
+
+func TestWebhookSinkDoesNotBlockRecords(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	// the endpoint never answers, so the buffer fills up instead of Record waiting
+	sink := NewWebhookSink(server.URL, nil)
+	var err error
+	for i := 0; i <= webhookBuffer+1 && err == nil; i++ {
+		err = sink.Record(context.Background(), Event{})
+	}
+	if err == nil {
+		t.Fatal("expected an error once the buffer is full")
+	}
+}
+
+func TestNewSink(t *testing.T) {
+	sink, err := NewSink(" ", nil)
+	if err != nil || sink != nil {
+		t.Fatalf("expected no sink for an empty list, got %v %v", sink, err)
+	}
+
+	if _, err := NewSink("syslog", nil); err == nil {
+		t.Fatal("expected an error for an unknown destination")
+	}
+
+	file := filepath.Join(t.TempDir(), "audit.log")
+	sink, err = NewSink("file:"+file+",https://audit.example.com/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sink.(multiSink)) != 2 {
+		t.Fatalf("expected 2 sinks, got %d", len(sink.(multiSink)))
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Fatal(err)
+	}
+}
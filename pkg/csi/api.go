@@ -0,0 +1,385 @@
+// Package csi serves the provider API of the Secrets Store CSI driver
+// (https://secrets-store-csi-driver.sigs.k8s.io) over a unix socket. The driver
+// calls Mount for every volume of a pod and writes the returned files into the
+// tmpfs of the volume.
+//
+// The messages of the v1alpha1.CSIDriverProvider service are encoded by hand
+// with protowire, which keeps the generated code of the driver out of the module.
+// Their field numbers follow provider/v1alpha1/service.proto of the driver.
+package csi
+
+import (
+	"context"
+	"fmt"
+
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// VersionRequest is sent by the driver to learn the version of the provider
+type VersionRequest struct {
+	// Version is the version of the provider API the driver speaks
+	Version string
+}
+
+// VersionResponse tells the driver the version of the provider
+type VersionResponse struct {
+	Version        string
+	RuntimeName    string
+	RuntimeVersion string
+}
+
+// MountRequest asks for the files of a volume
+type MountRequest struct {
+	// Attributes is a JSON object holding the parameters of the SecretProviderClass
+	// and the pod the volume belongs to
+	Attributes string
+	// Secrets is a JSON object holding the node publish secret of the volume
+	Secrets string
+	// TargetPath is the directory the volume is mounted at
+	TargetPath string
+	// Permission is the JSON encoded mode of the files
+	Permission string
+	// CurrentObjectVersions are the versions of the objects mounted last time
+	CurrentObjectVersions []*ObjectVersion
+}
+
+// MountResponse holds the files the driver writes into the volume
+type MountResponse struct {
+	ObjectVersions []*ObjectVersion
+	Error          *Error
+	Files          []*File
+}
+
+// File is written into the volume at Path, relative to the target path
+type File struct {
+	Path     string
+	Mode     int32
+	Contents []byte
+}
+
+// ObjectVersion identifies the version of a mounted object, the driver remounts
+// volumes whose versions changed when it rotates secrets
+type ObjectVersion struct {
+	ID      string
+	Version string
+}
+
+// Error reports a failed mount with a code the driver records in its metrics
+type Error struct {
+	Code string
+}
+
+// message is a message that encodes itself in the protobuf wire format
+type message interface {
+	marshal() []byte
+	unmarshal(data []byte) error
+}
+
+func (m *VersionRequest) marshal() []byte {
+	return appendString(nil, 1, m.Version)
+}
+
+func (m *VersionRequest) unmarshal(data []byte) error {
+	return decodeFields(data, func(num protowire.Number, value []byte) error {
+		if num == 1 {
+			m.Version = string(value)
+		}
+		return nil
+	})
+}
+
+func (m *VersionResponse) marshal() []byte {
+	b := appendString(nil, 1, m.Version)
+	b = appendString(b, 2, m.RuntimeName)
+	return appendString(b, 3, m.RuntimeVersion)
+}
+
+func (m *VersionResponse) unmarshal(data []byte) error {
+	return decodeFields(data, func(num protowire.Number, value []byte) error {
+		switch num {
+		case 1:
+			m.Version = string(value)
+		case 2:
+			m.RuntimeName = string(value)
+		case 3:
+			m.RuntimeVersion = string(value)
+		}
+		return nil
+	})
+}
+
+func (m *MountRequest) marshal() []byte {
+	b := appendString(nil, 1, m.Attributes)
+	b = appendString(b, 2, m.Secrets)
+	b = appendString(b, 3, m.TargetPath)
+	b = appendString(b, 4, m.Permission)
+	for _, version := range m.CurrentObjectVersions {
+		b = appendMessage(b, 5, version)
+	}
+	return b
+}
+
+func (m *MountRequest) unmarshal(data []byte) error {
+	return decodeFields(data, func(num protowire.Number, value []byte) error {
+		switch num {
+		case 1:
+			m.Attributes = string(value)
+		case 2:
+			m.Secrets = string(value)
+		case 3:
+			m.TargetPath = string(value)
+		case 4:
+			m.Permission = string(value)
+		case 5:
+			version := &ObjectVersion{}
+			if err := version.unmarshal(value); err != nil {
+				return err
+			}
+			m.CurrentObjectVersions = append(m.CurrentObjectVersions, version)
+		}
+		return nil
+	})
+}
+
+func (m *MountResponse) marshal() []byte {
+	var b []byte
+	for _, version := range m.ObjectVersions {
+		b = appendMessage(b, 1, version)
+	}
+	if m.Error != nil {
+		b = appendMessage(b, 2, m.Error)
+	}
+	for _, file := range m.Files {
+		b = appendMessage(b, 3, file)
+	}
+	return b
+}
+
+func (m *MountResponse) unmarshal(data []byte) error {
+	return decodeFields(data, func(num protowire.Number, value []byte) error {
+		switch num {
+		case 1:
+			version := &ObjectVersion{}
+			if err := version.unmarshal(value); err != nil {
+				return err
+			}
+			m.ObjectVersions = append(m.ObjectVersions, version)
+		case 2:
+			m.Error = &Error{}
+			return m.Error.unmarshal(value)
+		case 3:
+			file := &File{}
+			if err := file.unmarshal(value); err != nil {
+				return err
+			}
+			m.Files = append(m.Files, file)
+		}
+		return nil
+	})
+}
+
+func (m *File) marshal() []byte {
+	b := appendString(nil, 1, m.Path)
+	if m.Mode != 0 {
+		b = protowire.AppendTag(b, 2, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(m.Mode))
+	}
+	if len(m.Contents) > 0 {
+		b = protowire.AppendTag(b, 3, protowire.BytesType)
+		b = protowire.AppendBytes(b, m.Contents)
+	}
+	return b
+}
+
+func (m *File) unmarshal(data []byte) error {
+	return decodeFields(data, func(num protowire.Number, value []byte) error {
+		switch num {
+		case 1:
+			m.Path = string(value)
+		case 2:
+			mode, n := protowire.ConsumeVarint(value)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			m.Mode = int32(mode)
+		case 3:
+			m.Contents = append([]byte(nil), value...)
+		}
+		return nil
+	})
+}
+
+func (m *ObjectVersion) marshal() []byte {
+	b := appendString(nil, 1, m.ID)
+	return appendString(b, 2, m.Version)
+}
+
+func (m *ObjectVersion) unmarshal(data []byte) error {
+	return decodeFields(data, func(num protowire.Number, value []byte) error {
+		switch num {
+		case 1:
+			m.ID = string(value)
+		case 2:
+			m.Version = string(value)
+		}
+		return nil
+	})
+}
+
+func (m *Error) marshal() []byte {
+	return appendString(nil, 1, m.Code)
+}
+
+func (m *Error) unmarshal(data []byte) error {
+	return decodeFields(data, func(num protowire.Number, value []byte) error {
+		if num == 1 {
+			m.Code = string(value)
+		}
+		return nil
+	})
+}
+
+// appendString appends a string field, leaving it out when it is empty like
+// proto3 does
+func appendString(b []byte, num protowire.Number, value string) []byte {
+	if value == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, value)
+}
+
+func appendMessage(b []byte, num protowire.Number, m message) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, m.marshal())
+}
+
+// decodeFields calls field with the number and value of every field of data.
+// The value of a varint is passed in its encoded form, unknown fields are
+// skipped.
+func decodeFields(data []byte, field func(num protowire.Number, value []byte) error) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		var value []byte
+		switch typ {
+		case protowire.BytesType:
+			value, n = protowire.ConsumeBytes(data)
+		case protowire.VarintType:
+			_, n = protowire.ConsumeVarint(data)
+			if n >= 0 {
+				value = data[:n]
+			}
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, data)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+		if value == nil && typ != protowire.BytesType {
+			continue
+		}
+		if err := field(num, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// codec encodes the messages of the service for grpc. It is called proto as it
+// writes the same bytes as the protobuf codec of the driver.
+type codec struct{}
+
+func (codec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(message)
+	if !ok {
+		return nil, fmt.Errorf("csi: can't marshal %T", v)
+	}
+	return m.marshal(), nil
+}
+
+func (codec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(message)
+	if !ok {
+		return fmt.Errorf("csi: can't unmarshal %T", v)
+	}
+	return m.unmarshal(data)
+}
+
+func (codec) Name() string {
+	return "proto"
+}
+
+// ProviderServer is the provider side of the v1alpha1.CSIDriverProvider service
+type ProviderServer interface {
+	Version(ctx context.Context, req *VersionRequest) (*VersionResponse, error)
+	Mount(ctx context.Context, req *MountRequest) (*MountResponse, error)
+}
+
+const serviceName = "v1alpha1.CSIDriverProvider"
+
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: serviceName,
+	HandlerType: (*ProviderServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Version",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+				req := &VersionRequest{}
+				if err := dec(req); err != nil {
+					return nil, err
+				}
+				return srv.(ProviderServer).Version(ctx, req)
+			},
+		},
+		{
+			MethodName: "Mount",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+				req := &MountRequest{}
+				if err := dec(req); err != nil {
+					return nil, err
+				}
+				return srv.(ProviderServer).Mount(ctx, req)
+			},
+		},
+	},
+	Metadata: "provider/v1alpha1/service.proto",
+}
+
+// Client calls a provider like the driver does
+type Client struct {
+	conn grpc.ClientConnInterface
+}
+
+// NewClient returns a client of the provider behind conn, which needs the codec
+// of DialOptions
+func NewClient(conn grpc.ClientConnInterface) *Client {
+	return &Client{conn: conn}
+}
+
+// DialOptions are the options a connection to a provider needs
+func DialOptions() []grpc.DialOption {
+	return []grpc.DialOption{grpc.WithDefaultCallOptions(grpc.ForceCodec(codec{}))}
+}
+
+func (c *Client) Version(ctx context.Context, req *VersionRequest) (*VersionResponse, error) {
+	resp := &VersionResponse{}
+	if err := c.conn.Invoke(ctx, "/"+serviceName+"/Version", req, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (c *Client) Mount(ctx context.Context, req *MountRequest) (*MountResponse, error) {
+	resp := &MountResponse{}
+	if err := c.conn.Invoke(ctx, "/"+serviceName+"/Mount", req, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
@@ -0,0 +1,49 @@
+package csi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+
+	"google.golang.org/grpc"
+)
+
+// DefaultSocketPath is where the driver looks for the socket of the provider
+// called encrypted-secrets, in the default providers directory of its chart
+const DefaultSocketPath = "/var/run/secrets-store-csi-providers/encrypted-secrets.sock"
+
+// NewServer returns a grpc server serving provider
+func NewServer(provider ProviderServer) *grpc.Server {
+	server := grpc.NewServer(grpc.ForceServerCodec(codec{}))
+	server.RegisterService(&serviceDesc, provider)
+	return server
+}
+
+// Listen listens on the unix socket at path, replacing the socket a previous run
+// left behind
+func Listen(path string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to remove the stale socket %v", err)
+	}
+	return net.Listen("unix", path)
+}
+
+// Serve serves provider on the unix socket at path until ctx is done
+func Serve(ctx context.Context, path string, provider ProviderServer) error {
+	listener, err := Listen(path)
+	if err != nil {
+		return err
+	}
+	server := NewServer(provider)
+	go func() {
+		<-ctx.Done()
+		server.GracefulStop()
+	}()
+	return server.Serve(listener)
+}
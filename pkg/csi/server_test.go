@@ -0,0 +1,138 @@
+package csi
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// fakeProvider mounts a file holding the attributes it was called with
+type fakeProvider struct {
+	req *MountRequest
+}
+
+func (p *fakeProvider) Version(_ context.Context, req *VersionRequest) (*VersionResponse, error) {
+	return &VersionResponse{Version: req.Version, RuntimeName: "fake", RuntimeVersion: "0.1.0"}, nil
+}
+
+func (p *fakeProvider) Mount(_ context.Context, req *MountRequest) (*MountResponse, error) {
+	if req.TargetPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing target path")
+	}
+	p.req = req
+	return &MountResponse{
+		ObjectVersions: []*ObjectVersion{{ID: "encryptedsecret/db", Version: "2"}},
+		Files: []*File{
+			{Path: "password", Mode: 0o400, Contents: []byte("hunter2")},
+			{Path: "tls/empty", Mode: 0o644},
+		},
+	}, nil
+}
+
+// serve serves provider on a unix socket in a temporary directory and returns
+// a client connected to it
+func serve(t *testing.T, provider ProviderServer) *Client {
+	ctx, cancel := context.WithCancel(context.Background())
+	path := filepath.Join(t.TempDir(), "provider", "encrypted-secrets.sock")
+	listener, err := Listen(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(provider)
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Serve(listener)
+	}()
+
+	conn, err := grpc.DialContext(ctx, "unix://"+path,
+		append(DialOptions(), grpc.WithTransportCredentials(insecure.NewCredentials()))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		cancel()
+		server.GracefulStop()
+		if err := <-done; err != nil {
+			t.Errorf("unexpected serve error %v", err)
+		}
+	})
+	return NewClient(conn)
+}
+
+func TestMount(t *testing.T) {
+	provider := &fakeProvider{}
+	client := serve(t, provider)
+	ctx := context.Background()
+
+	version, err := client.Version(ctx, &VersionRequest{Version: "v1alpha1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version.Version != "v1alpha1" || version.RuntimeName != "fake" || version.RuntimeVersion != "0.1.0" {
+		t.Fatalf("unexpected version %+v", version)
+	}
+
+	req := &MountRequest{
+		Attributes:            `{"csi.storage.k8s.io/pod.namespace":"default","objects":"- name: db\n"}`,
+		Secrets:               "{}",
+		TargetPath:            "/var/lib/kubelet/pods/uid/volumes/secrets",
+		Permission:            "420",
+		CurrentObjectVersions: []*ObjectVersion{{ID: "encryptedsecret/db", Version: "1"}},
+	}
+	resp, err := client.Mount(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if provider.req.Attributes != req.Attributes || provider.req.Secrets != req.Secrets ||
+		provider.req.TargetPath != req.TargetPath || provider.req.Permission != req.Permission {
+		t.Fatalf("unexpected request %+v", provider.req)
+	}
+	if len(provider.req.CurrentObjectVersions) != 1 || *provider.req.CurrentObjectVersions[0] != *req.CurrentObjectVersions[0] {
+		t.Fatalf("unexpected object versions %v", provider.req.CurrentObjectVersions)
+	}
+
+	if len(resp.ObjectVersions) != 1 || resp.ObjectVersions[0].ID != "encryptedsecret/db" || resp.ObjectVersions[0].Version != "2" {
+		t.Fatalf("unexpected object versions %v", resp.ObjectVersions)
+	}
+	if resp.Error != nil {
+		t.Fatalf("unexpected error %v", resp.Error)
+	}
+	if len(resp.Files) != 2 {
+		t.Fatalf("expected 2 files, got %d", len(resp.Files))
+	}
+	if f := resp.Files[0]; f.Path != "password" || f.Mode != 0o400 || string(f.Contents) != "hunter2" {
+		t.Fatalf("unexpected file %+v", f)
+	}
+	if f := resp.Files[1]; f.Path != "tls/empty" || f.Mode != 0o644 || len(f.Contents) != 0 {
+		t.Fatalf("unexpected file %+v", f)
+	}
+
+	// errors of the provider reach the driver with their code
+	_, err = client.Mount(ctx, &MountRequest{Attributes: "{}"})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected an invalid argument, got %v", err)
+	}
+}
+
+func TestListenReplacesStaleSockets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "encrypted-secrets.sock")
+	listener, err := Listen(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a crashed provider leaves its socket behind
+	listener.(interface{ SetUnlinkOnClose(bool) }).SetUnlinkOnClose(false)
+	listener.Close()
+
+	listener, err = Listen(path)
+	if err != nil {
+		t.Fatalf("expected the stale socket to be replaced, got %v", err)
+	}
+	listener.Close()
+}
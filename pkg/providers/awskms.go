@@ -0,0 +1,121 @@
+package providers
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/kms/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+const defaultKMSKeyID = "alias/cryptctl-key"
+
+type kmsProvider struct {
+	client *kms.Client
+	keyID  string
+}
+
+func newKMSProvider(ctx context.Context, cfg Config) (*kmsProvider, error) {
+	if cfg.NamespacedAWSAuth && !cfg.OperatorAWSCredentials && cfg.Credentials == nil {
+		return nil, NewPolicyError("aws-kms of a namespaced EncryptionProvider needs the SecretRef auth method, " +
+			"the operator doesn't share its AWS credentials")
+	}
+	client, err := newKMSClient(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &kmsProvider{client: client, keyID: kmsKeyID(cfg)}, nil
+}
+
+// newKMSClient returns a KMS client for the region, credentials and role of cfg
+func newKMSClient(ctx context.Context, cfg Config) (*kms.Client, error) {
+	awsConfig, err := loadAWSConfig(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return kms.NewFromConfig(awsConfig), nil
+}
+
+// loadAWSConfig returns the AWS configuration for the region, credentials and
+// role of cfg
+func loadAWSConfig(ctx context.Context, cfg Config) (aws.Config, error) {
+	// credentials from the shared credentials file ~/.aws/credentials unless
+	// the provider configuration brings its own
+	var opts []func(*config.LoadOptions) error
+	if cfg.Region != "" {
+		opts = append(opts, config.WithRegion(cfg.Region))
+	}
+	if cfg.Credentials != nil {
+		opts = append(opts, config.WithCredentialsProvider(cfg.Credentials))
+	}
+
+	awsConfig, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return aws.Config{}, err
+	}
+	if cfg.RoleARN != "" {
+		assumeRole := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(awsConfig), cfg.RoleARN)
+		awsConfig.Credentials = aws.NewCredentialsCache(assumeRole)
+	}
+	return awsConfig, nil
+}
+
+// kmsKeyID returns the KMS key new values are encrypted with
+func kmsKeyID(cfg Config) string {
+	if cfg.KMSKeyID == "" {
+		return defaultKMSKeyID
+	}
+	return cfg.KMSKeyID
+}
+
+func (p *kmsProvider) Encrypt(ctx context.Context, value string) (string, error) {
+	encrypted, err := p.client.Encrypt(ctx, &kms.EncryptInput{
+		KeyId:     aws.String(p.keyID),
+		Plaintext: []byte(value),
+	})
+	if err != nil {
+		return "", kmsError(err)
+	}
+	return base64.StdEncoding.EncodeToString(encrypted.CiphertextBlob), nil
+}
+
+// Decrypt returns the ARN of the KMS key as the key version
+func (p *kmsProvider) Decrypt(ctx context.Context, encoded string) (string, string, error) {
+	ciphered, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", "", err
+	}
+	decoded, err := p.client.Decrypt(ctx, &kms.DecryptInput{
+		CiphertextBlob: ciphered,
+	})
+	if err != nil {
+		return "", "", kmsError(err)
+	}
+	return string(decoded.Plaintext), aws.ToString(decoded.KeyId), nil
+}
+
+// PrimaryKeyVersion resolves the configured key id or alias to the key ARN, so
+// that it can be compared with what Decrypt reports
+func (p *kmsProvider) PrimaryKeyVersion(ctx context.Context) (string, error) {
+	described, err := p.client.DescribeKey(ctx, &kms.DescribeKeyInput{
+		KeyId: aws.String(p.keyID),
+	})
+	if err != nil {
+		return "", kmsError(err)
+	}
+	return aws.ToString(described.KeyMetadata.Arn), nil
+}
+
+// kmsError reports keys KMS doesn't know as a KeyMissingError
+func kmsError(err error) error {
+	var notFound *types.NotFoundException
+	if errors.As(err, &notFound) {
+		return NewKeyMissingError(err.Error())
+	}
+	return err
+}
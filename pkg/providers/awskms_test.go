@@ -0,0 +1,33 @@
+package providers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/credentials"
+)
+
+func TestNamespacedAWSAuthNeedsItsOwnCredentials(t *testing.T) {
+	ctx := context.Background()
+	cfg := Config{
+		Provider:          AWSKMSProvider,
+		Region:            "eu-west-1",
+		RoleARN:           "arn:aws:iam::111122223333:role/operator",
+		NamespacedAWSAuth: true,
+	}
+	if _, err := NewProvider(ctx, cfg); !IsPolicyError(err) {
+		t.Fatalf("expected the credentials of the operator to be refused, got %v", err)
+	}
+
+	allowed := cfg
+	allowed.OperatorAWSCredentials = true
+	if _, err := NewProvider(ctx, allowed); err != nil {
+		t.Fatalf("expected the operator to allow its credentials, got %v", err)
+	}
+
+	own := cfg
+	own.Credentials = credentials.NewStaticCredentialsProvider("AKIAEXAMPLE", "secret", "")
+	if _, err := NewProvider(ctx, own); err != nil {
+		t.Fatalf("expected the credentials of the namespace to be used, got %v", err)
+	}
+}
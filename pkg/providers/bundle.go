@@ -0,0 +1,118 @@
+package providers
+
+import (
+	"context"
+	"crypto/ecdh"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// KeyBundle holds everything needed to encrypt values for the k8s provider of a
+// namespace without access to the cluster: the id and public key of its primary
+// key. It can't decrypt anything, so it can be handed to CI pipelines.
+type KeyBundle struct {
+	Provider  string `json:"provider"`
+	Namespace string `json:"namespace"`
+	KeyID     string `json:"keyId"`
+	// PublicKey is the base64 encoded X25519 public key of the primary key
+	PublicKey string `json:"publicKey"`
+}
+
+// ExportKeyBundle returns the key bundle of the primary key of the k8s provider
+// configured by cfg, which has to be an X25519 key
+func ExportKeyBundle(ctx context.Context, cfg Config) (*KeyBundle, error) {
+	if cfg.Provider != K8sProvider {
+		return nil, fmt.Errorf("key bundles can only be exported for the %s provider", K8sProvider)
+	}
+	provider, err := newK8sProvider(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return provider.keyring.keyBundle(cfg.Namespace)
+}
+
+// keyBundle returns the key bundle of the primary key, which has to be an X25519 key
+func (k *Keyring) keyBundle(namespace string) (*KeyBundle, error) {
+	privateKey, ok, err := parseX25519Key(k.keys[k.primary])
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("the primary key %s is a passphrase, only x25519 keys can be exported", k.primary)
+	}
+	return &KeyBundle{
+		Provider:  K8sProvider,
+		Namespace: namespace,
+		KeyID:     k.primary,
+		PublicKey: base64.StdEncoding.EncodeToString(privateKey.PublicKey().Bytes()),
+	}, nil
+}
+
+// LoadKeyBundle reads a key bundle written by ExportKeyBundle from the file at path
+func LoadKeyBundle(path string) (*KeyBundle, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	bundle := &KeyBundle{}
+	if err := json.Unmarshal(data, bundle); err != nil {
+		return nil, fmt.Errorf("invalid key bundle %s %v", path, err)
+	}
+	return bundle, nil
+}
+
+// ApplyTo sets the namespace and the provider annotation of a manifest encrypted
+// with the bundle. The namespace defaults to the one of the bundle and may not
+// differ from it.
+func (b *KeyBundle) ApplyTo(meta *v1.ObjectMeta) error {
+	if meta.Namespace == "" {
+		meta.Namespace = b.Namespace
+	}
+	if meta.Namespace != b.Namespace {
+		return fmt.Errorf("the key bundle is for namespace %s, not %s", b.Namespace, meta.Namespace)
+	}
+	v1.SetMetaDataAnnotation(meta, ProviderAnnotation, b.Provider)
+	return nil
+}
+
+// bundleProvider encrypts values with a key bundle. It can't decrypt them.
+type bundleProvider struct {
+	keyID     string
+	publicKey *ecdh.PublicKey
+}
+
+func newBundleProvider(bundle *KeyBundle) (*bundleProvider, error) {
+	if bundle.Provider != K8sProvider {
+		return nil, fmt.Errorf("invalid key bundle provider %s", bundle.Provider)
+	}
+	raw, err := base64.StdEncoding.DecodeString(bundle.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key bundle public key %v", err)
+	}
+	publicKey, err := ecdh.X25519().NewPublicKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key bundle public key %v", err)
+	}
+	return &bundleProvider{keyID: bundle.KeyID, publicKey: publicKey}, nil
+}
+
+func (p *bundleProvider) Encrypt(_ context.Context, value string) (string, error) {
+	header, err := encodeKeyIDHeader(p.keyID)
+	if err != nil {
+		return "", err
+	}
+	return x25519SealAndEncode(value, p.publicKey, header)
+}
+
+func (p *bundleProvider) Decrypt(_ context.Context, _ string) (string, string, error) {
+	return "", "", errors.New("a key bundle can only encrypt")
+}
+
+func (p *bundleProvider) PrimaryKeyVersion(_ context.Context) (string, error) {
+	return p.keyID, nil
+}
@@ -0,0 +1,147 @@
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	secretsv1alpha1 "github.com/opensecrecy/encrypted-secrets/api/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestKeyBundleEncryptsForTheKeyring(t *testing.T) {
+	x25519Key, err := GenerateK8sKey(KeyTypeX25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring, err := NewKeyring("2", map[string]string{
+		"1": "justRandomEncryptionKey",
+		"2": x25519Key,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bundle, err := keyring.keyBundle("default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "bundle.json")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// the bundle alone encrypts, without the private key
+	loaded, err := LoadKeyBundle(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider, err := NewProvider(context.Background(), Config{Provider: K8sProvider, Namespace: "default", KeyBundle: loaded})
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := provider.Encrypt(context.Background(), "hello-world")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyID, ok := KeyID(encrypted); !ok || keyID != "2" {
+		t.Fatalf("got key id %q, want %q", keyID, "2")
+	}
+	if _, _, err := provider.Decrypt(context.Background(), encrypted); err == nil {
+		t.Fatal("expected a key bundle to refuse decryption")
+	}
+
+	decoded, version, err := keyring.Decrypt(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded != "hello-world" || version != "2" {
+		t.Fatalf("got %q with key version %q, want %q with key version %q", decoded, version, "hello-world", "2")
+	}
+
+	// the keyring encrypts with the x25519 key itself as well
+	encrypted, err = keyring.Encrypt("hello-again")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded, _, err := keyring.Decrypt(encrypted); err != nil || decoded != "hello-again" {
+		t.Fatalf("got %q, %v", decoded, err)
+	}
+}
+
+func TestKeyBundleNeedsX25519Key(t *testing.T) {
+	keyring, err := NewKeyring("1", map[string]string{"1": "justRandomEncryptionKey"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keyring.keyBundle("default"); err == nil {
+		t.Fatal("expected passphrases not to be exported")
+	}
+}
+
+func TestX25519RejectsTamperedCiphertext(t *testing.T) {
+	x25519Key, err := GenerateK8sKey(KeyTypeX25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring, err := NewKeyring("1", map[string]string{"1": x25519Key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := keyring.Encrypt("hello-world")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// flip a bit of the sealed value
+	tampered := []byte(encrypted)
+	tampered[len(tampered)-5] ^= 1
+	if _, _, err := keyring.Decrypt(string(tampered)); err == nil {
+		t.Fatal("expected a tampered ciphertext to fail")
+	}
+}
+
+func TestEncryptWithKeyBundleWorksOffline(t *testing.T) {
+	// there is no cluster to read keys from
+	t.Setenv("KUBECONFIG", filepath.Join(t.TempDir(), "missing"))
+
+	x25519Key, err := GenerateK8sKey(KeyTypeX25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring, err := NewKeyring("1", map[string]string{"1": x25519Key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle, err := keyring.keyBundle("team-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encrypted, err := EncryptWithKeyBundle(secretsv1alpha1.DecryptedSecret{
+		ObjectMeta: metav1.ObjectMeta{Name: "db"},
+		Data:       map[string]string{"password": "hello-world"},
+	}, bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encrypted.Namespace != "team-a" || encrypted.Annotations[ProviderAnnotation] != K8sProvider {
+		t.Fatalf("got namespace %q and provider %q", encrypted.Namespace, encrypted.Annotations[ProviderAnnotation])
+	}
+	if decoded, _, err := keyring.Decrypt(encrypted.Data["password"]); err != nil || decoded != "hello-world" {
+		t.Fatalf("got %q, %v", decoded, err)
+	}
+
+	_, err = EncryptWithKeyBundle(secretsv1alpha1.DecryptedSecret{
+		ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "team-b"},
+	}, bundle)
+	if err == nil {
+		t.Fatal("expected an error for a bundle of another namespace")
+	}
+}
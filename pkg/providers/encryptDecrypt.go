@@ -2,22 +2,36 @@ package providers
 
 import (
 	"context"
-	"encoding/base64"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
 	"fmt"
-
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/service/kms"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/opensecrecy/encrypted-secrets/pkg/providers/utils"
+	"sort"
+	"strings"
 
 	secretsv1alpha1 "github.com/opensecrecy/encrypted-secrets/api/v1alpha1"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 func DecodeAndDecrypt(encryptedSecret *secretsv1alpha1.EncryptedSecret) (*secretsv1alpha1.DecryptedSecret, error) {
+	decryptedSecret, _, err := DecryptWithKeyVersions(context.TODO(), encryptedSecret)
+	return decryptedSecret, err
+}
 
-	// get the provider
-	provider := encryptedSecret.GetAnnotations()["secrets.opensecrecy.org/provider"]
+// DecryptWithKeyVersions decrypts encryptedSecret like DecodeAndDecrypt and also
+// returns the sorted versions of the keys its values are encrypted with
+func DecryptWithKeyVersions(ctx context.Context, encryptedSecret *secretsv1alpha1.EncryptedSecret) (*secretsv1alpha1.DecryptedSecret, []string, error) {
+
+	provider, err := newProvider(ctx, encryptedSecret)
+	if err != nil {
+		return nil, nil, err
+	}
+	return DecryptWithProvider(ctx, provider, encryptedSecret)
+}
+
+// DecryptWithProvider decrypts encryptedSecret with provider and returns the sorted
+// versions of the keys its values are encrypted with
+func DecryptWithProvider(ctx context.Context, provider Provider, encryptedSecret *secretsv1alpha1.EncryptedSecret) (*secretsv1alpha1.DecryptedSecret, []string, error) {
 
 	// init a decryptedSecret to hold everything
 	decryptedSecret := &secretsv1alpha1.DecryptedSecret{
@@ -26,76 +40,74 @@ func DecodeAndDecrypt(encryptedSecret *secretsv1alpha1.EncryptedSecret) (*secret
 			Kind:       "DecryptedSecret",
 			APIVersion: "secrets.opensecrecy.org/v1alpha1",
 		},
+		Type: encryptedSecret.Type,
 	}
 
 	// map to hold the decrypted values
 	decryptedMap := make(map[string]string)
+	keyVersions := make(map[string]struct{})
 
-	switch provider {
-	case "k8s":
-		k8sClient, err := utils.GetKubeClient()
+	// the values of a SOPS document are decrypted at once, the provider
+	// returns them as a JSON object
+	if encryptedSecret.Sops != "" {
+		if len(encryptedSecret.Data) > 0 {
+			return nil, nil, errors.New("an EncryptedSecret holds either data or a SOPS document, not both")
+		}
+		decoded, keyVersion, err := provider.Decrypt(ctx, encryptedSecret.Sops)
 		if err != nil {
-			return nil, fmt.Errorf("failed to get kubeclient %v", err)
+			return nil, nil, err
 		}
+		if err := json.Unmarshal([]byte(decoded), &decryptedMap); err != nil {
+			return nil, nil, fmt.Errorf("the provider didn't decrypt the SOPS document into values %v", err)
+		}
+		for _, keyID := range strings.Split(keyVersion, ",") {
+			keyVersions[keyID] = struct{}{}
+		}
+	}
 
-		namespace := encryptedSecret.Namespace
-
-		// Retrieve the secret from the Kubernetes cluster
-		secret, err := k8sClient.CoreV1().Secrets(namespace).Get(context.TODO(), "cryptctl-key", v1.GetOptions{})
+	for key, value := range encryptedSecret.Data {
+		decoded, keyVersion, err := provider.Decrypt(ctx, value)
 		if err != nil {
-			return nil, fmt.Errorf("failed to get the secret %v", err)
+			return nil, nil, err
 		}
+		decryptedMap[key] = decoded
+		keyVersions[keyVersion] = struct{}{}
+	}
 
-		// Access the secret data
-		keyPhrase := string(secret.Data["tls.crt"])
+	// add the decrypted values to decryptedSecret
+	decryptedSecret.Data = decryptedMap
 
-		// ToDo: plan is to eventually mode this repeated code to a separate util or something.
-		// need to figure out a way to avoid this code repetition
-		for key, value := range encryptedSecret.Data {
-			decoded, err := staticDecodeAndDecrypt(value, keyPhrase)
-			if err != nil {
-				return nil, err
-			}
-			decryptedMap[key] = decoded
-		}
+	return decryptedSecret, sortedKeys(keyVersions), nil
+}
 
-		// add the decrypted values to decryptedSecret
-		decryptedSecret.Data = decryptedMap
+func EncryptAndEncode(decryptedSecret secretsv1alpha1.DecryptedSecret) (*secretsv1alpha1.EncryptedSecret, error) {
 
-		return decryptedSecret, nil
+	provider, err := newProvider(context.TODO(), &decryptedSecret)
+	if err != nil {
+		return nil, err
+	}
+	return EncryptWithProvider(context.TODO(), provider, decryptedSecret)
+}
 
-	case "aws-kms":
-		// credentials from the shared credentials file ~/.aws/credentials.
-		// ToDo: commonize the client creation code
-		cfg, err := config.LoadDefaultConfig(context.TODO())
-		if err != nil {
-			return nil, err
-		}
-		client := kms.NewFromConfig(cfg)
-
-		for key, value := range encryptedSecret.Data {
-			ciphered, _ := base64.StdEncoding.DecodeString(value)
-			decoded, err := client.Decrypt(context.TODO(), &kms.DecryptInput{
-				CiphertextBlob: ciphered,
-			})
-			if err != nil {
-				return nil, err
-			}
-			decryptedMap[key] = string(decoded.Plaintext)
-		}
-		decryptedSecret.Data = decryptedMap
+// EncryptWithKeyBundle encrypts decryptedSecret like EncryptAndEncode, but with
+// bundle instead of the keys in the cluster, so that it works offline. The
+// namespace of decryptedSecret defaults to the one of the bundle.
+func EncryptWithKeyBundle(decryptedSecret secretsv1alpha1.DecryptedSecret, bundle *KeyBundle) (*secretsv1alpha1.EncryptedSecret, error) {
 
-		return decryptedSecret, nil
-	default:
-		return nil, fmt.Errorf("invalid provider %s", provider)
+	if err := bundle.ApplyTo(&decryptedSecret.ObjectMeta); err != nil {
+		return nil, err
 	}
-
+	cfg := ConfigFromAnnotations(&decryptedSecret)
+	cfg.KeyBundle = bundle
+	provider, err := NewProvider(context.TODO(), cfg)
+	if err != nil {
+		return nil, err
+	}
+	return EncryptWithProvider(context.TODO(), provider, decryptedSecret)
 }
 
-func EncryptAndEncode(decryptedSecret secretsv1alpha1.DecryptedSecret) (*secretsv1alpha1.EncryptedSecret, error) {
-
-	// get the provider
-	provider := decryptedSecret.GetAnnotations()["secrets.opensecrecy.org/provider"]
+// EncryptWithProvider encrypts decryptedSecret with provider
+func EncryptWithProvider(ctx context.Context, provider Provider, decryptedSecret secretsv1alpha1.DecryptedSecret) (*secretsv1alpha1.EncryptedSecret, error) {
 
 	// init a encryptedSecret to hold everything
 	encryptedSecret := &secretsv1alpha1.EncryptedSecret{
@@ -104,66 +116,75 @@ func EncryptAndEncode(decryptedSecret secretsv1alpha1.DecryptedSecret) (*secrets
 			Kind:       "EncryptedSecret",
 			APIVersion: "secrets.opensecrecy.org/v1alpha1",
 		},
+		Type: decryptedSecret.Type,
 	}
 
 	// map to hold the encrypted values
 	encryptedMap := make(map[string]string)
 
-	switch provider {
-	case "k8s":
-		k8sClient, err := utils.GetKubeClient()
+	for key, value := range decryptedSecret.Data {
+		encrypted, err := provider.Encrypt(ctx, value)
 		if err != nil {
-			return nil, fmt.Errorf("failed to get kubeclient %v", err)
+			return nil, err
 		}
+		encryptedMap[key] = encrypted
+	}
+	encryptedSecret.Data = encryptedMap
+	return encryptedSecret, nil
+}
 
-		namespace := decryptedSecret.Namespace
-
-		// Retrieve the secret from the Kubernetes cluster
-		secret, err := k8sClient.CoreV1().Secrets(namespace).Get(context.TODO(), "cryptctl-key", v1.GetOptions{})
-		if err != nil {
-			return nil, fmt.Errorf("failed to get the secret %v", err)
-		}
+// EncryptReusing encrypts decryptedSecret with provider like EncryptWithProvider,
+// but keeps the ciphertexts of previous for the values that didn't change, so
+// that encrypting unchanged values again leaves the manifest unchanged. A
+// ciphertext is only kept when provider decrypts it with its primary key to the
+// same value, values of other providers or retired keys are encrypted again.
+// previous may be nil. It also returns the number of values it encrypted.
+func EncryptReusing(ctx context.Context, provider Provider, decryptedSecret secretsv1alpha1.DecryptedSecret,
+	previous *secretsv1alpha1.EncryptedSecret) (*secretsv1alpha1.EncryptedSecret, int, error) {
 
-		// Access the secret data
-		keyPhrase := string(secret.Data["tls.crt"])
+	encryptedSecret := &secretsv1alpha1.EncryptedSecret{
+		ObjectMeta: decryptedSecret.ObjectMeta,
+		TypeMeta: v1.TypeMeta{
+			Kind:       "EncryptedSecret",
+			APIVersion: "secrets.opensecrecy.org/v1alpha1",
+		},
+		Type: decryptedSecret.Type,
+	}
 
-		// ToDo: plan is to eventually mode this repeated code to a separate util or something.
-		// need to figure out a way to avoid this code repetition
-		for key, value := range decryptedSecret.Data {
-			encrypted, err := staticEncryptAndEncode(value, keyPhrase)
-			if err != nil || encrypted == "" {
-				return nil, fmt.Errorf("failed to encrypt the data %s", err.Error())
+	var primaryKeyVersion string
+	if previous != nil && len(previous.Data) > 0 {
+		var err error
+		if primaryKeyVersion, err = provider.PrimaryKeyVersion(ctx); err != nil {
+			return nil, 0, err
+		}
+	}
 
+	encryptedMap := make(map[string]string, len(decryptedSecret.Data))
+	encrypted := 0
+	for key, value := range decryptedSecret.Data {
+		if previous != nil && previous.Data[key] != "" {
+			decoded, keyVersion, err := provider.Decrypt(ctx, previous.Data[key])
+			if err == nil && keyVersion == primaryKeyVersion && subtle.ConstantTimeCompare([]byte(decoded), []byte(value)) == 1 {
+				encryptedMap[key] = previous.Data[key]
+				continue
 			}
-			encryptedMap[key] = encrypted
 		}
-		encryptedSecret.Data = encryptedMap
-		return encryptedSecret, nil
-
-	case "aws-kms":
-		// credentials from the shared credentials file ~/.aws/credentials.
-		// ToDo: commonize the client creation code
-		cfg, err := config.LoadDefaultConfig(context.TODO())
+		ciphertext, err := provider.Encrypt(ctx, value)
 		if err != nil {
-			return nil, err
-		}
-		client := kms.NewFromConfig(cfg)
-
-		for key, value := range decryptedSecret.Data {
-			encrypted, err := client.Encrypt(context.TODO(), &kms.EncryptInput{
-				KeyId:     aws.String("alias/cryptctl-key"),
-				Plaintext: []byte(value),
-			})
-			if err != nil {
-				return nil, err
-			}
-
-			encryptedMap[key] = base64.StdEncoding.EncodeToString(encrypted.CiphertextBlob)
+			return nil, 0, err
 		}
-		encryptedSecret.Data = encryptedMap
-		return encryptedSecret, nil
-	default:
-		return nil, fmt.Errorf("invalid provider %s", provider)
+		encryptedMap[key] = ciphertext
+		encrypted++
 	}
+	encryptedSecret.Data = encryptedMap
+	return encryptedSecret, encrypted, nil
+}
 
+func sortedKeys(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
 }
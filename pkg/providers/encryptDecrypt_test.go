@@ -0,0 +1,46 @@
+package providers
+
+import (
+	"context"
+	"testing"
+
+	secretsv1alpha1 "github.com/opensecrecy/encrypted-secrets/api/v1alpha1"
+)
+
+func TestEncryptReusingKeepsUnchangedCiphertexts(t *testing.T) {
+	ctx := context.Background()
+	keys := map[string]string{"1": "justRandomEncryptionKey", "2": "anotherRandomEncryptionKey"}
+	keyring, err := NewKeyring("1", keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := &k8sProvider{keyring: keyring}
+
+	decryptedSecret := secretsv1alpha1.DecryptedSecret{Data: map[string]string{"username": "admin", "password": "hunter2"}}
+	previous, encrypted, err := EncryptReusing(ctx, provider, decryptedSecret, nil)
+	if err != nil || encrypted != 2 {
+		t.Fatalf("expected both values to be encrypted, got %d, %v", encrypted, err)
+	}
+
+	decryptedSecret.Data = map[string]string{"username": "admin", "password": "hunter3", "host": "db"}
+	updated, encrypted, err := EncryptReusing(ctx, provider, decryptedSecret, previous)
+	if err != nil || encrypted != 2 {
+		t.Fatalf("expected the changed and added values to be encrypted, got %d, %v", encrypted, err)
+	}
+	if updated.Data["username"] != previous.Data["username"] || updated.Data["password"] == previous.Data["password"] {
+		t.Fatalf("expected only the unchanged ciphertext to be kept")
+	}
+
+	// values of a retired key are encrypted with the primary key again
+	rotated, err := NewKeyring("2", keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotatedSecret, encrypted, err := EncryptReusing(ctx, &k8sProvider{keyring: rotated}, decryptedSecret, updated)
+	if err != nil || encrypted != 3 {
+		t.Fatalf("expected every value to be encrypted with the new key, got %d, %v", encrypted, err)
+	}
+	if _, version, _ := rotated.Decrypt(rotatedSecret.Data["username"]); version != "2" {
+		t.Fatalf("expected key version 2, got %q", version)
+	}
+}
@@ -0,0 +1,51 @@
+package providers
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+)
+
+// keyIDMagic starts every ciphertext that carries the id of the key it was
+// encrypted with. It is followed by the header version, the length of the key
+// id and the key id itself. The whole header is authenticated as additional
+// data, so it can't be swapped without failing decryption.
+var keyIDMagic = []byte("ES")
+
+const keyIDHeaderVersion = 1
+
+// encodeKeyIDHeader returns the header announcing keyID
+func encodeKeyIDHeader(keyID string) ([]byte, error) {
+	if keyID == "" || len(keyID) > 255 {
+		return nil, fmt.Errorf("invalid key id %q", keyID)
+	}
+	header := append([]byte{}, keyIDMagic...)
+	header = append(header, keyIDHeaderVersion, byte(len(keyID)))
+	return append(header, keyID...), nil
+}
+
+// splitKeyIDHeader splits ciphered into its header, the key id from the header
+// and the remaining ciphertext. ok is false for ciphertexts without a header.
+func splitKeyIDHeader(ciphered []byte) (header []byte, keyID string, rest []byte, ok bool) {
+	prefixLen := len(keyIDMagic) + 2
+	if len(ciphered) < prefixLen || !bytes.HasPrefix(ciphered, keyIDMagic) || ciphered[len(keyIDMagic)] != keyIDHeaderVersion {
+		return nil, "", nil, false
+	}
+	idLen := int(ciphered[prefixLen-1])
+	if idLen == 0 || len(ciphered) < prefixLen+idLen {
+		return nil, "", nil, false
+	}
+	headerLen := prefixLen + idLen
+	return ciphered[:headerLen], string(ciphered[prefixLen:headerLen]), ciphered[headerLen:], true
+}
+
+// KeyID returns the id of the key encoded was encrypted with, if its
+// ciphertext carries a key id header
+func KeyID(encoded string) (string, bool) {
+	ciphered, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", false
+	}
+	_, keyID, _, ok := splitKeyIDHeader(ciphered)
+	return keyID, ok
+}
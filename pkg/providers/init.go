@@ -0,0 +1,136 @@
+package providers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/kms/types"
+	"github.com/opensecrecy/encrypted-secrets/pkg/providers/utils"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// KeyTypePassphrase is a random passphrase of the k8s provider
+	KeyTypePassphrase = "passphrase"
+	// KeyTypeX25519 is an X25519 key of the k8s provider, whose public key can
+	// be exported into a key bundle
+	KeyTypeX25519 = "x25519"
+
+	// k8sPassphraseSize is the number of random bytes of a new k8s passphrase
+	k8sPassphraseSize = 32
+)
+
+// InitKey creates the key of the provider selected by cfg and returns its version.
+// For k8s that is a key secret in cfg.Namespace holding a key of keyType, for
+// aws-kms a symmetric KMS key under the alias cfg.KMSKeyID. Existing keys are
+// never replaced.
+func InitKey(ctx context.Context, cfg Config, keyType string) (string, error) {
+	switch cfg.Provider {
+	case K8sProvider:
+		return initK8sKey(ctx, cfg, keyType)
+	case AWSKMSProvider:
+		return initKMSKey(ctx, cfg)
+	default:
+		return "", fmt.Errorf("invalid provider %s", cfg.Provider)
+	}
+}
+
+func initK8sKey(ctx context.Context, cfg Config, keyType string) (string, error) {
+	if cfg.Namespace == "" {
+		return "", errors.New("the k8s provider needs a namespace")
+	}
+	name := cfg.KeySecretName
+	if name == "" {
+		name = K8sKeySecretName
+	}
+
+	key, err := GenerateK8sKey(keyType)
+	if err != nil {
+		return "", err
+	}
+
+	k8sClient, err := utils.GetKubeClient()
+	if err != nil {
+		return "", fmt.Errorf("failed to get kubeclient %v", err)
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: v1.ObjectMeta{
+			Name:        name,
+			Namespace:   cfg.Namespace,
+			Annotations: map[string]string{K8sKeyVersionAnnotation: defaultK8sKeyVersion},
+		},
+		Data: map[string][]byte{
+			k8sKeyField: []byte(key),
+		},
+	}
+	_, err = k8sClient.CoreV1().Secrets(cfg.Namespace).Create(ctx, secret, v1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		return "", fmt.Errorf("key secret %s already exists in namespace %s", name, cfg.Namespace)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to create the secret %v", err)
+	}
+	return defaultK8sKeyVersion, nil
+}
+
+// GenerateK8sKey returns a new key of keyType in the form the key secret or a
+// keyring of the k8s provider holds it
+func GenerateK8sKey(keyType string) (string, error) {
+	switch keyType {
+	case "", KeyTypePassphrase:
+		passphrase := make([]byte, k8sPassphraseSize)
+		if _, err := rand.Read(passphrase); err != nil {
+			return "", err
+		}
+		return base64.StdEncoding.EncodeToString(passphrase), nil
+	case KeyTypeX25519:
+		return generateX25519Key()
+	default:
+		return "", fmt.Errorf("invalid key type %s", keyType)
+	}
+}
+
+func initKMSKey(ctx context.Context, cfg Config) (string, error) {
+	alias := kmsKeyID(cfg)
+	if !strings.HasPrefix(alias, "alias/") {
+		return "", fmt.Errorf("new KMS keys are created under an alias, got %s", alias)
+	}
+
+	client, err := newKMSClient(ctx, cfg)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = client.DescribeKey(ctx, &kms.DescribeKeyInput{KeyId: aws.String(alias)})
+	if err == nil {
+		return "", fmt.Errorf("KMS key %s already exists", alias)
+	}
+	var notFound *types.NotFoundException
+	if !errors.As(err, &notFound) {
+		return "", err
+	}
+
+	created, err := client.CreateKey(ctx, &kms.CreateKeyInput{
+		Description: aws.String("encrypted-secrets"),
+		KeySpec:     types.KeySpecSymmetricDefault,
+		KeyUsage:    types.KeyUsageTypeEncryptDecrypt,
+	})
+	if err != nil {
+		return "", err
+	}
+	if _, err := client.CreateAlias(ctx, &kms.CreateAliasInput{
+		AliasName:   aws.String(alias),
+		TargetKeyId: created.KeyMetadata.KeyId,
+	}); err != nil {
+		return "", err
+	}
+	return aws.ToString(created.KeyMetadata.Arn), nil
+}
@@ -0,0 +1,145 @@
+package providers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/opensecrecy/encrypted-secrets/pkg/providers/utils"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// K8sKeyringSecretName is the secret holding the named keys of the k8s provider.
+	// Every data entry is a key, the entry name being its key id.
+	K8sKeyringSecretName = "cryptctl-keyring"
+	// K8sPrimaryKeyAnnotation names the key of the keyring secret new values are encrypted with
+	K8sPrimaryKeyAnnotation = "secrets.opensecrecy.org/primary-key"
+
+	// K8sKeySecretName is the secret holding the passphrases of the k8s provider
+	// in namespaces without a keyring secret
+	K8sKeySecretName = "cryptctl-key"
+	// K8sKeyVersionAnnotation records the version of the current passphrase on the key secret
+	K8sKeyVersionAnnotation = "secrets.opensecrecy.org/key-version"
+
+	// k8sKeyField holds the current passphrase. Retired passphrases are kept
+	// next to it as tls.crt.<version> so that old values can still be decrypted.
+	k8sKeyField          = "tls.crt"
+	defaultK8sKeyVersion = "1"
+)
+
+type k8sProvider struct {
+	keyring *Keyring
+	// deterministic makes Encrypt return the same ciphertext for the same value
+	deterministic bool
+}
+
+func newK8sProvider(ctx context.Context, cfg Config) (*k8sProvider, error) {
+	k8sClient, err := utils.GetKubeClient()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get kubeclient %v", err)
+	}
+	secrets := k8sClient.CoreV1().Secrets(cfg.Namespace)
+
+	// a configured secret is a keyring when it names its primary key
+	if cfg.KeySecretName != "" {
+		secret, err := secrets.Get(ctx, cfg.KeySecretName, v1.GetOptions{})
+		if err != nil {
+			return nil, keySecretError(cfg.Namespace, cfg.KeySecretName, err)
+		}
+		if _, ok := secret.Annotations[K8sPrimaryKeyAnnotation]; ok {
+			return newK8sProviderFromKeyring(keyringFromSecret(secret))
+		}
+		return newK8sProviderFromKeyring(keyringFromKeySecret(secret))
+	}
+
+	// Retrieve the keyring from the Kubernetes cluster, falling back to the key secret
+	secret, err := secrets.Get(ctx, K8sKeyringSecretName, v1.GetOptions{})
+	if err == nil {
+		return newK8sProviderFromKeyring(keyringFromSecret(secret))
+	}
+	if !apierrors.IsNotFound(err) {
+		return nil, fmt.Errorf("failed to get the secret %v", err)
+	}
+
+	secret, err = secrets.Get(ctx, K8sKeySecretName, v1.GetOptions{})
+	if err != nil {
+		return nil, keySecretError(cfg.Namespace, K8sKeySecretName, err)
+	}
+	return newK8sProviderFromKeyring(keyringFromKeySecret(secret))
+}
+
+// keySecretError reports a key secret that doesn't exist as a KeyMissingError
+func keySecretError(namespace, name string, err error) error {
+	if apierrors.IsNotFound(err) {
+		return NewKeyMissingError(fmt.Sprintf("key secret %s not found in namespace %s", name, namespace))
+	}
+	return fmt.Errorf("failed to get the secret %v", err)
+}
+
+func newK8sProviderFromKeyring(keyring *Keyring, err error) (*k8sProvider, error) {
+	if err != nil {
+		return nil, err
+	}
+	return &k8sProvider{keyring: keyring}, nil
+}
+
+// keyringFromSecret reads the named keys of a keyring secret
+func keyringFromSecret(secret *corev1.Secret) (*Keyring, error) {
+	primary := secret.Annotations[K8sPrimaryKeyAnnotation]
+	if primary == "" {
+		return nil, fmt.Errorf("keyring secret %s has no %s annotation", secret.Name, K8sPrimaryKeyAnnotation)
+	}
+
+	keys := make(map[string]string, len(secret.Data))
+	for keyID, value := range secret.Data {
+		keys[keyID] = string(value)
+	}
+	return NewKeyring(primary, keys)
+}
+
+// keyringFromKeySecret reads the versioned passphrases of a key secret
+func keyringFromKeySecret(secret *corev1.Secret) (*Keyring, error) {
+	primary := secret.Annotations[K8sKeyVersionAnnotation]
+	if primary == "" {
+		primary = defaultK8sKeyVersion
+	}
+
+	keys := make(map[string]string)
+	for field, value := range secret.Data {
+		if version, ok := strings.CutPrefix(field, k8sKeyField+"."); ok && version != "" {
+			keys[version] = string(value)
+		}
+	}
+	// the current passphrase always wins over a retired one with the same version
+	keys[primary] = string(secret.Data[k8sKeyField])
+
+	return NewKeyring(primary, keys)
+}
+
+func (p *k8sProvider) Encrypt(_ context.Context, value string) (string, error) {
+	encrypt := p.keyring.Encrypt
+	if p.deterministic {
+		encrypt = p.keyring.EncryptDeterministic
+	}
+	encrypted, err := encrypt(value)
+	if err != nil || encrypted == "" {
+		return "", fmt.Errorf("failed to encrypt the data %v", err)
+	}
+	return encrypted, nil
+}
+
+func (p *k8sProvider) Decrypt(_ context.Context, encoded string) (string, string, error) {
+	return p.keyring.Decrypt(encoded)
+}
+
+func (p *k8sProvider) PrimaryKeyVersion(_ context.Context) (string, error) {
+	return p.keyring.Primary(), nil
+}
+
+// KeyIDs returns the ids of the keys of the keyring, primary first
+func (p *k8sProvider) KeyIDs(_ context.Context) ([]string, error) {
+	return p.keyring.KeyIDs(), nil
+}
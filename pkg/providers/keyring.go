@@ -0,0 +1,123 @@
+package providers
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sort"
+)
+
+// Keyring holds every passphrase of a static provider by key id. New values are
+// encrypted with the primary key only and carry its id in the ciphertext header,
+// while values encrypted with any of the other keys can still be decrypted
+// until they are rotated.
+type Keyring struct {
+	primary string
+	keys    map[string]string
+}
+
+// NewKeyring returns a keyring for keys, where keys maps a key id to its passphrase
+func NewKeyring(primary string, keys map[string]string) (*Keyring, error) {
+	if _, ok := keys[primary]; !ok {
+		return nil, NewKeyMissingError(fmt.Sprintf("primary key %s not found in keyring", primary))
+	}
+	return &Keyring{primary: primary, keys: keys}, nil
+}
+
+// Primary returns the id of the key used for encryption
+func (k *Keyring) Primary() string {
+	return k.primary
+}
+
+// KeyIDs returns the ids of all keys in the keyring, primary first
+func (k *Keyring) KeyIDs() []string {
+	keyIDs := make([]string, 0, len(k.keys))
+	for keyID := range k.keys {
+		if keyID != k.primary {
+			keyIDs = append(keyIDs, keyID)
+		}
+	}
+	sort.Strings(keyIDs)
+	return append([]string{k.primary}, keyIDs...)
+}
+
+// Encrypt encrypts value with the primary key
+func (k *Keyring) Encrypt(value string) (string, error) {
+	header, err := encodeKeyIDHeader(k.primary)
+	if err != nil {
+		return "", err
+	}
+	privateKey, ok, err := parseX25519Key(k.keys[k.primary])
+	if err != nil {
+		return "", err
+	}
+	if ok {
+		return x25519SealAndEncode(value, privateKey.PublicKey(), header)
+	}
+	return staticEncryptAndEncode(value, k.keys[k.primary], header)
+}
+
+// EncryptDeterministic encrypts value with the primary key like Encrypt, but the
+// same value always gives the same ciphertext, which reveals values that are
+// equal. Only passphrases support it, values sealed to an X25519 key need a
+// fresh ephemeral key.
+func (k *Keyring) EncryptDeterministic(value string) (string, error) {
+	header, err := encodeKeyIDHeader(k.primary)
+	if err != nil {
+		return "", err
+	}
+	if _, ok, err := parseX25519Key(k.keys[k.primary]); err != nil || ok {
+		return "", fmt.Errorf("the primary key %s is an x25519 key, only passphrases can encrypt deterministically", k.primary)
+	}
+	return staticEncryptDeterministic(value, k.keys[k.primary], header)
+}
+
+// Decrypt decrypts encoded with the key named in its header and returns the
+// plaintext along with the key id
+func (k *Keyring) Decrypt(encoded string) (string, string, error) {
+	ciphered, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", "", err
+	}
+
+	header, keyID, rest, ok := splitKeyIDHeader(ciphered)
+	if ok {
+		if keyPhrase, found := k.keys[keyID]; found {
+			if decoded, err := openWithKey(rest, keyPhrase, header); err == nil {
+				return decoded, keyID, nil
+			}
+		}
+	}
+
+	// ciphertexts written before key ids were added to the header carry no key
+	// id. AES-GCM authenticates the ciphertext, so trying the wrong key fails
+	// instead of returning garbage.
+	var lastErr error
+	for _, candidate := range k.KeyIDs() {
+		decoded, err := staticOpen(ciphered, k.keys[candidate], nil)
+		if err == nil {
+			return decoded, candidate, nil
+		}
+		lastErr = err
+	}
+
+	if ok {
+		if _, found := k.keys[keyID]; !found {
+			return "", "", NewKeyMissingError(fmt.Sprintf("key %s not found in keyring", keyID))
+		}
+		return "", "", fmt.Errorf("failed to decrypt the value with key %s", keyID)
+	}
+	return "", "", fmt.Errorf("no key in keyring can decrypt the value: %v", lastErr)
+}
+
+// openWithKey decrypts ciphered with key, which is either a passphrase or an
+// X25519 private key
+func openWithKey(ciphered []byte, key string, header []byte) (string, error) {
+	privateKey, ok, err := parseX25519Key(key)
+	if err != nil {
+		return "", err
+	}
+	if ok {
+		return x25519Open(ciphered, privateKey, header)
+	}
+	return staticOpen(ciphered, key, header)
+}
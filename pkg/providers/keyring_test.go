@@ -0,0 +1,171 @@
+package providers
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestKeyringDecryptsWithRetiredKeys(t *testing.T) {
+	keyring, err := NewKeyring("2", map[string]string{
+		"1": "justRandomEncryptionKey",
+		"2": "anotherRandomEncryptionKey",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// encrypted with version 1 before the rotation
+	decoded, version, err := keyring.Decrypt("VdnNsF55TFX9kRiorzy0XPJQRK0FlICFntVqgEMeGOqq+IZfpHmr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded != "hello-world" || version != "1" {
+		t.Fatalf("got %q with key version %q, want %q with key version %q", decoded, version, "hello-world", "1")
+	}
+
+	encrypted, err := keyring.Encrypt("hello-world")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, version, _ = keyring.Decrypt(encrypted); version != "2" {
+		t.Fatalf("new values are encrypted with key version %q, want %q", version, "2")
+	}
+}
+
+func TestKeyringRejectsUnknownKeys(t *testing.T) {
+	if _, err := NewKeyring("3", map[string]string{"1": "justRandomEncryptionKey"}); !IsKeyMissingError(err) {
+		t.Fatalf("expected a KeyMissingError for a missing primary key, got %v", err)
+	}
+
+	keyring, err := NewKeyring("1", map[string]string{"1": "anotherRandomEncryptionKey"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := keyring.Decrypt("VdnNsF55TFX9kRiorzy0XPJQRK0FlICFntVqgEMeGOqq+IZfpHmr"); err == nil {
+		t.Fatal("expected an error when no key matches")
+	}
+	if _, _, err := keyring.Decrypt("c2hvcnQ="); err == nil {
+		t.Fatal("expected an error for a truncated ciphertext")
+	}
+}
+
+func TestKeyringReportsMissingKeys(t *testing.T) {
+	keyring, err := NewKeyring("1", map[string]string{"1": "justRandomEncryptionKey"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewKeyring("2", map[string]string{"2": "anotherRandomEncryptionKey"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := other.Encrypt("hello-world")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = keyring.Decrypt(encrypted)
+	if !IsKeyMissingError(err) {
+		t.Fatalf("expected a KeyMissingError for a value encrypted with an unknown key, got %v", err)
+	}
+	if strings.Contains(err.Error(), "hello-world") {
+		t.Fatalf("the error %q contains the plaintext", err)
+	}
+}
+
+func TestKeyringWritesKeyIDHeader(t *testing.T) {
+	keyring, err := NewKeyring("team-a-2023", map[string]string{
+		"team-a-2022": "justRandomEncryptionKey",
+		"team-a-2023": "anotherRandomEncryptionKey",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encrypted, err := keyring.Encrypt("hello-world")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyID, ok := KeyID(encrypted); !ok || keyID != "team-a-2023" {
+		t.Fatalf("got key id %q (%v), want %q", keyID, ok, "team-a-2023")
+	}
+	if _, ok := KeyID("VdnNsF55TFX9kRiorzy0XPJQRK0FlICFntVqgEMeGOqq+IZfpHmr"); ok {
+		t.Fatal("legacy ciphertexts carry no key id")
+	}
+
+	decoded, keyID, err := keyring.Decrypt(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded != "hello-world" || keyID != "team-a-2023" {
+		t.Fatalf("got %q with key %q", decoded, keyID)
+	}
+
+	// a keyring without the key named in the header must not decrypt the value
+	other, err := NewKeyring("team-a-2022", map[string]string{"team-a-2022": "justRandomEncryptionKey"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := other.Decrypt(encrypted); err == nil || !strings.Contains(err.Error(), "team-a-2023 not found") {
+		t.Fatalf("expected a missing key error, got %v", err)
+	}
+}
+
+func TestKeyringRejectsTamperedHeader(t *testing.T) {
+	// both keys share a passphrase, so only the authenticated header tells them apart
+	keyring, err := NewKeyring("aa", map[string]string{
+		"aa": "justRandomEncryptionKey",
+		"bb": "justRandomEncryptionKey",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := keyring.Encrypt("hello-world")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ciphered, _ := base64.StdEncoding.DecodeString(encrypted)
+	copy(ciphered[4:], "bb")
+	if _, _, err := keyring.Decrypt(base64.StdEncoding.EncodeToString(ciphered)); err == nil {
+		t.Fatal("expected decryption to fail after the key id was changed")
+	}
+}
+
+func TestKeyringEncryptsDeterministically(t *testing.T) {
+	keyring, err := NewKeyring("1", map[string]string{"1": "justRandomEncryptionKey"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := keyring.EncryptDeterministic("hello-world")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := keyring.EncryptDeterministic("hello-world")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := keyring.EncryptDeterministic("hello-world!")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second || first == other {
+		t.Fatalf("expected equal ciphertexts for equal values only, got %q, %q and %q", first, second, other)
+	}
+	if decoded, _, err := keyring.Decrypt(first); err != nil || decoded != "hello-world" {
+		t.Fatalf("got %q, %v, want %q", decoded, err, "hello-world")
+	}
+
+	x25519Key, err := generateX25519Key()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := NewKeyring("1", map[string]string{"1": x25519Key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sealed.EncryptDeterministic("hello-world"); err == nil {
+		t.Fatal("expected x25519 keys to refuse deterministic encryption")
+	}
+}
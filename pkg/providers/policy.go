@@ -0,0 +1,157 @@
+package providers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// AllowedProvidersAnnotation lists the providers the EncryptedSecrets of a
+	// namespace may use
+	AllowedProvidersAnnotation = "secrets.opensecrecy.org/allowed-providers"
+	// AllowedKeyIDsAnnotation lists patterns of the keys the EncryptedSecrets of a
+	// namespace may be decrypted with
+	AllowedKeyIDsAnnotation = "secrets.opensecrecy.org/allowed-key-ids"
+)
+
+// Policy restricts the providers and keys that may be used to decrypt. An empty
+// list allows everything.
+type Policy struct {
+	// Providers lists the names of the allowed providers
+	Providers []string
+	// KeyIDs lists patterns of the allowed key ids, in the syntax of path.Match.
+	// A pattern matches a key id, or for KMS key ARNs the part after the last /.
+	KeyIDs []string
+}
+
+// PolicyError is returned when a policy refuses a provider or a key
+type PolicyError struct {
+	msg string
+}
+
+// NewPolicyError returns a PolicyError with the message msg
+func NewPolicyError(msg string) *PolicyError {
+	return &PolicyError{msg: msg}
+}
+
+func (e *PolicyError) Error() string {
+	return e.msg
+}
+
+// IsPolicyError reports whether err was returned because a policy refused it
+func IsPolicyError(err error) bool {
+	var policyErr *PolicyError
+	return errors.As(err, &policyErr)
+}
+
+// ParsePolicyList splits a comma separated list as used in annotations and flags
+func ParsePolicyList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// PolicyFromAnnotations returns the policy held by the annotations of obj and
+// whether obj has any policy annotation
+func PolicyFromAnnotations(obj v1.Object) (Policy, bool) {
+	providers, hasProviders := obj.GetAnnotations()[AllowedProvidersAnnotation]
+	keyIDs, hasKeyIDs := obj.GetAnnotations()[AllowedKeyIDsAnnotation]
+	return Policy{
+		Providers: ParsePolicyList(providers),
+		KeyIDs:    ParsePolicyList(keyIDs),
+	}, hasProviders || hasKeyIDs
+}
+
+// CheckProvider returns a PolicyError unless the provider called name is allowed
+func (p Policy) CheckProvider(name string) error {
+	if len(p.Providers) == 0 {
+		return nil
+	}
+	for _, allowed := range p.Providers {
+		if allowed == name {
+			return nil
+		}
+	}
+	return NewPolicyError(fmt.Sprintf("provider %s is not allowed by policy", name))
+}
+
+// CheckKeyID returns a PolicyError unless the key keyID is allowed
+func (p Policy) CheckKeyID(keyID string) error {
+	if len(p.KeyIDs) == 0 {
+		return nil
+	}
+	short := keyID[strings.LastIndex(keyID, "/")+1:]
+	for _, pattern := range p.KeyIDs {
+		if matched, _ := path.Match(pattern, keyID); matched {
+			return nil
+		}
+		if matched, _ := path.Match(pattern, short); matched {
+			return nil
+		}
+	}
+	return NewPolicyError(fmt.Sprintf("key %s is not allowed by policy", keyID))
+}
+
+// WithPolicies returns provider restricted to the keys every policy allows. Values
+// naming their key in a header are refused before they are decrypted, the others
+// once the provider reports the key, so their plaintext is never returned.
+func WithPolicies(provider Provider, policies ...Policy) Provider {
+	return &policyProvider{provider: provider, policies: policies}
+}
+
+type policyProvider struct {
+	provider Provider
+	policies []Policy
+}
+
+func (p *policyProvider) checkKeyID(keyID string) error {
+	for _, policy := range p.policies {
+		if err := policy.CheckKeyID(keyID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *policyProvider) Encrypt(ctx context.Context, value string) (string, error) {
+	primary, err := p.provider.PrimaryKeyVersion(ctx)
+	if err != nil {
+		return "", err
+	}
+	if err := p.checkKeyID(primary); err != nil {
+		return "", err
+	}
+	return p.provider.Encrypt(ctx, value)
+}
+
+func (p *policyProvider) Decrypt(ctx context.Context, encoded string) (string, string, error) {
+	if keyID, ok := KeyID(encoded); ok {
+		if err := p.checkKeyID(keyID); err != nil {
+			return "", "", err
+		}
+	}
+	decoded, keyVersion, err := p.provider.Decrypt(ctx, encoded)
+	if err != nil {
+		return "", "", err
+	}
+	// the sops provider reports every master key it used
+	for _, keyID := range strings.Split(keyVersion, ",") {
+		if err := p.checkKeyID(keyID); err != nil {
+			return "", "", err
+		}
+	}
+	return decoded, keyVersion, nil
+}
+
+func (p *policyProvider) PrimaryKeyVersion(ctx context.Context) (string, error) {
+	return p.provider.PrimaryKeyVersion(ctx)
+}
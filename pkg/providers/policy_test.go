@@ -0,0 +1,56 @@
+package providers
+
+import (
+	"context"
+	"testing"
+)
+
+func TestPolicyMatchesKeyIDs(t *testing.T) {
+	policy := Policy{KeyIDs: ParsePolicyList("team-a-*, 1234abcd-12ab-34cd-56ef-1234567890ab")}
+
+	for _, keyID := range []string{
+		"team-a-2023",
+		"arn:aws:kms:eu-west-1:111122223333:key/1234abcd-12ab-34cd-56ef-1234567890ab",
+	} {
+		if err := policy.CheckKeyID(keyID); err != nil {
+			t.Errorf("key %s: %v", keyID, err)
+		}
+	}
+	if err := policy.CheckKeyID("team-b-2023"); !IsPolicyError(err) {
+		t.Errorf("expected a policy error for team-b-2023, got %v", err)
+	}
+	if err := (Policy{}).CheckKeyID("team-b-2023"); err != nil {
+		t.Errorf("an empty policy refused a key: %v", err)
+	}
+	if err := (Policy{Providers: []string{K8sProvider}}).CheckProvider(AWSKMSProvider); !IsPolicyError(err) {
+		t.Errorf("expected a policy error for %s, got %v", AWSKMSProvider, err)
+	}
+}
+
+func TestPolicyRefusesKeysBeforeDecrypting(t *testing.T) {
+	keyring, err := NewKeyring("team-b-2023", map[string]string{
+		"team-a-2023": "justRandomEncryptionKey",
+		"team-b-2023": "anotherRandomEncryptionKey",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := keyring.Encrypt("hello-world")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	provider := WithPolicies(&k8sProvider{keyring: keyring}, Policy{KeyIDs: []string{"team-a-*"}})
+	if _, _, err := provider.Decrypt(context.TODO(), encrypted); !IsPolicyError(err) {
+		t.Fatalf("expected a policy error, got %v", err)
+	}
+	if _, err := provider.Encrypt(context.TODO(), "hello-world"); !IsPolicyError(err) {
+		t.Fatalf("expected a policy error when encrypting with a forbidden primary key, got %v", err)
+	}
+
+	// values without a key id header are refused once the key is known
+	legacy := WithPolicies(&k8sProvider{keyring: keyring}, Policy{KeyIDs: []string{"team-b-*"}})
+	if _, _, err := legacy.Decrypt(context.TODO(), "VdnNsF55TFX9kRiorzy0XPJQRK0FlICFntVqgEMeGOqq+IZfpHmr"); !IsPolicyError(err) {
+		t.Fatalf("expected a policy error for a legacy value, got %v", err)
+	}
+}
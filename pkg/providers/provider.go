@@ -0,0 +1,172 @@
+package providers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// ProviderAnnotation selects the provider used to encrypt and decrypt the values
+	ProviderAnnotation = "secrets.opensecrecy.org/provider"
+	// KMSKeyIDAnnotation overrides the KMS key that aws-kms encrypts new values with
+	KMSKeyIDAnnotation = "secrets.opensecrecy.org/kms-key-id"
+	// DeterministicAnnotation makes the k8s provider encrypt the same value to the
+	// same ciphertext when it is "true", so that encrypting unchanged values again
+	// leaves manifests unchanged
+	DeterministicAnnotation = "secrets.opensecrecy.org/deterministic"
+
+	K8sProvider    = "k8s"
+	AWSKMSProvider = "aws-kms"
+)
+
+// Provider encrypts and decrypts single values for one EncryptedSecret
+type Provider interface {
+	// Encrypt encrypts value with the primary key and returns it base64 encoded
+	Encrypt(ctx context.Context, value string) (string, error)
+	// Decrypt decodes and decrypts encoded and returns the plaintext together
+	// with the version of the key that was used
+	Decrypt(ctx context.Context, encoded string) (string, string, error)
+	// PrimaryKeyVersion returns the version of the key Encrypt uses
+	PrimaryKeyVersion(ctx context.Context) (string, error)
+}
+
+// KeyIDLister is implemented by providers that know the ids of every key they
+// decrypt with, without decrypting anything
+type KeyIDLister interface {
+	// KeyIDs returns the ids of the keys values can be decrypted with
+	KeyIDs(ctx context.Context) ([]string, error)
+}
+
+// KeyMissingError is returned when the key needed to encrypt or decrypt a value
+// doesn't exist
+type KeyMissingError struct {
+	msg string
+}
+
+// NewKeyMissingError returns a KeyMissingError with the message msg
+func NewKeyMissingError(msg string) *KeyMissingError {
+	return &KeyMissingError{msg: msg}
+}
+
+func (e *KeyMissingError) Error() string {
+	return e.msg
+}
+
+// IsKeyMissingError reports whether err was returned because a key doesn't exist
+func IsKeyMissingError(err error) bool {
+	var keyMissingErr *KeyMissingError
+	return errors.As(err, &keyMissingErr)
+}
+
+// Config selects and configures a provider
+type Config struct {
+	// Provider is the name of the provider, k8s, aws-kms or sops
+	Provider string
+
+	// Namespace holds the key secrets of the k8s and sops providers
+	Namespace string
+	// KeySecretName overrides the keyring or key secret of the k8s provider, or
+	// the age identities of the sops provider
+	KeySecretName string
+	// PGPKeySecretName overrides the PGP private keys of the sops provider
+	PGPKeySecretName string
+
+	// KMSKeyID is the KMS key aws-kms encrypts new values with
+	KMSKeyID string
+	// Region overrides the AWS region of the operator
+	Region string
+	// Credentials overrides the AWS credentials of the operator
+	Credentials aws.CredentialsProvider
+	// RoleARN is assumed before calling KMS when set
+	RoleARN string
+	// SOPSKMS makes the sops provider decrypt KMS master keys with the region,
+	// credentials and role above
+	SOPSKMS bool
+	// NamespacedAWSAuth makes aws-kms refuse the AWS credentials of the operator
+	// unless OperatorAWSCredentials is set, so that it needs Credentials. It is
+	// set for namespaced EncryptionProviders.
+	NamespacedAWSAuth bool
+	// OperatorAWSCredentials lets aws-kms use the AWS credentials of the operator,
+	// and assume RoleARN with them, despite NamespacedAWSAuth
+	OperatorAWSCredentials bool
+	// SOPSOperatorKeys makes the sops provider use the keys of the operator as
+	// well: the age identities of $SOPS_AGE_KEY or $SOPS_AGE_KEY_FILE, its AWS
+	// credentials and the keyring of gpg
+	SOPSOperatorKeys bool
+
+	// KeyBundle makes the k8s provider encrypt with the bundle instead of reading
+	// its keys from the cluster. Such a provider can't decrypt.
+	KeyBundle *KeyBundle
+
+	// Deterministic makes Encrypt return the same ciphertext for the same value.
+	// Only the k8s provider with a passphrase as its primary key supports it.
+	Deterministic bool
+}
+
+// ConfigFromAnnotations returns the provider configuration held by the
+// annotations of obj
+func ConfigFromAnnotations(obj v1.Object) Config {
+	return Config{
+		Provider:  obj.GetAnnotations()[ProviderAnnotation],
+		Namespace: obj.GetNamespace(),
+		KMSKeyID:  obj.GetAnnotations()[KMSKeyIDAnnotation],
+		// decrypting doesn't depend on it, values are decrypted either way
+		Deterministic: obj.GetAnnotations()[DeterministicAnnotation] == "true",
+	}
+}
+
+// NewProvider returns the provider selected by cfg
+func NewProvider(ctx context.Context, cfg Config) (Provider, error) {
+	switch cfg.Provider {
+	case K8sProvider:
+		if cfg.KeyBundle != nil {
+			if cfg.Deterministic {
+				return nil, errors.New("a key bundle can't encrypt deterministically")
+			}
+			return newBundleProvider(cfg.KeyBundle)
+		}
+		provider, err := newK8sProvider(ctx, cfg)
+		if err != nil {
+			return nil, err
+		}
+		provider.deterministic = cfg.Deterministic
+		return provider, nil
+	case SOPSProvider:
+		if cfg.KeyBundle != nil {
+			return nil, errors.New("the sops provider doesn't use key bundles")
+		}
+		return newSOPSProvider(ctx, cfg)
+	case AWSKMSProvider:
+		provider, err := newKMSProvider(ctx, cfg)
+		if err != nil {
+			return nil, err
+		}
+		if cfg.Deterministic {
+			return randomizedProvider{Provider: provider, name: AWSKMSProvider}, nil
+		}
+		return provider, nil
+	default:
+		return nil, fmt.Errorf("invalid provider %s", cfg.Provider)
+	}
+}
+
+// randomizedProvider wraps a provider that can't encrypt deterministically. It
+// still decrypts, but refuses to encrypt instead of silently returning a new
+// ciphertext every time.
+type randomizedProvider struct {
+	Provider
+	name string
+}
+
+func (p randomizedProvider) Encrypt(_ context.Context, _ string) (string, error) {
+	return "", fmt.Errorf("the %s provider can't encrypt deterministically, keep the previous ciphertexts instead", p.name)
+}
+
+// newProvider returns the provider selected by the annotations of obj
+func newProvider(ctx context.Context, obj v1.Object) (Provider, error) {
+	return NewProvider(ctx, ConfigFromAnnotations(obj))
+}
@@ -0,0 +1,50 @@
+package providers
+
+import (
+	"context"
+
+	secretsv1alpha1 "github.com/opensecrecy/encrypted-secrets/api/v1alpha1"
+)
+
+// Reencrypt re-encrypts every value of encryptedSecret that isn't encrypted with
+// the primary key of its provider yet. It returns a copy of encryptedSecret with
+// the rotated values and whether any value had to be rotated.
+func Reencrypt(ctx context.Context, encryptedSecret *secretsv1alpha1.EncryptedSecret) (*secretsv1alpha1.EncryptedSecret, bool, error) {
+
+	provider, err := newProvider(ctx, encryptedSecret)
+	if err != nil {
+		return nil, false, err
+	}
+	return ReencryptWithProvider(ctx, provider, encryptedSecret)
+}
+
+// ReencryptWithProvider re-encrypts encryptedSecret like Reencrypt, using provider
+func ReencryptWithProvider(ctx context.Context, provider Provider, encryptedSecret *secretsv1alpha1.EncryptedSecret) (*secretsv1alpha1.EncryptedSecret, bool, error) {
+
+	primary, err := provider.PrimaryKeyVersion(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+
+	rotated := encryptedSecret.DeepCopy()
+	changed := false
+
+	for key, value := range encryptedSecret.Data {
+		decoded, keyVersion, err := provider.Decrypt(ctx, value)
+		if err != nil {
+			return nil, false, err
+		}
+		if keyVersion == primary {
+			continue
+		}
+
+		encrypted, err := provider.Encrypt(ctx, decoded)
+		if err != nil {
+			return nil, false, err
+		}
+		rotated.Data[key] = encrypted
+		changed = true
+	}
+
+	return rotated, changed, nil
+}
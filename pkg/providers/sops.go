@@ -0,0 +1,195 @@
+package providers
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/opensecrecy/encrypted-secrets/pkg/providers/utils"
+	"github.com/opensecrecy/encrypted-secrets/pkg/sops"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	SOPSProvider = "sops"
+
+	// SOPSAgeKeySecretName is the secret holding the age identities of the sops
+	// provider, in the format of the key file of SOPS
+	SOPSAgeKeySecretName = "sops-age"
+	sopsAgeKeyField      = "keys.txt"
+	// SOPSPGPKeySecretName is the secret holding the armored PGP private keys of
+	// the sops provider
+	SOPSPGPKeySecretName = "sops-pgp"
+	sopsPGPKeyField      = "private.asc"
+)
+
+// sopsProvider decrypts documents encrypted by SOPS with the age identities and
+// PGP keys of the key secrets in its namespace, and KMS master keys with the AWS
+// credentials of its configuration. The keys of the operator are only used when
+// they are enabled. The role a document names for a KMS master key is never
+// assumed. It can't encrypt, the documents are encrypted with sops.
+type sopsProvider struct {
+	keys sops.Keys
+}
+
+func newSOPSProvider(ctx context.Context, cfg Config) (*sopsProvider, error) {
+	var keys sops.Keys
+	identities, err := sopsKeySecret(ctx, cfg.Namespace, cfg.KeySecretName, SOPSAgeKeySecretName, sopsAgeKeyField)
+	if err != nil {
+		return nil, err
+	}
+	if len(identities) > 0 {
+		if keys.Age, err = age.ParseIdentities(bytes.NewReader(identities)); err != nil {
+			return nil, fmt.Errorf("invalid age identities in %s of the age key secret %v", sopsAgeKeyField, err)
+		}
+	}
+	if keys.PGP, err = sopsKeySecret(ctx, cfg.Namespace, cfg.PGPKeySecretName, SOPSPGPKeySecretName, sopsPGPKeyField); err != nil {
+		return nil, err
+	}
+
+	if cfg.SOPSOperatorKeys {
+		identities, err := sops.LoadAgeIdentities()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the age identities of the operator %v", err)
+		}
+		keys.Age = append(keys.Age, identities...)
+		keys.GPG = true
+	}
+	if cfg.SOPSKMS || cfg.SOPSOperatorKeys {
+		awsConfig, err := loadAWSConfig(ctx, cfg)
+		if err != nil {
+			return nil, err
+		}
+		keys.AWS = &awsConfig
+	}
+	return &sopsProvider{keys: keys}, nil
+}
+
+// sopsKeySecret returns the field of the key secret name in namespace, or of the
+// secret defaultName when name is empty. Only a configured secret must exist.
+func sopsKeySecret(ctx context.Context, namespace, name, defaultName, field string) ([]byte, error) {
+	configured := name != ""
+	if !configured {
+		name = defaultName
+	}
+	k8sClient, err := utils.GetKubeClient()
+	if err != nil {
+		if !configured {
+			// without a cluster only the keys of the operator are used
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get kubeclient %v", err)
+	}
+
+	secret, err := k8sClient.CoreV1().Secrets(namespace).Get(ctx, name, v1.GetOptions{})
+	if apierrors.IsNotFound(err) && !configured {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, keySecretError(namespace, name, err)
+	}
+	if configured && len(secret.Data[field]) == 0 {
+		return nil, fmt.Errorf("secret %s has no %s", name, field)
+	}
+	return secret.Data[field], nil
+}
+
+func (p *sopsProvider) Encrypt(_ context.Context, _ string) (string, error) {
+	return "", errors.New("the sops provider can't encrypt, encrypt the document with sops instead")
+}
+
+// Decrypt decrypts a document encrypted by SOPS after checking its MAC and
+// returns its values as a JSON object. The key version lists the master keys the
+// data key was decrypted with, separated by commas.
+func (p *sopsProvider) Decrypt(ctx context.Context, document string) (string, string, error) {
+	plain, keyIDs, err := sops.DecryptWithKeyIDs(ctx, []byte(document), p.keys)
+	if err != nil {
+		return "", "", err
+	}
+	values, err := SOPSValues(plain)
+	if err != nil {
+		return "", "", err
+	}
+	encoded, err := json.Marshal(values)
+	if err != nil {
+		return "", "", err
+	}
+	return string(encoded), strings.Join(keyIDs, ","), nil
+}
+
+// PrimaryKeyVersion is empty, as the sops provider doesn't encrypt
+func (p *sopsProvider) PrimaryKeyVersion(_ context.Context) (string, error) {
+	return "", nil
+}
+
+// SOPSValues returns the values of a document decrypted by SOPS. The values of a
+// Secret are its data and stringData, those of a DecryptedSecret its data. Any
+// other document is a map of values.
+func SOPSValues(document []byte) (map[string]string, error) {
+	// numbers are kept as they are written instead of becoming floats
+	var fields map[string]interface{}
+	if err := yaml.Unmarshal(document, &fields, yaml.JSONOpt(func(d *json.Decoder) *json.Decoder {
+		d.UseNumber()
+		return d
+	})); err != nil {
+		return nil, err
+	}
+
+	switch fields["kind"] {
+	case "Secret":
+		values, err := scalarValues(fields["data"], "data")
+		if err != nil {
+			return nil, err
+		}
+		for key, value := range values {
+			decoded, err := base64.StdEncoding.DecodeString(value)
+			if err != nil {
+				return nil, fmt.Errorf("the value of data.%s isn't base64 encoded %v", key, err)
+			}
+			values[key] = string(decoded)
+		}
+		stringData, err := scalarValues(fields["stringData"], "stringData")
+		if err != nil {
+			return nil, err
+		}
+		for key, value := range stringData {
+			values[key] = value
+		}
+		return values, nil
+	case "DecryptedSecret":
+		return scalarValues(fields["data"], "data")
+	case nil:
+		return scalarValues(fields, "")
+	default:
+		return nil, fmt.Errorf("expected a Secret, DecryptedSecret or a map of values, got %v", fields["kind"])
+	}
+}
+
+// scalarValues returns the values of the map at path as strings
+func scalarValues(m interface{}, path string) (map[string]string, error) {
+	fields, ok := m.(map[string]interface{})
+	if !ok && m != nil {
+		return nil, fmt.Errorf("%s isn't a map", path)
+	}
+	values := make(map[string]string, len(fields))
+	for key, value := range fields {
+		switch value := value.(type) {
+		case string:
+			values[key] = value
+		case nil:
+			values[key] = ""
+		case map[string]interface{}, []interface{}:
+			return nil, fmt.Errorf("the value of %s isn't a scalar", strings.TrimPrefix(path+"."+key, "."))
+		default:
+			values[key] = fmt.Sprint(value)
+		}
+	}
+	return values, nil
+}
@@ -0,0 +1,110 @@
+package providers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	secretsv1alpha1 "github.com/opensecrecy/encrypted-secrets/api/v1alpha1"
+	"github.com/opensecrecy/encrypted-secrets/pkg/sops"
+)
+
+// testdata/secret.age.yaml was encrypted by sops 3.9.0 for the first identity
+// of testdata/age.txt
+
+func TestSOPSProviderDecryptsDocuments(t *testing.T) {
+	ctx := context.Background()
+	document, err := os.ReadFile(filepath.Join("testdata", "secret.age.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile, err := os.ReadFile(filepath.Join("testdata", "age.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	identities, err := age.ParseIdentities(bytes.NewReader(keyFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := &sopsProvider{keys: sops.Keys{Age: identities}}
+
+	encryptedSecret := &secretsv1alpha1.EncryptedSecret{Sops: string(document)}
+	decryptedSecret, keyVersions, err := DecryptWithProvider(ctx, provider, encryptedSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decryptedSecret.Data) != 3 || decryptedSecret.Data["username"] != "admin" ||
+		decryptedSecret.Data["password"] != "hunter2" || decryptedSecret.Data["port"] != "5432" {
+		t.Fatalf("unexpected values %v", decryptedSecret.Data)
+	}
+	if len(keyVersions) != 1 || keyVersions[0] != "age1agaju97fcnd5yhss5v49qp6n0ccrxk3w98sys73dqkg5fgjmps8s322wku" {
+		t.Fatalf("expected the age recipient as key version, got %v", keyVersions)
+	}
+
+	// the MAC is checked before any value is returned
+	encryptedSecret.Sops = strings.Replace(string(document), "name: db", "name: dc", 1)
+	if _, _, err := DecryptWithProvider(ctx, provider, encryptedSecret); !errors.Is(err, sops.ErrMACMismatch) {
+		t.Fatalf("expected a MAC mismatch, got %v", err)
+	}
+
+	// policies apply to the master keys
+	policy := Policy{KeyIDs: []string{"age1other*"}}
+	encryptedSecret.Sops = string(document)
+	if _, _, err := DecryptWithProvider(ctx, WithPolicies(provider, policy), encryptedSecret); !IsPolicyError(err) {
+		t.Fatalf("expected a policy error, got %v", err)
+	}
+
+	if _, err := provider.Encrypt(ctx, "hunter2"); err == nil {
+		t.Fatal("expected the sops provider to refuse encrypting")
+	}
+}
+
+func TestSOPSProviderUsesTheOperatorKeysWhenEnabled(t *testing.T) {
+	ctx := context.Background()
+	// no cluster, so no key secrets
+	t.Setenv("KUBECONFIG", filepath.Join(t.TempDir(), "missing"))
+	t.Setenv("SOPS_AGE_KEY_FILE", filepath.Join("testdata", "age.txt"))
+
+	provider, err := newSOPSProvider(ctx, Config{Provider: SOPSProvider, Namespace: "default"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(provider.keys.Age) != 0 || provider.keys.AWS != nil || provider.keys.GPG {
+		t.Fatalf("expected the keys of the operator to be left out, got %+v", provider.keys)
+	}
+
+	provider, err = newSOPSProvider(ctx, Config{Provider: SOPSProvider, Namespace: "default", SOPSOperatorKeys: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(provider.keys.Age) == 0 || provider.keys.AWS == nil || !provider.keys.GPG {
+		t.Fatalf("expected the keys of the operator, got %+v", provider.keys)
+	}
+
+	// the KMS master keys of a provider with its own credentials
+	provider, err = newSOPSProvider(ctx, Config{Provider: SOPSProvider, Namespace: "default", SOPSKMS: true, Region: "eu-west-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(provider.keys.Age) != 0 || provider.keys.AWS == nil || provider.keys.AWS.Region != "eu-west-1" {
+		t.Fatalf("expected only the AWS configuration of the provider, got %+v", provider.keys)
+	}
+}
+
+func TestSOPSValuesOfMaps(t *testing.T) {
+	values, err := SOPSValues([]byte("password: hunter2\nport: 5432\ntls: true\nempty:\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values["password"] != "hunter2" || values["port"] != "5432" || values["tls"] != "true" || values["empty"] != "" {
+		t.Fatalf("unexpected values %v", values)
+	}
+	if _, err := SOPSValues([]byte("hosts:\n- db-0\n")); err == nil {
+		t.Fatal("expected a sequence to be refused")
+	}
+}
@@ -3,56 +3,93 @@ package providers
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"errors"
 	"io"
 
 	"github.com/opensecrecy/encrypted-secrets/pkg/providers/utils"
 )
 
-func staticDecodeAndDecrypt(encoded string, keyPhrase string) (string, error) {
-	ciphered, _ := base64.StdEncoding.DecodeString(encoded)
-	hashedPhrase := utils.MdHashing(keyPhrase)
+// staticNonceKDFLabel separates the key of the synthetic nonces from the passphrase
+const staticNonceKDFLabel = "encrypted-secrets synthetic nonce "
 
-	aesBlock, err := aes.NewCipher([]byte(hashedPhrase))
+// staticEncryptAndEncode encrypts value and prepends header to the ciphertext.
+// The header is authenticated along with the value.
+func staticEncryptAndEncode(value string, keyPhrase string, header []byte) (string, error) {
+
+	gcmInstance, err := staticGCM(keyPhrase)
 	if err != nil {
 		return "", err
 	}
 
-	gcmInstance, err := cipher.NewGCM(aesBlock)
+	nonce := make([]byte, gcmInstance.NonceSize())
+	_, _ = io.ReadFull(rand.Reader, nonce)
+
+	return staticSealAndEncode(gcmInstance, value, nonce, header), nil
+}
+
+// staticEncryptDeterministic encrypts value like staticEncryptAndEncode, but
+// derives the nonce from the key, the header and value instead of drawing it at
+// random, like the synthetic IV of AES-SIV. The same value encrypted with the
+// same key always gives the same ciphertext, while different values practically
+// never share a nonce.
+func staticEncryptDeterministic(value string, keyPhrase string, header []byte) (string, error) {
+
+	gcmInstance, err := staticGCM(keyPhrase)
 	if err != nil {
 		return "", err
 	}
 
+	// the nonce key is derived apart from the encryption key
+	nonceKey := sha256.Sum256([]byte(staticNonceKDFLabel + keyPhrase))
+	mac := hmac.New(sha256.New, nonceKey[:])
+	mac.Write(header)
+	mac.Write([]byte(value))
 	nonceSize := gcmInstance.NonceSize()
-	nonce, cipheredText := ciphered[:nonceSize], ciphered[nonceSize:]
-	originalText, err := gcmInstance.Open(nil, nonce, cipheredText, nil)
-	if err != nil {
-		return "", err
-	}
+	nonce := mac.Sum(nil)[:nonceSize:nonceSize]
 
-	return string(originalText), nil
+	return staticSealAndEncode(gcmInstance, value, nonce, header), nil
+}
 
+// staticSealAndEncode seals value with nonce and returns the header, the nonce
+// and the sealed value base64 encoded
+func staticSealAndEncode(gcmInstance cipher.AEAD, value string, nonce, header []byte) string {
+	cipheredText := gcmInstance.Seal(nonce, nonce, []byte(value), header)
+
+	return base64.StdEncoding.EncodeToString(append(append([]byte{}, header...), cipheredText...))
 }
 
-func staticEncryptAndEncode(value string, keyPhrase string) (string, error) {
+// staticOpen decrypts ciphered, the nonce followed by the sealed value, which
+// was encrypted with header as additional data
+func staticOpen(ciphered []byte, keyPhrase string, header []byte) (string, error) {
 
-	aesBlock, err := aes.NewCipher([]byte(utils.MdHashing(keyPhrase)))
+	gcmInstance, err := staticGCM(keyPhrase)
 	if err != nil {
 		return "", err
 	}
 
-	gcmInstance, err := cipher.NewGCM(aesBlock)
+	nonceSize := gcmInstance.NonceSize()
+	if len(ciphered) < nonceSize {
+		return "", errors.New("ciphertext too short")
+	}
+	nonce, cipheredText := ciphered[:nonceSize], ciphered[nonceSize:]
+	originalText, err := gcmInstance.Open(nil, nonce, cipheredText, header)
 	if err != nil {
 		return "", err
 	}
 
-	nonce := make([]byte, gcmInstance.NonceSize())
-	_, _ = io.ReadFull(rand.Reader, nonce)
+	return string(originalText), nil
 
-	cipheredText := gcmInstance.Seal(nonce, nonce, []byte(value), nil)
+}
 
-	encoded := base64.StdEncoding.EncodeToString(cipheredText)
+func staticGCM(keyPhrase string) (cipher.AEAD, error) {
+	aesBlock, err := aes.NewCipher([]byte(utils.MdHashing(keyPhrase)))
+	if err != nil {
+		return nil, err
+	}
 
-	return encoded, nil
+	return cipher.NewGCM(aesBlock)
 }
@@ -0,0 +1,127 @@
+package providers
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// x25519KeyPrefix marks a key of a keyring as an X25519 private key instead
+	// of a passphrase. Values are sealed to its public key, so that they can be
+	// encrypted from a key bundle without the private key.
+	x25519KeyPrefix = "x25519:"
+
+	// x25519KDFLabel separates the keys derived here from other uses of the
+	// shared secret
+	x25519KDFLabel = "encrypted-secrets x25519"
+)
+
+// generateX25519Key returns a new X25519 private key in the form a keyring or
+// key secret holds it
+func generateX25519Key() (string, error) {
+	privateKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	return x25519KeyPrefix + base64.StdEncoding.EncodeToString(privateKey.Bytes()), nil
+}
+
+// parseX25519Key returns the private key held by key. ok is false for passphrases.
+func parseX25519Key(key string) (privateKey *ecdh.PrivateKey, ok bool, err error) {
+	encoded, ok := strings.CutPrefix(key, x25519KeyPrefix)
+	if !ok {
+		return nil, false, nil
+	}
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, true, fmt.Errorf("invalid x25519 key %v", err)
+	}
+	privateKey, err = ecdh.X25519().NewPrivateKey(raw)
+	if err != nil {
+		return nil, true, fmt.Errorf("invalid x25519 key %v", err)
+	}
+	return privateKey, true, nil
+}
+
+// x25519SealAndEncode encrypts value to publicKey and prepends header to the
+// ciphertext. A fresh ephemeral key is agreed with publicKey for every value
+// and follows the header, the header is authenticated along with the value.
+func x25519SealAndEncode(value string, publicKey *ecdh.PublicKey, header []byte) (string, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	shared, err := ephemeral.ECDH(publicKey)
+	if err != nil {
+		return "", err
+	}
+	gcmInstance, err := x25519GCM(shared, ephemeral.PublicKey(), publicKey)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcmInstance.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	ciphered := append(append([]byte{}, header...), ephemeral.PublicKey().Bytes()...)
+	ciphered = append(ciphered, nonce...)
+	ciphered = gcmInstance.Seal(ciphered, nonce, []byte(value), header)
+	return base64.StdEncoding.EncodeToString(ciphered), nil
+}
+
+// x25519Open decrypts ciphered, the ephemeral public key followed by the nonce
+// and the sealed value, which was encrypted with header as additional data
+func x25519Open(ciphered []byte, privateKey *ecdh.PrivateKey, header []byte) (string, error) {
+	keySize := len(privateKey.PublicKey().Bytes())
+	if len(ciphered) < keySize {
+		return "", errors.New("ciphertext too short")
+	}
+	ephemeral, err := ecdh.X25519().NewPublicKey(ciphered[:keySize])
+	if err != nil {
+		return "", err
+	}
+	shared, err := privateKey.ECDH(ephemeral)
+	if err != nil {
+		return "", err
+	}
+	gcmInstance, err := x25519GCM(shared, ephemeral, privateKey.PublicKey())
+	if err != nil {
+		return "", err
+	}
+
+	rest := ciphered[keySize:]
+	nonceSize := gcmInstance.NonceSize()
+	if len(rest) < nonceSize {
+		return "", errors.New("ciphertext too short")
+	}
+	originalText, err := gcmInstance.Open(nil, rest[:nonceSize], rest[nonceSize:], header)
+	if err != nil {
+		return "", err
+	}
+	return string(originalText), nil
+}
+
+// x25519GCM returns the AEAD keyed with the shared secret of an ephemeral key
+// and the key of the recipient, bound to both public keys
+func x25519GCM(shared []byte, ephemeral, recipient *ecdh.PublicKey) (cipher.AEAD, error) {
+	kdf := sha256.New()
+	kdf.Write([]byte(x25519KDFLabel))
+	kdf.Write(shared)
+	kdf.Write(ephemeral.Bytes())
+	kdf.Write(recipient.Bytes())
+
+	aesBlock, err := aes.NewCipher(kdf.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(aesBlock)
+}
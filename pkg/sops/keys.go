@@ -0,0 +1,319 @@
+package sops
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/getsops/sops/v3"
+	"github.com/getsops/sops/v3/keyservice"
+	"google.golang.org/grpc"
+)
+
+// Keys are the master keys the data key of a document can be decrypted with
+type Keys struct {
+	// Age holds the age identities
+	Age []age.Identity
+	// AWS configures the KMS client, nil skips KMS master keys. The region of each
+	// master key overrides it. The role a document names is never assumed, only
+	// the credentials of AWS are used.
+	AWS *aws.Config
+	// PGP holds armored PGP private keys, which are imported into a temporary
+	// keyring to decrypt PGP master keys with
+	PGP []byte
+	// GPG decrypts PGP master keys with the keyring of the gpg binary, or
+	// $SOPS_GPG_EXEC, as well
+	GPG bool
+}
+
+// LoadAgeIdentities reads the age identities from $SOPS_AGE_KEY, $SOPS_AGE_KEY_FILE
+// or the default key file of SOPS, like SOPS does. No identities are returned when
+// there are none.
+func LoadAgeIdentities() ([]age.Identity, error) {
+	if key := os.Getenv("SOPS_AGE_KEY"); key != "" {
+		return age.ParseIdentities(strings.NewReader(key))
+	}
+	path := os.Getenv("SOPS_AGE_KEY_FILE")
+	if path == "" {
+		configDir, err := os.UserConfigDir()
+		if err != nil {
+			return nil, nil
+		}
+		path = filepath.Join(configDir, "sops", "age", "keys.txt")
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return age.ParseIdentities(bytes.NewReader(data))
+}
+
+// keyService decrypts the master keys of a document for SOPS with Keys, instead
+// of the keys SOPS finds in the environment of the process, and records the ids
+// of the master keys that decrypted the data key. It stops decrypting once the
+// data key can be recovered, so that every key group used has a single id.
+type keyService struct {
+	ctx  context.Context
+	keys Keys
+	// needed is the number of key groups the data key is recovered from
+	needed int
+	// keyrings are the gpg homes PGP master keys are decrypted with, where "" is
+	// the default one. They are set up for the first PGP master key.
+	keyrings []string
+	// imported is the gpg home the PGP keys of Keys were imported into
+	imported string
+
+	keyIDs []string
+	errs   []error
+}
+
+// errNoKeys is returned for master keys Keys holds nothing for
+var errNoKeys = errors.New("no keys for the master key")
+
+func newKeyService(ctx context.Context, keys Keys, metadata sops.Metadata) *keyService {
+	needed := 1
+	if len(metadata.KeyGroups) > 1 {
+		needed = metadata.ShamirThreshold
+		if needed == 0 {
+			needed = len(metadata.KeyGroups)
+		}
+	}
+	return &keyService{ctx: ctx, keys: keys, needed: needed}
+}
+
+// Encrypt is never called, as documents are only decrypted
+func (s *keyService) Encrypt(context.Context, *keyservice.EncryptRequest, ...grpc.CallOption) (*keyservice.EncryptResponse, error) {
+	return nil, errors.New("master keys are only decrypted")
+}
+
+// Decrypt decrypts the data key, or share of it, held by a master key. The role
+// and AWS profile of KMS master keys are ignored, documents don't get to pick
+// the credentials of the reader.
+func (s *keyService) Decrypt(_ context.Context, req *keyservice.DecryptRequest, _ ...grpc.CallOption) (*keyservice.DecryptResponse, error) {
+	if len(s.keyIDs) == s.needed {
+		return nil, errors.New("the data key can already be recovered")
+	}
+	var dataKey []byte
+	var keyID string
+	var err error
+	switch key := req.GetKey().GetKeyType().(type) {
+	case *keyservice.Key_AgeKey:
+		if len(s.keys.Age) == 0 {
+			return nil, errNoKeys
+		}
+		if dataKey, keyID, err = decryptAge(req.Ciphertext, s.keys.Age); err != nil {
+			err = fmt.Errorf("age %s: %w", key.AgeKey.Recipient, err)
+		}
+	case *keyservice.Key_KmsKey:
+		if s.keys.AWS == nil {
+			return nil, errNoKeys
+		}
+		if dataKey, keyID, err = decryptKMS(s.ctx, key.KmsKey.Arn, key.KmsKey.Context, req.Ciphertext, *s.keys.AWS); err != nil {
+			err = fmt.Errorf("kms %s: %w", key.KmsKey.Arn, err)
+		}
+	case *keyservice.Key_PgpKey:
+		if dataKey, keyID, err = s.decryptPGP(req.Ciphertext); errors.Is(err, errNoKeys) {
+			return nil, err
+		} else if err != nil {
+			err = fmt.Errorf("pgp %s: %w", key.PgpKey.Fingerprint, err)
+		}
+	default:
+		err = fmt.Errorf("%T master keys aren't supported", key)
+	}
+	if err != nil {
+		s.errs = append(s.errs, err)
+		return nil, err
+	}
+	s.keyIDs = append(s.keyIDs, keyID)
+	return &keyservice.DecryptResponse{Plaintext: dataKey}, nil
+}
+
+// decryptPGP tries the keyring the PGP keys of Keys are imported into, then the
+// keyring of the user when Keys allows it
+func (s *keyService) decryptPGP(ciphertext []byte) ([]byte, string, error) {
+	if s.keyrings == nil {
+		s.keyrings = []string{}
+		if len(s.keys.PGP) > 0 {
+			home, err := importPGPKeys(s.ctx, s.keys.PGP)
+			if err != nil {
+				return nil, "", err
+			}
+			s.imported = home
+			s.keyrings = append(s.keyrings, home)
+		}
+		if s.keys.GPG {
+			s.keyrings = append(s.keyrings, "")
+		}
+	}
+	if len(s.keyrings) == 0 {
+		return nil, "", errNoKeys
+	}
+	var errs []error
+	for _, home := range s.keyrings {
+		dataKey, keyID, err := decryptPGP(s.ctx, ciphertext, home)
+		if err == nil {
+			return dataKey, keyID, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, "", errors.Join(errs...)
+}
+
+// close removes the gpg home the PGP keys were imported into
+func (s *keyService) close() {
+	if s.imported != "" {
+		removeKeyring(s.imported)
+	}
+}
+
+// dataKeyError returns why the data key couldn't be recovered, naming the master
+// keys that failed rather than the summary of SOPS
+func (s *keyService) dataKeyError(err error) error {
+	if len(s.keyIDs) == s.needed {
+		// the shares were decrypted but couldn't be combined
+		return err
+	}
+	cause := errors.Join(s.errs...)
+	if cause == nil {
+		cause = errors.New("no master key that can be decrypted with the available keys")
+	}
+	if s.needed > 1 {
+		return fmt.Errorf("only %d of the %d key groups needed could be decrypted: %w", len(s.keyIDs), s.needed, cause)
+	}
+	return cause
+}
+
+// decryptAge tries the identities one by one on the armored data key and returns
+// it decrypted along with the recipient of the identity that decrypted it
+func decryptAge(ciphertext []byte, identities []age.Identity) ([]byte, string, error) {
+	var errs []error
+	for _, identity := range identities {
+		reader, err := age.Decrypt(armor.NewReader(bytes.NewReader(ciphertext)), identity)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		withRecipient, ok := identity.(interface{ Recipient() *age.X25519Recipient })
+		if !ok {
+			return nil, "", fmt.Errorf("can't name the recipient of the %T identity", identity)
+		}
+		dataKey, err := io.ReadAll(reader)
+		return dataKey, withRecipient.Recipient().String(), err
+	}
+	return nil, "", errors.Join(errs...)
+}
+
+// kmsRegion matches the region of a KMS key ARN
+var kmsRegion = regexp.MustCompile(`^arn:aws[\w-]*:kms:([^:]+):`)
+
+// decryptKMS decrypts the base64 encoded data key with the KMS key of the
+// document. KMS refuses a ciphertext of any other key, and the ARN KMS reports is
+// returned.
+func decryptKMS(ctx context.Context, arn string, encryptionContext map[string]string, encoded []byte, awsConfig aws.Config) ([]byte, string, error) {
+	ciphertext, err := base64.StdEncoding.DecodeString(string(encoded))
+	if err != nil {
+		return nil, "", err
+	}
+	if match := kmsRegion.FindStringSubmatch(arn); match != nil {
+		awsConfig.Region = match[1]
+	}
+
+	decrypted, err := kms.NewFromConfig(awsConfig).Decrypt(ctx, &kms.DecryptInput{
+		CiphertextBlob:    ciphertext,
+		EncryptionContext: encryptionContext,
+		KeyId:             aws.String(arn),
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	if aws.ToString(decrypted.KeyId) == "" {
+		return nil, "", errors.New("KMS didn't report the key it decrypted with")
+	}
+	return decrypted.Plaintext, aws.ToString(decrypted.KeyId), nil
+}
+
+// gpgBinary returns $SOPS_GPG_EXEC, or gpg
+func gpgBinary() string {
+	if gpg := os.Getenv("SOPS_GPG_EXEC"); gpg != "" {
+		return gpg
+	}
+	return "gpg"
+}
+
+// gpgCommand returns a gpg command using the keyring of the gpg home, or the
+// default one when home is empty
+func gpgCommand(ctx context.Context, home string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, gpgBinary(), append([]string{"--batch", "--quiet"}, args...)...)
+	if home != "" {
+		cmd.Env = append(os.Environ(), "GNUPGHOME="+home)
+	}
+	return cmd
+}
+
+// importPGPKeys imports the armored private keys into a new gpg home and returns
+// its path
+func importPGPKeys(ctx context.Context, keys []byte) (string, error) {
+	home, err := os.MkdirTemp("", "sops-gnupg")
+	if err != nil {
+		return "", err
+	}
+	cmd := gpgCommand(ctx, home, "--import")
+	cmd.Stdin = bytes.NewReader(keys)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		removeKeyring(home)
+		return "", fmt.Errorf("failed to import the PGP keys %v %s", err, strings.TrimSpace(string(out)))
+	}
+	return home, nil
+}
+
+// removeKeyring stops the agent gpg started for the gpg home and removes it
+func removeKeyring(home string) {
+	_ = exec.Command("gpgconf", "--homedir", home, "--kill", "all").Run()
+	_ = os.RemoveAll(home)
+}
+
+// decryptPGP decrypts the data key with the keyring of the gpg home and returns
+// it along with the fingerprint of the primary key whose subkey decrypted it, as
+// reported on the status output of gpg
+func decryptPGP(ctx context.Context, ciphertext []byte, home string) ([]byte, string, error) {
+	gpg := gpgBinary()
+	cmd := gpgCommand(ctx, home, "--status-fd", "2", "--decrypt")
+	cmd.Stdin = bytes.NewReader(ciphertext)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	dataKey, err := cmd.Output()
+
+	var fingerprint string
+	var messages []string
+	for _, line := range strings.Split(stderr.String(), "\n") {
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) >= 4 && fields[0] == "[GNUPG:]" && fields[1] == "DECRYPTION_KEY":
+			fingerprint = fields[3]
+		case len(fields) > 0 && fields[0] != "[GNUPG:]":
+			messages = append(messages, line)
+		}
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("%s failed %v %s", gpg, err, strings.Join(messages, " "))
+	}
+	if fingerprint == "" {
+		return nil, "", fmt.Errorf("%s didn't report the key it decrypted with", gpg)
+	}
+	return dataKey, fingerprint, nil
+}
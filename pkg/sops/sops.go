@@ -0,0 +1,98 @@
+// Package sops decrypts documents encrypted by SOPS (https://github.com/getsops/sops)
+// with age, AWS KMS and PGP master keys. Only YAML and JSON documents are supported.
+//
+// Documents are parsed, decrypted and checked with the packages of SOPS. Only the
+// master keys are decrypted here, with the keys given to Decrypt rather than the
+// ones SOPS finds in the environment of the process.
+package sops
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/getsops/sops/v3"
+	"github.com/getsops/sops/v3/aes"
+	"github.com/getsops/sops/v3/config"
+	"github.com/getsops/sops/v3/keyservice"
+	sopsjson "github.com/getsops/sops/v3/stores/json"
+	sopsyaml "github.com/getsops/sops/v3/stores/yaml"
+)
+
+// ErrMACMismatch is returned when the MAC of a document doesn't match its values,
+// which means the document was changed without SOPS
+var ErrMACMismatch = errors.New("the MAC of the document doesn't match its values")
+
+// IsEncrypted reports whether data is a YAML or JSON document encrypted by SOPS
+func IsEncrypted(data []byte) bool {
+	_, err := load(data)
+	return err == nil
+}
+
+// Decrypt decrypts a YAML or JSON document encrypted by SOPS with keys and returns
+// it as YAML without the SOPS metadata. The MAC of the document is checked before
+// anything is returned.
+func Decrypt(ctx context.Context, data []byte, keys Keys) ([]byte, error) {
+	plain, _, err := DecryptWithKeyIDs(ctx, data, keys)
+	return plain, err
+}
+
+// DecryptWithKeyIDs decrypts data like Decrypt and also returns the ids of the
+// master keys the data key was decrypted with, one for every key group used
+func DecryptWithKeyIDs(ctx context.Context, data []byte, keys Keys) ([]byte, []string, error) {
+	tree, err := load(data)
+	if errors.Is(err, sops.MetadataNotFound) {
+		return nil, nil, errors.New("the document isn't encrypted by SOPS, it has no sops metadata")
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	service := newKeyService(ctx, keys, tree.Metadata)
+	defer service.close()
+	dataKey, err := tree.Metadata.GetDataKeyWithKeyServices([]keyservice.KeyServiceClient{service}, nil)
+	if err != nil {
+		return nil, nil, service.dataKeyError(err)
+	}
+
+	cipher := aes.NewCipher()
+	computed, err := tree.Decrypt(dataKey, cipher)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decrypt the document %v", err)
+	}
+	mac, err := cipher.Decrypt(tree.Metadata.MessageAuthenticationCode, dataKey, tree.Metadata.LastModified.Format(time.RFC3339))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decrypt the MAC %v", err)
+	}
+	if macString, ok := mac.(string); !ok || subtle.ConstantTimeCompare([]byte(macString), []byte(computed)) != 1 {
+		return nil, nil, ErrMACMismatch
+	}
+
+	plain, err := sopsyaml.NewStore(&config.YAMLStoreConfig{Indent: 2}).EmitPlainFile(tree.Branches)
+	if err != nil {
+		return nil, nil, err
+	}
+	return plain, service.keyIDs, nil
+}
+
+// load parses a document encrypted by SOPS with the JSON store of SOPS when it is
+// a JSON object and with the YAML one otherwise
+func load(data []byte) (sops.Tree, error) {
+	var tree sops.Tree
+	var err error
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		tree, err = sopsjson.NewStore(&config.JSONStoreConfig{}).LoadEncryptedFile(data)
+	} else {
+		tree, err = sopsyaml.NewStore(&config.YAMLStoreConfig{}).LoadEncryptedFile(data)
+	}
+	if err != nil {
+		return tree, err
+	}
+	if len(tree.Branches) != 1 {
+		return tree, errors.New("documents with more than one YAML document aren't supported")
+	}
+	return tree, nil
+}
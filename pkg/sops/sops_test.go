@@ -0,0 +1,318 @@
+package sops
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"gopkg.in/yaml.v3"
+)
+
+// The fixtures in testdata were encrypted by sops 3.9.0 with generate.sh
+
+const (
+	ageRecipient  = "age1agaju97fcnd5yhss5v49qp6n0ccrxk3w98sys73dqkg5fgjmps8s322wku"
+	pgpPrimaryKey = "3A03ADA38EE6DEAA7DE2BA5C9677353B82E7346E"
+	kmsKeyARN     = "arn:aws:kms:eu-west-1:111122223333:key/0f1e2d3c-4b5a-6978-8796-a5b4c3d2e1f0"
+)
+
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// ageIdentities returns the identities of age.txt, the first one being the
+// recipient of the age fixtures
+func ageIdentities(t *testing.T) []age.Identity {
+	identities, err := age.ParseIdentities(bytes.NewReader(readFixture(t, "age.txt")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return identities
+}
+
+// useGPGKey imports the key of pgp.asc into the keyring of a temporary
+// GNUPGHOME
+func useGPGKey(t *testing.T) {
+	if _, err := exec.LookPath("gpg"); err != nil {
+		t.Skip("gpg isn't installed")
+	}
+	home, err := os.MkdirTemp("", "gnupg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = exec.Command("gpgconf", "--homedir", home, "--kill", "all").Run()
+		os.RemoveAll(home)
+	})
+	t.Setenv("GNUPGHOME", home)
+	cmd := exec.Command("gpg", "--batch", "--quiet", "--import")
+	cmd.Stdin = bytes.NewReader(readFixture(t, "pgp.asc"))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("failed to import the key %v %s", err, out)
+	}
+}
+
+// fakeKMS decrypts the ciphertext blobs of testdata/fakekms, checking the
+// encryption context and the key like KMS does, and records the requests
+type fakeKMS struct {
+	requests []map[string]interface{}
+}
+
+func (f *fakeKMS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		KeyId             string
+		CiphertextBlob    []byte
+		EncryptionContext map[string]string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || r.Header.Get("X-Amz-Target") != "TrentService.Decrypt" {
+		http.Error(w, `{"__type":"UnsupportedOperationException"}`, http.StatusBadRequest)
+		return
+	}
+	f.requests = append(f.requests, map[string]interface{}{"KeyId": req.KeyId, "EncryptionContext": req.EncryptionContext})
+
+	parts := strings.SplitN(string(req.CiphertextBlob), "\n", 3)
+	var context []string
+	for name, value := range req.EncryptionContext {
+		context = append(context, name+"="+value)
+	}
+	sort.Strings(context)
+	if len(parts) != 3 || parts[1] != strings.Join(context, ",") {
+		http.Error(w, `{"__type":"InvalidCiphertextException"}`, http.StatusBadRequest)
+		return
+	}
+	if req.KeyId != "" && req.KeyId != parts[0] {
+		http.Error(w, `{"__type":"IncorrectKeyException"}`, http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"Plaintext": []byte(parts[2]), "KeyId": parts[0]})
+}
+
+// awsConfig returns an AWS configuration calling the fake KMS
+func (f *fakeKMS) awsConfig(t *testing.T) *aws.Config {
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	return &aws.Config{
+		Region:      "us-east-1",
+		Credentials: aws.AnonymousCredentials{},
+		EndpointResolverWithOptions: aws.EndpointResolverWithOptionsFunc(func(service, region string, _ ...interface{}) (aws.Endpoint, error) {
+			return aws.Endpoint{URL: server.URL}, nil
+		}),
+	}
+}
+
+// plainValues decodes a YAML or JSON document for comparing its values
+func plainValues(t *testing.T, data []byte) string {
+	t.Helper()
+	var values map[string]interface{}
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprint(values)
+}
+
+func TestDecryptFixtures(t *testing.T) {
+	useGPGKey(t)
+	kms := &fakeKMS{}
+	keys := Keys{Age: ageIdentities(t), AWS: kms.awsConfig(t), GPG: true}
+	secret := plainValues(t, readFixture(t, "secret.yaml"))
+
+	for _, test := range []struct {
+		fixture string
+		keyIDs  []string
+		plain   string
+	}{
+		{fixture: "secret.age.yaml", keyIDs: []string{ageRecipient}, plain: secret},
+		{fixture: "values.age.json", keyIDs: []string{ageRecipient}, plain: plainValues(t, readFixture(t, "values.json"))},
+		{fixture: "secret.pgp.yaml", keyIDs: []string{pgpPrimaryKey}, plain: secret},
+		{fixture: "secret.kms.yaml", keyIDs: []string{kmsKeyARN}, plain: secret},
+		// the first two of the three key groups are enough
+		{fixture: "secret.shamir.yaml", keyIDs: []string{ageRecipient, pgpPrimaryKey}, plain: secret},
+	} {
+		t.Run(test.fixture, func(t *testing.T) {
+			encrypted := readFixture(t, test.fixture)
+			if !IsEncrypted(encrypted) {
+				t.Fatal("expected the fixture to be reported as encrypted")
+			}
+			decrypted, keyIDs, err := DecryptWithKeyIDs(context.Background(), encrypted, keys)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(keyIDs) != fmt.Sprint(test.keyIDs) {
+				t.Fatalf("expected the master keys %v, got %v", test.keyIDs, keyIDs)
+			}
+			if got := plainValues(t, decrypted); got != test.plain {
+				t.Fatalf("got\n%s\nwant\n%s", got, test.plain)
+			}
+		})
+	}
+
+	if len(kms.requests) != 1 {
+		t.Fatalf("expected a single KMS request, got %v", kms.requests)
+	}
+	if context := fmt.Sprint(kms.requests[0]["EncryptionContext"]); context != "map[app:db team:payments]" {
+		t.Fatalf("expected the encryption context of the document, got %s", context)
+	}
+	if keyID := kms.requests[0]["KeyId"]; keyID != kmsKeyARN {
+		t.Fatalf("expected KMS to be asked for the key of the document, got %v", keyID)
+	}
+}
+
+func TestDecryptReportsTheKeyThatDecrypted(t *testing.T) {
+	useGPGKey(t)
+	kms := &fakeKMS{}
+	keys := Keys{Age: ageIdentities(t), AWS: kms.awsConfig(t), GPG: true}
+	// the master keys aren't covered by the MAC, a document can claim any key
+	otherARN := strings.Replace(kmsKeyARN, "0f1e2d3c", "aaaaaaaa", 1)
+	for _, test := range []struct {
+		fixture, claimed, claim, keyID string
+	}{
+		{fixture: "secret.age.yaml", claimed: ageRecipient, claim: "age1allowed", keyID: ageRecipient},
+		{fixture: "secret.pgp.yaml", claimed: pgpPrimaryKey, claim: "ALLOWED", keyID: pgpPrimaryKey},
+	} {
+		encrypted := bytes.Replace(readFixture(t, test.fixture), []byte(test.claimed), []byte(test.claim), 1)
+		_, keyIDs, err := DecryptWithKeyIDs(context.Background(), encrypted, keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keyIDs) != 1 || keyIDs[0] != test.keyID {
+			t.Fatalf("%s: expected the key that decrypted, %s, got %v", test.fixture, test.keyID, keyIDs)
+		}
+	}
+
+	// KMS refuses to decrypt the data key with another key than its own
+	encrypted := bytes.Replace(readFixture(t, "secret.kms.yaml"), []byte(kmsKeyARN), []byte(otherARN), 1)
+	if _, err := Decrypt(context.Background(), encrypted, keys); err == nil || !strings.Contains(err.Error(), "IncorrectKeyException") {
+		t.Fatalf("expected KMS to refuse the key of another ciphertext, got %v", err)
+	}
+}
+
+func TestDecryptWithPGPKeys(t *testing.T) {
+	if _, err := exec.LookPath("gpg"); err != nil {
+		t.Skip("gpg isn't installed")
+	}
+	// the default keyring doesn't hold the key
+	t.Setenv("GNUPGHOME", t.TempDir())
+	encrypted := readFixture(t, "secret.pgp.yaml")
+	if _, err := Decrypt(context.Background(), encrypted, Keys{GPG: true}); err == nil {
+		t.Fatal("expected the default keyring not to decrypt the fixture")
+	}
+
+	_, keyIDs, err := DecryptWithKeyIDs(context.Background(), encrypted, Keys{PGP: readFixture(t, "pgp.asc")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keyIDs) != 1 || keyIDs[0] != pgpPrimaryKey {
+		t.Fatalf("expected the master key %s, got %v", pgpPrimaryKey, keyIDs)
+	}
+}
+
+func TestDecryptIgnoresTheRoleOfKMSKeys(t *testing.T) {
+	kms := &fakeKMS{}
+	// the fake KMS doesn't serve STS, assuming the role would fail
+	encrypted := bytes.Replace(readFixture(t, "secret.kms.yaml"), []byte("          aws_profile: \"\""),
+		[]byte("          role: arn:aws:iam::111122223333:role/admin\n          aws_profile: \"\""), 1)
+	if !bytes.Contains(encrypted, []byte("role/admin")) {
+		t.Fatal("expected the role to be added to the fixture")
+	}
+	if _, err := Decrypt(context.Background(), encrypted, Keys{AWS: kms.awsConfig(t)}); err != nil {
+		t.Fatal(err)
+	}
+	if len(kms.requests) != 1 {
+		t.Fatalf("expected a single KMS request, got %v", kms.requests)
+	}
+}
+
+func TestDecryptChecksTheMAC(t *testing.T) {
+	encrypted := readFixture(t, "secret.age.yaml")
+	keys := Keys{Age: ageIdentities(t)}
+	if IsEncrypted(readFixture(t, "secret.yaml")) {
+		t.Fatal("expected the plain document not to be reported as encrypted")
+	}
+
+	// changing an unencrypted value breaks the MAC
+	tampered := bytes.Replace(encrypted, []byte("name: db"), []byte("name: dc"), 1)
+	if _, err := Decrypt(context.Background(), tampered, keys); !errors.Is(err, ErrMACMismatch) {
+		t.Fatalf("expected a MAC mismatch, got %v", err)
+	}
+
+	// so does swapping encrypted values
+	var document map[string]interface{}
+	if err := yaml.Unmarshal(encrypted, &document); err != nil {
+		t.Fatal(err)
+	}
+	stringData := document["stringData"].(map[string]interface{})
+	swapped := bytes.Replace(encrypted, []byte(stringData["password"].(string)), []byte(stringData["port"].(string)), 1)
+	if _, err := Decrypt(context.Background(), swapped, keys); err == nil {
+		t.Fatal("expected a value moved to another key to fail")
+	}
+
+	// other identities can't decrypt the data key
+	other, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Decrypt(context.Background(), encrypted, Keys{Age: []age.Identity{other}}); err == nil {
+		t.Fatal("expected decrypting with another identity to fail")
+	}
+}
+
+func TestDecryptNeedsEnoughKeyGroups(t *testing.T) {
+	encrypted := readFixture(t, "secret.shamir.yaml")
+
+	// both age groups are enough without gpg
+	_, keyIDs, err := DecryptWithKeyIDs(context.Background(), encrypted, Keys{Age: ageIdentities(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keyIDs) != 2 || keyIDs[0] != ageRecipient || !strings.HasPrefix(keyIDs[1], "age1") {
+		t.Fatalf("unexpected master keys %v", keyIDs)
+	}
+
+	if _, err := Decrypt(context.Background(), encrypted, Keys{Age: ageIdentities(t)[:1]}); err == nil ||
+		!strings.Contains(err.Error(), "only 1 of the 2 key groups") {
+		t.Fatalf("expected the missing key group to be reported, got %v", err)
+	}
+
+	// the MAC is checked with the data key combined from the shares
+	tampered := bytes.Replace(encrypted, []byte("name: db"), []byte("name: dc"), 1)
+	if _, err := Decrypt(context.Background(), tampered, Keys{Age: ageIdentities(t)}); !errors.Is(err, ErrMACMismatch) {
+		t.Fatalf("expected a MAC mismatch, got %v", err)
+	}
+}
+
+func TestDecryptWithoutKMSCredentials(t *testing.T) {
+	encrypted := readFixture(t, "secret.kms.yaml")
+	if _, err := Decrypt(context.Background(), encrypted, Keys{Age: ageIdentities(t)}); err == nil ||
+		!strings.Contains(err.Error(), "no master key") {
+		t.Fatalf("expected KMS master keys to be skipped without an AWS configuration, got %v", err)
+	}
+
+	// the fake KMS refuses another encryption context
+	kms := &fakeKMS{}
+	changed := bytes.Replace(encrypted, []byte("team: payments"), []byte("team: billing"), 1)
+	if _, err := Decrypt(context.Background(), changed, Keys{AWS: kms.awsConfig(t)}); err == nil {
+		t.Fatal("expected another encryption context to fail")
+	}
+	if enc := base64.StdEncoding.EncodeToString([]byte(kmsKeyARN)); !bytes.Contains(encrypted, []byte(enc[:40])) {
+		t.Fatal("expected the data key to be encrypted by the fake KMS")
+	}
+}
@@ -0,0 +1,35 @@
+// Command fakekms serves the Encrypt call of AWS KMS for generating the KMS
+// fixtures with sops. The ciphertext blob is the key ARN, the encryption context
+// and the plaintext separated by newlines, which fakeKMS of the tests decrypts.
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+func main() {
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			KeyId             string
+			Plaintext         []byte
+			EncryptionContext map[string]string
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || r.Header.Get("X-Amz-Target") != "TrentService.Encrypt" {
+			http.Error(w, `{"__type":"UnsupportedOperationException"}`, http.StatusBadRequest)
+			return
+		}
+		var context []string
+		for name, value := range req.EncryptionContext {
+			context = append(context, name+"="+value)
+		}
+		sort.Strings(context)
+		blob := req.KeyId + "\n" + strings.Join(context, ",") + "\n" + string(req.Plaintext)
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"CiphertextBlob": []byte(blob), "KeyId": req.KeyId})
+	})
+	log.Fatal(http.ListenAndServe("127.0.0.1:4599", nil))
+}
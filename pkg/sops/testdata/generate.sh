@@ -0,0 +1,32 @@
+#!/bin/sh
+# Regenerates the encrypted fixtures with the sops 3.9.0 binary, run from this
+# directory.
+# age.txt holds the age identities and pgp.asc the PGP key without a passphrase.
+set -eu
+
+AGE1=age1agaju97fcnd5yhss5v49qp6n0ccrxk3w98sys73dqkg5fgjmps8s322wku
+PGP=3A03ADA38EE6DEAA7DE2BA5C9677353B82E7346E
+KMS=arn:aws:kms:eu-west-1:111122223333:key/0f1e2d3c-4b5a-6978-8796-a5b4c3d2e1f0
+
+GNUPGHOME=$(mktemp -d)
+export GNUPGHOME
+gpg --batch --quiet --import pgp.asc
+
+# KMS master keys are encrypted by a fake KMS, built first so that the server
+# itself is stopped rather than go run
+go build -o "$GNUPGHOME/fakekms" ./fakekms
+"$GNUPGHOME/fakekms" &
+trap 'kill $!; gpgconf --kill all; rm -rf "$GNUPGHOME"' EXIT
+sleep 2
+export AWS_ENDPOINT_URL=http://127.0.0.1:4599 AWS_ACCESS_KEY_ID=fixture AWS_SECRET_ACCESS_KEY=fixture AWS_REGION=eu-west-1
+
+# without a .sops.yaml in the way, except for the Shamir fixture
+cd "$(mktemp -d)"
+cp "$OLDPWD"/secret.yaml "$OLDPWD"/values.json .
+sops --encrypt --age $AGE1 --encrypted-regex '^(data|stringData)$' secret.yaml > "$OLDPWD"/secret.age.yaml
+sops --encrypt --age $AGE1 values.json > "$OLDPWD"/values.age.json
+sops --encrypt --pgp $PGP --encrypted-regex '^(data|stringData)$' secret.yaml > "$OLDPWD"/secret.pgp.yaml
+sops --encrypt --kms $KMS --encryption-context app:db,team:payments --encrypted-regex '^(data|stringData)$' \
+	secret.yaml > "$OLDPWD"/secret.kms.yaml
+cp "$OLDPWD"/shamir.sops.yaml .sops.yaml
+sops --encrypt secret.yaml > "$OLDPWD"/secret.shamir.yaml
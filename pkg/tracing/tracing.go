@@ -0,0 +1,103 @@
+// Package tracing sets up the OpenTelemetry tracer provider of the operator.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+)
+
+const (
+	// ExporterNone disables tracing
+	ExporterNone = "none"
+	// ExporterOTLP sends the spans to an OTLP collector over gRPC
+	ExporterOTLP = "otlp"
+	// ExporterStdout writes the spans as JSON to stdout or a file, for local testing
+	ExporterStdout = "stdout"
+
+	serviceName = "encrypted-secrets-operator"
+)
+
+// Options configures the exporter of the spans
+type Options struct {
+	// Exporter is one of none, otlp or stdout
+	Exporter string
+	// Endpoint is the host:port of the OTLP collector. The OTEL_EXPORTER_OTLP_*
+	// environment variables apply when it is empty.
+	Endpoint string
+	// Insecure disables TLS towards the OTLP collector
+	Insecure bool
+	// File receives the spans of the stdout exporter instead of stdout
+	File string
+}
+
+// Setup installs the global tracer provider for opts and returns the function
+// flushing and stopping it
+func Setup(ctx context.Context, opts Options) (func(context.Context) error, error) {
+	var exporter sdktrace.SpanExporter
+	var closer io.Closer
+
+	switch opts.Exporter {
+	case "", ExporterNone:
+		return func(context.Context) error { return nil }, nil
+	case ExporterOTLP:
+		var clientOpts []otlptracegrpc.Option
+		if opts.Endpoint != "" {
+			clientOpts = append(clientOpts, otlptracegrpc.WithEndpoint(opts.Endpoint))
+		}
+		if opts.Insecure {
+			clientOpts = append(clientOpts, otlptracegrpc.WithInsecure())
+		}
+		otlpExporter, err := otlptracegrpc.New(ctx, clientOpts...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create the OTLP exporter %v", err)
+		}
+		exporter = otlpExporter
+	case ExporterStdout:
+		var writer io.Writer = os.Stdout
+		if opts.File != "" {
+			file, err := os.OpenFile(opts.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+			if err != nil {
+				return nil, fmt.Errorf("failed to open the trace file %v", err)
+			}
+			writer, closer = file, file
+		}
+		stdoutExporter, err := stdouttrace.New(stdouttrace.WithWriter(writer))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create the stdout exporter %v", err)
+		}
+		exporter = stdoutExporter
+	default:
+		return nil, fmt.Errorf("invalid trace exporter %s", opts.Exporter)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(semconv.ServiceName(serviceName)))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if closer != nil {
+			if closeErr := closer.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		return err
+	}, nil
+}